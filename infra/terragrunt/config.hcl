@@ -68,7 +68,10 @@ locals {
   // tagging strategy. These tags enable cost tracking, compliance monitoring, and
   // comprehensive resource management across the entire infrastructure.
   // Ensure all tags are meaningful, descriptive, and follow organizational standards.
-  tags = local.cfg_tags.tags
+  tags = merge(
+    local.cfg_tags.tags,
+    local.is_preview ? { PreviewId = local.preview_id } : {}
+  )
 
   // 🔖 Project Metadata Management
   // Maintains consistent project identification across infrastructure by providing
@@ -78,6 +81,21 @@ locals {
   product_name    = local.cfg_app.product_name
   product_version = local.cfg_app.product_version
 
+  // 🔍 Preview Environment Namespacing
+  // Enables ephemeral, isolated deployments of a stack (e.g., per branch or merge request) by
+  // namespacing the remote state key and the resource name prefix with a preview identifier.
+  // Set TG_STACK_PREVIEW_ID (normally done by the preview pipeline jobs) to enable it; when it's
+  // empty, the regular environment's state and naming are used. The ID is normalised the same way the
+  // pipeline does (lowercased, non-alphanumeric runs replaced with '-', up to 32 characters), so the
+  // apply and the teardown of a preview always resolve to the same state key and resource names.
+  // Longer IDs keep their first 23 characters, and end with the first 8 characters of their SHA-256,
+  // so branches sharing a long prefix don't share a preview.
+  preview_id_unnormalized = get_env("TG_STACK_PREVIEW_ID", "")
+  preview_id_full         = trim(replace(lower(trimspace(local.preview_id_unnormalized)), "/[^a-z0-9]+/", "-"), "-")
+  preview_id              = length(local.preview_id_full) > 32 ? format("%s-%s", trim(substr(local.preview_id_full, 0, 23), "-"), substr(sha256(local.preview_id_full), 0, 8)) : local.preview_id_full
+  is_preview              = local.preview_id != ""
+  resource_name_prefix    = local.is_preview ? format("%s-%s", local.product_name, local.preview_id) : local.product_name
+
   // 🌍 Runtime Environment Configuration
   // Provides flexible, environment-driven configuration with sensible defaults to
   // support multi-environment deployments. Allows runtime configuration flexibility
@@ -86,6 +104,12 @@ locals {
   deployment_region_unnormalized = get_env("TG_STACK_DEPLOYMENT_REGION", "us-east-1")
   deployment_region              = lower(trimspace(local.deployment_region_unnormalized))
 
+  // 🗺️ Region-Scoped Remote State
+  // Allows the same stack to be deployed to several regions without sharing state. When
+  // TG_STACK_REMOTE_STATE_KEY_REGION_SCOPED is set to "true", the deployment region becomes
+  // part of the remote state key (see remote_state_key_path in root.hcl).
+  remote_state_key_region_scoped = lower(trimspace(get_env("TG_STACK_REMOTE_STATE_KEY_REGION_SCOPED", "false"))) == "true"
+
   // 💾 Remote State Management
   // Configures and standardizes Terraform state storage by centralizing remote state
   // configuration. Ensures consistent state management across all infrastructure units,
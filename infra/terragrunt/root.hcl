@@ -39,16 +39,20 @@ locals {
 
   // 🔑 Remote State Key Path Generation
   // Constructs a standardized, hierarchical key for Terraform remote state that reflects the infrastructure's logical structure.
-  // Format: <product_name>/<environment>/<unit-path>-<state_object_basename>
+  // Format: <product_name>/<environment>/[<region>/][previews/<preview_id>/]<unit-path>-<state_object_basename>
   // Example: myapp/global/dns-dns_zone-terraform.tfstate.json
-  remote_state_key_path = join("/", [
+  // Example (region-scoped): myapp/global/eu-west-1/dns-dns_zone-terraform.tfstate.json
+  // Example (preview): myapp/dev/previews/mr-42/dns-dns_zone-terraform.tfstate.json
+  remote_state_key_path = join("/", compact([
     local.cfg.locals.product_name,
     local.deployment_environment,
+    local.cfg.locals.remote_state_key_region_scoped ? local.deployment_region : "",
+    local.cfg.locals.is_preview ? "previews/${local.cfg.locals.preview_id}" : "",
     format("%s-%s",
       replace(trimprefix(local.path_relative_to_include, "${local.deployment_environment}/"), "/", "-"),
       local.cfg.locals.state_object_basename
     )
-  ])
+  ]))
 
   // 🔌 Dynamic Provider Loading
   // Enables flexible, unit-specific provider configuration by dynamically loading provider settings.
@@ -122,6 +126,8 @@ terraform {
   echo_deployment_stack                    = run_cmd("sh", "-c", "echo '🏞️  Deployment Stack: ${local.deployment_stack}'")
   echo_environment_name                    = run_cmd("sh", "-c", "echo '🏞️  Environment Name: ${local.deployment_environment}'")
   echo_remote_state_key_path               = run_cmd("sh", "-c", "echo '🔑  Remote State Key Path: ${local.remote_state_key_path}'")
+  echo_resource_name_prefix                = run_cmd("sh", "-c", "echo '🏷️  Resource Name Prefix: ${local.cfg.locals.resource_name_prefix}'")
+  echo_preview_id                          = run_cmd("sh", "-c", "echo '🔍  Preview ID: ${local.cfg.locals.is_preview ? local.cfg.locals.preview_id : "(none)"}'")
   echo_is_using_providers_then_true        = run_cmd("sh", "-c", "echo '🔌  Is Using Providers: ${length(local.dynamic_providers) > 0 ? "true" : "false"}'")
   echo_is_overwriting_versionstf_then_true = run_cmd("sh", "-c", "echo '🔧  Is Overwriting Versions: ${length(local.dynamic_versions) > 0 ? "true" : "false"}'")
 
@@ -183,6 +189,16 @@ remote_state {
   }
 }
 
+// 🏷️ Shared Naming Inputs
+// Passes the naming context to every unit (deep-merged with the unit's own inputs), so modules build the
+// names of their resources from resource_name_prefix instead of hardcoding them. In a preview environment
+// the prefix includes the preview ID (e.g., myapp-mr-42), so a preview never collides with, nor clobbers,
+// the resources of the environment it's based on.
+inputs = {
+  product_name         = local.cfg.locals.product_name
+  resource_name_prefix = local.cfg.locals.resource_name_prefix
+}
+
 // 🚀 Dynamic Provider Configuration
 // This block generates provider settings dynamically for each infrastructure unit.
 // By doing so, it allows for a more flexible and manageable configuration of providers,
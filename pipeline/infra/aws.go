@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	awsAssumeRoleOutputPath   = "/tmp/aws-assume-role.json"
+	awsConfigRootPath         = "/root/.aws"
+	awsConfigFilePath         = awsConfigRootPath + "/config"
+	awsCredentialsFilePath    = awsConfigRootPath + "/credentials"
+	awsSSOCacheRootPath       = awsConfigRootPath + "/sso/cache"
+	awsDefaultProfile         = "default"
+	awsConfigProfilePrefix    = "profile "
+	awsSSOCacheFileGlobFilter = "*.json"
+	awsRoleMappingDefaultKey  = "*"
+)
+
+var (
+	// awsCredentialsSourceEnvVars are the variables the AWS CLI gets credentials from (or the profile to get them).
+	awsCredentialsSourceEnvVars = []string{
+		"AWS_ACCESS_KEY_ID",
+		"AWS_WEB_IDENTITY_TOKEN_FILE",
+		"AWS_PROFILE",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+	}
+	awsRoleARNRegex     = regexp.MustCompile(`^arn:aws[a-z-]*:iam::(\d{12}):role/[\w+=,.@/-]+$`)
+	awsAccountIDRegex   = regexp.MustCompile(`^\d{12}$`)
+	awsProfileNameRegex = regexp.MustCompile(`^[\w+=,.@-]+$`)
+)
+
+// AWSCallerIdentity represents the output of 'aws sts get-caller-identity'.
+type AWSCallerIdentity struct {
+	Account string `json:"Account"` // Account is the AWS account ID of the caller.
+	Arn     string `json:"Arn"`     // Arn is the ARN of the caller (user, or assumed role).
+	UserID  string `json:"UserId"`  // UserID is the unique identifier of the caller.
+}
+
+// awsAssumeRoleOutput represents the output of 'aws sts assume-role'.
+type awsAssumeRoleOutput struct {
+	Credentials struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		SessionToken    string `json:"SessionToken"`
+	} `json:"Credentials"`
+}
+
+// WithAWSCLIInstalled installs the AWS CLI in the container.
+//
+// The AWS CLI is used to assume roles, and to check the caller identity before running Terragrunt.
+//
+// Returns:
+//   - The updated Infra instance with the AWS CLI installed
+func (m *Infra) WithAWSCLIInstalled() *Infra {
+	m.Ctr = m.Ctr.
+		WithExec([]string{"apk", "add", "--no-cache", "aws-cli"})
+
+	return m
+}
+
+// WithAWSConfig sets the AWS shared configuration in the container, and selects the profile to use.
+//
+// It mounts the AWS config file, the credentials file and the SSO cache (e.g., ~/.aws/config,
+// ~/.aws/credentials and ~/.aws/sso/cache) as secret files under /root/.aws, and sets AWS_PROFILE. This is
+// what allows running the jobs locally with AWS SSO profiles (after 'aws sso login'), instead of static keys.
+// Any AWS keys already set are removed, since they take precedence over the profile.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - awsProfile: Optional. The AWS profile to use. Defaults to the 'default' profile.
+//   - awsConfig: Optional. The AWS config file (~/.aws/config).
+//   - awsCredentials: Optional. The AWS credentials file (~/.aws/credentials).
+//   - awsSsoCache: Optional. The AWS SSO cache directory (~/.aws/sso/cache).
+//   - awsRegion: Optional. The AWS region. If not set, the region of the profile is used.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the AWS shared configuration set
+//   - error: An error if no configuration is passed, or the profile isn't in it
+func (m *Infra) WithAWSConfig(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// awsProfile is the AWS profile to use. Defaults to the 'default' profile.
+	// +optional
+	awsProfile string,
+	// awsConfig is the AWS config file (~/.aws/config).
+	// +optional
+	awsConfig *dagger.Secret,
+	// awsCredentials is the AWS credentials file (~/.aws/credentials).
+	// +optional
+	awsCredentials *dagger.Secret,
+	// awsSsoCache is the AWS SSO cache directory (~/.aws/sso/cache).
+	// +optional
+	awsSsoCache *dagger.Directory,
+	// awsRegion is the AWS region. If not set, the region of the profile is used.
+	// +optional
+	awsRegion string,
+) (*Infra, error) {
+	if awsConfig == nil && awsCredentials == nil {
+		return nil, NewError("either the AWS config file, or the AWS credentials file, is required to use an AWS profile")
+	}
+
+	awsProfile = strings.TrimSpace(awsProfile)
+	if awsProfile == "" {
+		awsProfile = awsDefaultProfile
+	}
+
+	if !awsProfileNameRegex.MatchString(awsProfile) {
+		return nil, Errorf("invalid AWS profile name %q", awsProfile)
+	}
+
+	var configContent, credentialsContent string
+
+	if awsConfig != nil {
+		content, err := awsConfig.Plaintext(ctx)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read the AWS config file")
+		}
+
+		configContent = content
+	}
+
+	if awsCredentials != nil {
+		content, err := awsCredentials.Plaintext(ctx)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read the AWS credentials file")
+		}
+
+		credentialsContent = content
+	}
+
+	if !awsProfileExists(configContent, credentialsContent, awsProfile) {
+		return nil, Errorf("the AWS profile %s isn't defined in the AWS config, or credentials, file", awsProfile)
+	}
+
+	m.Ctr = m.Ctr.
+		WithoutEnvVariable("AWS_ACCESS_KEY_ID").
+		WithoutEnvVariable("AWS_SECRET_ACCESS_KEY").
+		WithoutEnvVariable("AWS_SESSION_TOKEN").
+		WithoutEnvVariable("AWS_ROLE_ARN").
+		WithoutEnvVariable("AWS_WEB_IDENTITY_TOKEN_FILE").
+		WithEnvVariable("AWS_PROFILE", awsProfile).
+		// Some tools (and older AWS SDKs) only read the config file when this is set.
+		WithEnvVariable("AWS_SDK_LOAD_CONFIG", "1")
+
+	if awsConfig != nil {
+		m.Ctr = m.Ctr.
+			WithMountedSecret(awsConfigFilePath, awsConfig, dagger.ContainerWithMountedSecretOpts{Mode: 0o600}).
+			WithEnvVariable("AWS_CONFIG_FILE", awsConfigFilePath)
+	}
+
+	if awsCredentials != nil {
+		m.Ctr = m.Ctr.
+			WithMountedSecret(awsCredentialsFilePath, awsCredentials, dagger.ContainerWithMountedSecretOpts{Mode: 0o600}).
+			WithEnvVariable("AWS_SHARED_CREDENTIALS_FILE", awsCredentialsFilePath)
+	}
+
+	if awsSsoCache != nil {
+		// The SSO cache holds access tokens, so each file is mounted as a secret, instead of mounting the directory.
+		cacheFiles, err := awsSsoCache.Glob(ctx, awsSSOCacheFileGlobFilter)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to list the AWS SSO cache files")
+		}
+
+		for _, cacheFile := range cacheFiles {
+			content, err := awsSsoCache.File(cacheFile).Contents(ctx)
+			if err != nil {
+				return nil, WrapErrorf(err, "failed to read the AWS SSO cache file %s", cacheFile)
+			}
+
+			cacheFileName := filepath.Base(cacheFile)
+			cacheSecret := dag.SetSecret("AWS_SSO_CACHE_"+cacheFileName, content)
+
+			m.Ctr = m.Ctr.
+				WithMountedSecret(filepath.Join(awsSSOCacheRootPath, cacheFileName), cacheSecret, dagger.ContainerWithMountedSecretOpts{Mode: 0o600})
+		}
+	}
+
+	if awsRegion != "" {
+		m.Ctr = m.Ctr.
+			WithEnvVariable("AWS_REGION", awsRegion)
+	}
+
+	return m, nil
+}
+
+// awsProfileExists checks whether a profile is defined in the AWS config file ([profile NAME], or [default]),
+// or in the AWS credentials file ([NAME]).
+func awsProfileExists(configContent, credentialsContent, profile string) bool {
+	configSection := awsConfigProfilePrefix + profile
+	if profile == awsDefaultProfile {
+		configSection = awsDefaultProfile
+	}
+
+	for _, section := range getINISections(configContent) {
+		if section == configSection {
+			return true
+		}
+	}
+
+	for _, section := range getINISections(credentialsContent) {
+		if section == profile {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getINISections returns the names of the sections ([NAME]) of an INI file, such as the AWS config file.
+func getINISections(content string) []string {
+	var sections []string
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			sections = append(sections, strings.Join(strings.Fields(line[1:len(line)-1]), " "))
+		}
+	}
+
+	return sections
+}
+
+// WithAWSAssumeRole assumes an IAM role, and sets the temporary credentials in the container.
+//
+// The role is assumed with the credentials already configured in the container (keys, OIDC, etc.), and the
+// temporary credentials replace them as secret variables. The output of 'aws sts assume-role' is redirected to a
+// file, so the credentials are never printed in the logs. Afterwards, the caller identity is checked against the
+// account of the role, failing if they don't match.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - roleARN: The ARN of the IAM role to assume.
+//   - roleSessionName: Optional. The name of the assumed role session.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the temporary credentials of the role
+//   - error: An error if the role can't be assumed, or the caller identity doesn't match the role's account
+func (m *Infra) WithAWSAssumeRole(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// roleARN is the ARN of the IAM role to assume.
+	roleARN string,
+	// roleSessionName is the name of the assumed role session.
+	// +optional
+	roleSessionName string,
+) (*Infra, error) {
+	expectedAccountID, err := getAWSAccountIDFromRoleARN(roleARN)
+	if err != nil {
+		return nil, err
+	}
+
+	if roleSessionName == "" {
+		// The session name is unique, which also prevents the assume-role call from being cached.
+		roleSessionName = fmt.Sprintf("terragrunt-dagger-%s", uuid.New().String())
+	}
+
+	m = m.WithAWSCLIInstalled()
+
+	assumeRoleCtr := m.Ctr.
+		WithExec([]string{
+			"aws", "sts", "assume-role",
+			"--role-arn", roleARN,
+			"--role-session-name", roleSessionName,
+			"--output", "json",
+		}, dagger.ContainerWithExecOpts{
+			RedirectStdout: awsAssumeRoleOutputPath,
+		})
+
+	assumeRoleOut, err := assumeRoleCtr.File(awsAssumeRoleOutputPath).Contents(ctx)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to assume the AWS role %s", roleARN)
+	}
+
+	var assumedRole awsAssumeRoleOutput
+	if err := json.Unmarshal([]byte(assumeRoleOut), &assumedRole); err != nil {
+		return nil, WrapErrorf(err, "failed to parse the output of assuming the AWS role %s", roleARN)
+	}
+
+	if assumedRole.Credentials.AccessKeyID == "" || assumedRole.Credentials.SecretAccessKey == "" {
+		return nil, Errorf("assuming the AWS role %s returned no credentials", roleARN)
+	}
+
+	m.Ctr = m.Ctr.
+		WithoutEnvVariable("AWS_PROFILE").
+		WithSecretVariable("AWS_ACCESS_KEY_ID", dag.SetSecret("AWS_ACCESS_KEY_ID_"+roleSessionName, assumedRole.Credentials.AccessKeyID)).
+		WithSecretVariable("AWS_SECRET_ACCESS_KEY", dag.SetSecret("AWS_SECRET_ACCESS_KEY_"+roleSessionName, assumedRole.Credentials.SecretAccessKey)).
+		WithSecretVariable("AWS_SESSION_TOKEN", dag.SetSecret("AWS_SESSION_TOKEN_"+roleSessionName, assumedRole.Credentials.SessionToken))
+
+	if _, err := checkAWSCallerIdentityAccount(ctx, m.Ctr, expectedAccountID); err != nil {
+		return nil, WrapErrorf(err, "preflight failed after assuming the AWS role %s", roleARN)
+	}
+
+	return m, nil
+}
+
+// WithAWSRoleMappings maps environments, or stacks, to the IAM role the jobs assume.
+//
+// The mappings are in the ENVIRONMENT[/STACK]=ROLE_ARN format (e.g., prod=arn:aws:iam::123456789012:role/deployer,
+// or prod/dni=...), and a default role can be mapped with *=ROLE_ARN. Each job assumes the role mapped to its
+// stack, or else to its environment, or else the default role, once every other credential is set, since the
+// role is assumed with them. Jobs fail when no role applies to them, instead of running with the base
+// credentials.
+//
+// Parameters:
+//   - mappings: The role mappings, in the ENVIRONMENT[/STACK]=ROLE_ARN format.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the role mappings set
+//   - error: An error if any of the mappings is malformed
+func (m *Infra) WithAWSRoleMappings(
+	// mappings are the role mappings, in the ENVIRONMENT[/STACK]=ROLE_ARN format.
+	mappings []string,
+) (*Infra, error) {
+	if _, err := getAWSRoleMappings(mappings); err != nil {
+		return nil, err
+	}
+
+	m.AWSRoleMappings = slices.Clone(mappings)
+
+	return m, nil
+}
+
+// WithAWSExpectedAccountID sets the AWS account ID the credentials of the jobs must belong to.
+//
+// The AWS credentials preflight of the CD jobs (see WithAWSCredentialsPreflight) fails when the credentials
+// belong to another account, and it always runs when the expected account ID is set.
+//
+// Parameters:
+//   - accountID: The AWS account ID, a 12 digits number.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the expected account ID set
+//   - error: An error if the account ID isn't a 12 digits number
+func (m *Infra) WithAWSExpectedAccountID(
+	// accountID is the AWS account ID, a 12 digits number.
+	accountID string,
+) (*Infra, error) {
+	accountID = strings.TrimSpace(accountID)
+	if !awsAccountIDRegex.MatchString(accountID) {
+		return nil, Errorf("invalid expected AWS account ID %q, it must be a 12 digits number", accountID)
+	}
+
+	m.AWSExpectedAccountID = accountID
+
+	return m, nil
+}
+
+// WithoutAWSPreflight skips checking the AWS credentials (sts get-caller-identity) before the CD jobs run
+// Terragrunt. The CI jobs never check them, since they only run static analysis.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the AWS credentials preflight disabled
+func (m *Infra) WithoutAWSPreflight() *Infra {
+	m.SkipAWSPreflight = true
+
+	return m
+}
+
+// withAWSPreflight returns a copy of the module whose JobTg checks the AWS credentials before running
+// Terragrunt (unless WithoutAWSPreflight is set). The CD jobs run on it.
+func (m *Infra) withAWSPreflight() *Infra {
+	cloned := m.clone()
+	cloned.awsPreflight = true
+
+	return cloned
+}
+
+// WithAWSCredentialsPreflight checks the AWS credentials configured in the container, before running Terragrunt.
+//
+// It runs 'aws sts get-caller-identity' inside the container, and fails fast, with a clear error, if the
+// credentials are missing, expired, invalid, or belong to an account other than the expected one. When the
+// check passes, the account and ARN of the caller are reported in the logs.
+//
+// Jobs without any AWS credentials source (keys, a web identity token, a profile, a container credentials
+// endpoint, or AWS config files), e.g., the ones that only deploy to GCP, skip the check, unless the expected
+// account ID is passed. Credentials from the instance metadata (e.g., an EC2 instance profile) aren't detected,
+// so pass the expected account ID to check them too.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - expectedAccountID: Optional. The AWS account ID the credentials must belong to.
+//
+// Returns:
+//   - *Infra: The updated Infra instance, once the credentials are checked
+//   - error: An error if the credentials are missing, expired, invalid, or point to the wrong account
+func (m *Infra) WithAWSCredentialsPreflight(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// expectedAccountID is the AWS account ID the credentials must belong to.
+	// +optional
+	expectedAccountID string,
+) (*Infra, error) {
+	expectedAccountID = strings.TrimSpace(expectedAccountID)
+	if expectedAccountID != "" && !awsAccountIDRegex.MatchString(expectedAccountID) {
+		return nil, Errorf("invalid expected AWS account ID %q, it must be a 12 digits number", expectedAccountID)
+	}
+
+	if expectedAccountID == "" {
+		hasSource, err := hasAWSCredentialsSource(ctx, m.Ctr)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to look for an AWS credentials source")
+		}
+
+		if !hasSource {
+			m.Ctr = m.Ctr.
+				WithExec([]string{"echo", "AWS credentials preflight skipped: no AWS credentials source is configured"})
+
+			return m, nil
+		}
+	}
+
+	m = m.WithAWSCLIInstalled()
+
+	identity, err := checkAWSCallerIdentityAccount(ctx, m.Ctr, expectedAccountID)
+	if err != nil {
+		return nil, WrapErrorf(err, "AWS credentials preflight failed")
+	}
+
+	m.Ctr = m.Ctr.
+		WithExec([]string{"echo", fmt.Sprintf("AWS credentials preflight passed: account %s, ARN %s", identity.Account, identity.Arn)})
+
+	return m, nil
+}
+
+// hasAWSCredentialsSource checks whether the container has any AWS credentials source the AWS CLI reads:
+// keys, a web identity token, a profile, a container credentials endpoint, or AWS config files.
+// Only whether they're set is checked; their values are never read.
+func hasAWSCredentialsSource(ctx context.Context, ctr *dagger.Container) (bool, error) {
+	checkScript := fmt.Sprintf(`for key in %s; do
+  if [ -n "$(printenv "$key")" ]; then exit 0; fi
+done
+for file in "${AWS_CONFIG_FILE:-%s}" "${AWS_SHARED_CREDENTIALS_FILE:-%s}"; do
+  if [ -s "$file" ]; then exit 0; fi
+done
+exit 1`, strings.Join(awsCredentialsSourceEnvVars, " "), awsConfigFilePath, awsCredentialsFilePath)
+
+	checkCtr := ctr.
+		WithExec([]string{"sh", "-c", checkScript}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	exitCode, err := checkCtr.ExitCode(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return exitCode == 0, nil
+}
+
+// getAWSCallerIdentity returns the identity of the AWS credentials configured in the container.
+//
+// The call is never cached, since credentials can expire, or be revoked, between runs. When it fails, the
+// error explains whether the credentials are missing, expired or invalid, instead of the raw AWS CLI output.
+func getAWSCallerIdentity(ctx context.Context, ctr *dagger.Container) (*AWSCallerIdentity, error) {
+	identityCtr := ctr.
+		WithEnvVariable("AWS_CALLER_IDENTITY_CACHE_BUSTER", time.Now().Format(time.RFC3339Nano)).
+		WithExec([]string{"aws", "sts", "get-caller-identity", "--output", "json"}, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		})
+
+	exitCode, err := identityCtr.ExitCode(ctx)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to get the AWS caller identity")
+	}
+
+	if exitCode != 0 {
+		stderr, _ := identityCtr.Stderr(ctx)
+
+		return nil, getAWSCredentialsError(stderr)
+	}
+
+	identityOut, err := identityCtr.Stdout(ctx)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to get the AWS caller identity")
+	}
+
+	var identity AWSCallerIdentity
+	if err := json.Unmarshal([]byte(identityOut), &identity); err != nil {
+		return nil, WrapErrorf(err, "failed to parse the AWS caller identity")
+	}
+
+	return &identity, nil
+}
+
+// getAWSCredentialsError turns the error output of the AWS CLI into a clear error about the credentials.
+func getAWSCredentialsError(stderr string) error {
+	stderr = strings.TrimSpace(stderr)
+
+	switch {
+	case strings.Contains(stderr, "Unable to locate credentials"):
+		return Errorf("AWS credentials are missing: pass them as keys (awsAccessKeyID, awsSecretAccessKey), through OIDC, as a profile (awsProfile), or in the environment")
+	case strings.Contains(stderr, "ExpiredToken"), strings.Contains(stderr, "expired"):
+		return Errorf("AWS credentials have expired, refresh them (e.g., a new session token) and try again: %s", stderr)
+	case strings.Contains(stderr, "InvalidClientTokenId"), strings.Contains(stderr, "SignatureDoesNotMatch"):
+		return Errorf("AWS credentials are invalid, check the access key ID and secret access key: %s", stderr)
+	case strings.Contains(stderr, "AccessDenied"):
+		return Errorf("AWS credentials were rejected (access denied): %s", stderr)
+	default:
+		return Errorf("AWS credentials check failed: %s", stderr)
+	}
+}
+
+// checkAWSCallerIdentityAccount checks the AWS caller identity's account matches the expected account.
+func checkAWSCallerIdentityAccount(ctx context.Context, ctr *dagger.Container, expectedAccountID string) (*AWSCallerIdentity, error) {
+	identity, err := getAWSCallerIdentity(ctx, ctr)
+	if err != nil {
+		return nil, err
+	}
+
+	if expectedAccountID != "" && identity.Account != expectedAccountID {
+		return nil, Errorf("the AWS caller identity %s belongs to account %s, but account %s was expected", identity.Arn, identity.Account, expectedAccountID)
+	}
+
+	return identity, nil
+}
+
+// getAWSAccountIDFromRoleARN validates an IAM role ARN, and returns the account ID it belongs to.
+func getAWSAccountIDFromRoleARN(roleARN string) (string, error) {
+	matches := awsRoleARNRegex.FindStringSubmatch(strings.TrimSpace(roleARN))
+	if matches == nil {
+		return "", Errorf("invalid IAM role ARN %q, it must be in the format arn:aws:iam::<account-id>:role/<role-name>", roleARN)
+	}
+
+	return matches[1], nil
+}
+
+// getAWSRoleMappings parses the AWS role mappings passed in the ENVIRONMENT[/STACK]=ROLE_ARN format.
+//
+// The role is assumed once per job container, which runs every unit of the stack (e.g., with run --all),
+// so roles can't be mapped to units. Units that need a role of their own (e.g., in another account) must
+// assume it in their provider configuration (assume_role), or be moved to a stack of their own.
+func getAWSRoleMappings(awsRoleMappings []string) (map[string]string, error) {
+	roleMappings := make(map[string]string, len(awsRoleMappings))
+
+	for _, mapping := range awsRoleMappings {
+		key, roleARN, found := strings.Cut(strings.TrimSpace(mapping), "=")
+		key = strings.Trim(strings.TrimSpace(key), "/")
+
+		if !found || key == "" {
+			return nil, Errorf("AWS role mapping must be in the format ENVIRONMENT[/STACK]=ROLE_ARN: %s", mapping)
+		}
+
+		if strings.Contains(key, awsRoleMappingDefaultKey) && key != awsRoleMappingDefaultKey {
+			return nil, Errorf("AWS role mapping key %q is invalid, the default mapping must be %s=ROLE_ARN", key, awsRoleMappingDefaultKey)
+		}
+
+		if strings.Count(key, "/") > 1 {
+			return nil, Errorf("AWS role mapping key %q must be either an environment, or an environment/stack; units can't be mapped to roles", key)
+		}
+
+		if _, err := getAWSAccountIDFromRoleARN(roleARN); err != nil {
+			return nil, WrapErrorf(err, "invalid AWS role mapping for %s", key)
+		}
+
+		if _, duplicated := roleMappings[key]; duplicated {
+			return nil, Errorf("AWS role mapping for %s is set more than once", key)
+		}
+
+		roleMappings[key] = strings.TrimSpace(roleARN)
+	}
+
+	return roleMappings, nil
+}
+
+// resolveAWSRoleARN returns the role mapped to the stack of the environment, or else to the environment, or
+// else the default role (*). Jobs with role mappings never fall back to their base credentials silently, so
+// it fails when none of them applies, or when the job has no environment to resolve them with.
+func resolveAWSRoleARN(roleMappings map[string]string, environment, stack string) (string, error) {
+	if environment == "" {
+		if roleARN, ok := roleMappings[awsRoleMappingDefaultKey]; ok {
+			return roleARN, nil
+		}
+
+		return "", fmt.Errorf("AWS role mappings are set, but the job has no environment to resolve them with; add a default mapping (%s=ROLE_ARN) to use it", awsRoleMappingDefaultKey)
+	}
+
+	if stack != "" {
+		if roleARN, ok := roleMappings[environment+"/"+stack]; ok {
+			return roleARN, nil
+		}
+	}
+
+	if roleARN, ok := roleMappings[environment]; ok {
+		return roleARN, nil
+	}
+
+	if roleARN, ok := roleMappings[awsRoleMappingDefaultKey]; ok {
+		return roleARN, nil
+	}
+
+	return "", fmt.Errorf("no AWS role is mapped to environment %s, stack %s; map one, or add a default mapping (%s=ROLE_ARN)", environment, stack, awsRoleMappingDefaultKey)
+}
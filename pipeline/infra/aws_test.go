@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveAWSRoleARN(t *testing.T) {
+	const (
+		devRole     = "arn:aws:iam::111111111111:role/deployer"
+		prodRole    = "arn:aws:iam::222222222222:role/deployer"
+		prodDNIRole = "arn:aws:iam::333333333333:role/dni"
+		defaultRole = "arn:aws:iam::444444444444:role/deployer"
+	)
+
+	testCases := []struct {
+		name        string
+		mappings    []string
+		environment string
+		stack       string
+		want        string
+		wantErr     string
+	}{
+		{name: "stack mapping", mappings: []string{"prod=" + prodRole, "prod/dni=" + prodDNIRole}, environment: "prod", stack: "dni", want: prodDNIRole},
+		{name: "environment mapping", mappings: []string{"prod=" + prodRole, "prod/dni=" + prodDNIRole}, environment: "prod", stack: "other", want: prodRole},
+		{name: "default mapping", mappings: []string{"dev=" + devRole, "*=" + defaultRole}, environment: "prod", stack: "dni", want: defaultRole},
+		{name: "default mapping without environment", mappings: []string{"*=" + defaultRole}, want: defaultRole},
+		{name: "no mapping applies", mappings: []string{"dev=" + devRole}, environment: "prod", stack: "dni", wantErr: "no AWS role is mapped to environment prod"},
+		{name: "no environment", mappings: []string{"dev=" + devRole}, stack: "dni", wantErr: "has no environment"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			roleMappings, err := getAWSRoleMappings(tc.mappings)
+			if err != nil {
+				t.Fatalf("unexpected error parsing the mappings: %v", err)
+			}
+
+			got, err := resolveAWSRoleARN(roleMappings, tc.environment, tc.stack)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected an error containing %q, got role %q (error: %v)", tc.wantErr, got, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetAWSRoleMappingsInvalidDefault(t *testing.T) {
+	for _, invalid := range []string{"*/dni=arn:aws:iam::111111111111:role/deployer", "prod*=arn:aws:iam::111111111111:role/deployer"} {
+		if _, err := getAWSRoleMappings([]string{invalid}); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
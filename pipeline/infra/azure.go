@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const (
+	configAzureOIDCTokenFileName = "azure-oidc-token"
+)
+
+// azureIDRegex matches the IDs (GUIDs) of Azure tenants, subscriptions and client applications.
+var azureIDRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// WithAzureServicePrincipal sets the Azure credentials of a service principal, with a client secret.
+//
+// It sets the ARM_* environment variables the azurerm (and azuread) providers read, with the client
+// secret as a secret variable.
+//
+// Parameters:
+//   - clientID: The client (application) ID of the service principal.
+//   - clientSecret: The client secret of the service principal.
+//   - tenantID: The ID of the Azure tenant.
+//   - subscriptionID: Optional. The ID of the Azure subscription to deploy to.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the Azure credentials set
+//   - error: An error if an ID is malformed, or the client secret is missing
+func (m *Infra) WithAzureServicePrincipal(
+	// clientID is the client (application) ID of the service principal.
+	clientID string,
+	// clientSecret is the client secret of the service principal.
+	clientSecret *dagger.Secret,
+	// tenantID is the ID of the Azure tenant.
+	tenantID string,
+	// subscriptionID is the ID of the Azure subscription to deploy to.
+	// +optional
+	subscriptionID string,
+) (*Infra, error) {
+	if clientSecret == nil {
+		return nil, NewError("the client secret of the Azure service principal is required")
+	}
+
+	if err := validateAzureIDs(clientID, tenantID, subscriptionID); err != nil {
+		return nil, WrapError(err, "failed to set the Azure service principal credentials")
+	}
+
+	m.Ctr = withAzureIDs(m.Ctr, clientID, tenantID, subscriptionID).
+		WithSecretVariable("ARM_CLIENT_SECRET", clientSecret).
+		// cleaning —if set— the OIDC settings, so the providers don't pick them over the client secret.
+		WithoutEnvVariable("ARM_USE_OIDC").
+		WithoutEnvVariable("ARM_OIDC_TOKEN_FILE_PATH")
+
+	return m, nil
+}
+
+// WithAzureOIDC sets the Azure credentials of a workload identity federation, with an OIDC token.
+//
+// The token (e.g., GitLab's id_tokens, or GitHub Actions' ID token) is validated, and mounted as a
+// secret file the azurerm (and azuread) providers read, through ARM_OIDC_TOKEN_FILE_PATH. No
+// long-lived client secret is needed.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - clientID: The client (application) ID with the federated credential.
+//   - oidcToken: The OIDC JWT token.
+//   - tenantID: The ID of the Azure tenant.
+//   - subscriptionID: Optional. The ID of the Azure subscription to deploy to.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the Azure credentials set
+//   - error: An error if an ID is malformed, or the token is invalid, or expired
+func (m *Infra) WithAzureOIDC(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// clientID is the client (application) ID with the federated credential.
+	clientID string,
+	// oidcToken is the OIDC JWT token.
+	oidcToken *dagger.Secret,
+	// tenantID is the ID of the Azure tenant.
+	tenantID string,
+	// subscriptionID is the ID of the Azure subscription to deploy to.
+	// +optional
+	subscriptionID string,
+) (*Infra, error) {
+	if oidcToken == nil {
+		return nil, NewError("the OIDC token is required for Azure OIDC")
+	}
+
+	if err := validateAzureIDs(clientID, tenantID, subscriptionID); err != nil {
+		return nil, WrapError(err, "failed to set the Azure OIDC credentials")
+	}
+
+	oidcTokenValue, err := oidcToken.Plaintext(ctx)
+	if err != nil {
+		return nil, WrapError(err, "failed to read the OIDC token")
+	}
+
+	if _, err := validateOIDCToken(oidcTokenValue, time.Now()); err != nil {
+		return nil, WrapErrorf(err, "invalid OIDC token for the Azure client %s", clientID)
+	}
+
+	oidcTokenPath := filepath.Join(configOIDCTokenMountRootPath, configAzureOIDCTokenFileName)
+
+	m.Ctr = withAzureIDs(m.Ctr, clientID, tenantID, subscriptionID).
+		WithEnvVariable("ARM_USE_OIDC", "true").
+		WithEnvVariable("ARM_OIDC_TOKEN_FILE_PATH", oidcTokenPath).
+		// cleaning —if set— the client secret, so the providers don't pick it over the OIDC token.
+		WithoutEnvVariable("ARM_CLIENT_SECRET").
+		WithMountedSecret(oidcTokenPath, oidcToken, dagger.ContainerWithMountedSecretOpts{
+			Mode: 0o400,
+		})
+
+	return m, nil
+}
+
+// withAzureIDs sets the IDs of the client, tenant and —if set— subscription the providers authenticate with.
+func withAzureIDs(ctr *dagger.Container, clientID, tenantID, subscriptionID string) *dagger.Container {
+	ctr = ctr.
+		WithEnvVariable("ARM_CLIENT_ID", clientID).
+		WithEnvVariable("ARM_TENANT_ID", tenantID)
+
+	if subscriptionID != "" {
+		ctr = ctr.WithEnvVariable("ARM_SUBSCRIPTION_ID", subscriptionID)
+	}
+
+	return ctr
+}
+
+// validateAzureIDs checks the client and tenant IDs are GUIDs, and so is the subscription ID, when it's set.
+func validateAzureIDs(clientID, tenantID, subscriptionID string) error {
+	ids := []struct{ name, value string }{{"client ID", clientID}, {"tenant ID", tenantID}}
+	if subscriptionID != "" {
+		ids = append(ids, struct{ name, value string }{"subscription ID", subscriptionID})
+	}
+
+	for _, id := range ids {
+		if !azureIDRegex.MatchString(id.value) {
+			return fmt.Errorf("the Azure %s %q must be a GUID (e.g., 00000000-0000-0000-0000-000000000000)", id.name, id.value)
+		}
+	}
+
+	return nil
+}
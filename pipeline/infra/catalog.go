@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"dagger/infra/internal/dagger"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	catalogFormatJSON      = "json"
+	catalogFormatMarkdown  = "markdown"
+	tgRenderedConfigPath   = "/tmp/terragrunt-rendered.json"
+	tgInfoRedirectPath     = "/tmp/terragrunt-info.json"
+	secretHashesPath       = "/tmp/catalog-secret-hashes.txt"
+	catalogNoValueMarkdown = "—"
+	// minSecretSubstringLength is the length a secret value must have to be masked inside longer values,
+	// so short values (e.g., 1, or true) don't mask every value they're part of.
+	minSecretSubstringLength = 6
+)
+
+var catalogFormats = []string{catalogFormatJSON, catalogFormatMarkdown}
+
+// tgRenderedConfig are the fields of the resolved configuration of a unit, as written by render-json,
+// the catalog is built from.
+type tgRenderedConfig struct {
+	Terraform *struct {
+		Source string `json:"source"`
+	} `json:"terraform"`
+	Inputs       map[string]json.RawMessage `json:"inputs"`
+	Dependencies *struct {
+		Paths []string `json:"paths"`
+	} `json:"dependencies"`
+	Dependency map[string]struct {
+		ConfigPath string `json:"config_path"`
+	} `json:"dependency"`
+	RemoteState *struct {
+		Backend  string                     `json:"backend"`
+		Config   map[string]json.RawMessage `json:"config"`
+		Generate *struct {
+			Path string `json:"path"`
+		} `json:"generate"`
+	} `json:"remote_state"`
+	Generate map[string]struct {
+		Path string `json:"path"`
+	} `json:"generate"`
+}
+
+// tgInfo are the fields of the Terragrunt information of a unit, as printed by terragrunt-info.
+type tgInfo struct {
+	ConfigPath      string `json:"ConfigPath"`
+	TerraformBinary string `json:"TerraformBinary"`
+}
+
+// catalogUnit is the entry of a unit in the catalog.
+type catalogUnit struct {
+	Environment        string                     `json:"environment"`
+	Stack              string                     `json:"stack"`
+	Unit               string                     `json:"unit"`
+	ConfigPath         string                     `json:"config_path"`
+	TerraformBinary    string                     `json:"terraform_binary,omitempty"`
+	ModuleSource       string                     `json:"module_source"`
+	ModuleVersion      string                     `json:"module_version,omitempty"`
+	Inputs             map[string]json.RawMessage `json:"inputs"`
+	Dependencies       []string                   `json:"dependencies"`
+	RemoteStateBackend string                     `json:"remote_state_backend,omitempty"`
+	RemoteStateKey     string                     `json:"remote_state_key,omitempty"`
+	GeneratedFiles     []string                   `json:"generated_files"`
+}
+
+// catalogUnitResult is the result of building the catalog entry of a unit.
+type catalogUnitResult struct {
+	Entry catalogUnit
+	Err   error
+}
+
+// Catalog builds an inventory of the units of every environment, and stack, from their resolved configuration.
+//
+// For each unit, it runs render-json and terragrunt-info, and catalogs its module source and version,
+// inputs, dependencies, remote state key and generated files. Inputs whose name matches a secret key
+// pattern (see WithSecretKeyPatterns) are masked, and so are the values nested under a key matching one
+// (e.g., db = { password = ... }), and the values of secret variables (e.g., pulled in with get_env).
+// The inventory is rendered as JSON, or Markdown, for audits and docs.
+//
+// This function takes the following parameters:
+//   - ctx: The context for managing the operation's lifecycle.
+//   - environmentNames: The environments to catalog. Defaults to every environment.
+//   - stackNames: The stacks to catalog. Defaults to every stack.
+//   - format: The format of the inventory, json (default) or markdown.
+func (m *Infra) Catalog(
+	// Context is the context for managing the operation's lifecycle
+	// +optional
+	ctx context.Context,
+	// remoteStateBucket is the name of the bucket to use for the remote backend.
+	// +optional
+	remoteStateBucket string,
+	// remoteStateLockTable is the name of the lock table to use for the remote backend.
+	// +optional
+	remoteStateLockTable string,
+	// remoteStateRegion is the region of the remote state bucket.
+	// +optional
+	remoteStateRegion string,
+	// deploymentRegion is the AWS region to use for the remote backend.
+	// +optional
+	deploymentRegion string,
+	// awsAccessKeyID is the AWS access key ID.
+	// +optional
+	awsAccessKeyID *dagger.Secret,
+	// awsSecretAccessKey is the AWS secret access key.
+	// +optional
+	awsSecretAccessKey *dagger.Secret,
+	// awsSessionToken is the AWS session token.
+	// +optional
+	awsSessionToken *dagger.Secret,
+	// tfGitlabToken is the Terraform Gitlab token.
+	// +optional
+	tfGitlabToken *dagger.Secret,
+	// GitHubToken is the github token
+	// +optional
+	GitHubToken *dagger.Secret,
+	// loadDotEnvFile is a flag to enable source .env files from the local directory.
+	// +optional
+	loadDotEnvFile bool,
+	// NoCache is a flag to disable caching of the container.
+	// +optional
+	noCache bool,
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
+	// +optional
+	envVars []string,
+	// tgBinaryVersionOverride is the Terragrunt binary version to use.
+	// +optional
+	tgBinaryVersionOverride string,
+	// tfBinaryVersionOverride is the Terraform binary version to use.
+	// +optional
+	tfBinaryVersionOverride string,
+	// tfVersionFile is the Terraform version file to use. I'll generate a .terraform-version file in the working directory.
+	// +optional
+	tfVersionFile string,
+	// gitSSH is a flag to enable SSH for the container.
+	// +optional
+	gitSSH *dagger.Socket,
+	// tgLogLevel is the Terragrunt log level to use.
+	// +optional
+	tgLogLevel string,
+	// environmentNames are the environments to catalog. Defaults to every environment.
+	// +optional
+	environmentNames []string,
+	// stackNames are the stacks to catalog. Defaults to every stack.
+	// +optional
+	stackNames []string,
+	// format is the format of the inventory, json (default) or markdown.
+	// +optional
+	format string,
+) (string, error) {
+	if format == "" {
+		format = catalogFormatJSON
+	}
+
+	if !slices.Contains(catalogFormats, format) {
+		return "", Errorf("catalog format %q is not supported, it must be one of: %s", format, strings.Join(catalogFormats, ", "))
+	}
+
+	if len(environmentNames) == 0 {
+		environmentNames = environments
+	}
+
+	if len(stackNames) == 0 {
+		for stack := range unitsPerStack {
+			stackNames = append(stackNames, stack)
+		}
+
+		sort.Strings(stackNames)
+	}
+
+	totalUnits := 0
+
+	for _, stack := range stackNames {
+		if _, exists := unitsPerStack[stack]; !exists {
+			return "", Errorf("stack %s not found in unitsPerStack", stack)
+		}
+
+		totalUnits += getTotalUnitsPerStack(stack) * len(environmentNames)
+	}
+
+	if totalUnits == 0 {
+		return "", Errorf("no units found for stacks %s", strings.Join(stackNames, ", "))
+	}
+
+	if remoteStateRegion == "" {
+		remoteStateRegion = defaultRemoteStateRegion
+	}
+
+	// The inputs are masked with the same patterns the environment variables are set as secrets with.
+	maskPatterns := m.getSecretKeyPatterns()
+
+	var wg sync.WaitGroup
+
+	resultChan := make(chan catalogUnitResult, totalUnits)
+
+	for _, environment := range environmentNames {
+		remoteStateBucketName := remoteStateBucket
+		remoteStateLockTableName := remoteStateLockTable
+
+		if remoteStateBucket == "" && remoteStateLockTable == "" {
+			remoteStateBucketName = fmt.Sprintf("%s-%s", remoteStateDefaultBucketNamingConvention, environment)
+			remoteStateLockTableName = fmt.Sprintf("%s-%s", remoteStateDefaultLockTableNamingConvention, environment)
+		}
+
+		for _, stack := range stackNames {
+			baseCtr, baseCtrErr := m.JobTg(ctx,
+				remoteStateBucketName,
+				remoteStateLockTableName,
+				remoteStateRegion,
+				deploymentRegion,
+				awsAccessKeyID,
+				awsSecretAccessKey,
+				awsSessionToken,
+				tfGitlabToken,
+				GitHubToken,
+				loadDotEnvFile,
+				noCache,
+				envVars,
+				tgBinaryVersionOverride,
+				tfBinaryVersionOverride,
+				tfVersionFile,
+				gitSSH,
+				tgLogLevel,
+				environment,
+				stack,
+			)
+
+			if baseCtrErr != nil {
+				return "", WrapErrorf(baseCtrErr, "failed to create base jobTg container for stack %s (environment %s)", stack, environment)
+			}
+
+			cmdBuilder, err := newTgCmdBuilder(ctx, baseCtr)
+			if err != nil {
+				return "", WrapErrorf(err, "failed to build the Terragrunt commands for stack %s (environment %s)", stack, environment)
+			}
+
+			secretValueHashes, secretValueLengths, err := getContainerSecretValueHashes(ctx, baseCtr)
+			if err != nil {
+				return "", WrapErrorf(err, "failed to inspect the secret variables for stack %s (environment %s)", stack, environment)
+			}
+
+			masker := &inputMasker{
+				patterns:           maskPatterns,
+				secretValueHashes:  secretValueHashes,
+				secretValueLengths: secretValueLengths,
+			}
+
+			for _, units := range unitsPerStack[stack] {
+				for _, unit := range units {
+					wg.Add(1)
+
+					go func(environment, stack, unitName string) {
+						defer wg.Done()
+
+						readUnitCatalogAsync(ctx, resultChan, baseCtr, cmdBuilder, environment, stack, unitName, masker)
+					}(environment, stack, unit)
+				}
+			}
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	entries := make([]catalogUnit, 0, totalUnits)
+
+	var errs []error
+
+	for result := range resultChan {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+
+			continue
+		}
+
+		entries = append(entries, result.Entry)
+	}
+
+	if len(errs) > 0 {
+		return "", JoinErrors(errs...)
+	}
+
+	// The units finish in any order, so they're sorted for the inventory to be stable across runs.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Environment != entries[j].Environment {
+			return entries[i].Environment < entries[j].Environment
+		}
+
+		if entries[i].Stack != entries[j].Stack {
+			return entries[i].Stack < entries[j].Stack
+		}
+
+		return entries[i].Unit < entries[j].Unit
+	})
+
+	if format == catalogFormatMarkdown {
+		return formatCatalogMarkdown(entries), nil
+	}
+
+	catalogJSON, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return "", WrapError(err, "failed to marshal the catalog")
+	}
+
+	return string(catalogJSON), nil
+}
+
+// readUnitCatalogAsync builds the catalog entry of a unit from its resolved configuration, and its
+// Terragrunt information, and sends it to the result channel.
+func readUnitCatalogAsync(
+	ctx context.Context,
+	resultChan chan<- catalogUnitResult,
+	baseCtr *dagger.Container,
+	cmdBuilder *tgCmdBuilder,
+	environment string,
+	stack string,
+	unit string,
+	masker *inputMasker,
+) {
+	tgWorkDir := getTerragruntExecutionPath(environment, stack, unit)
+	catalogRes := catalogUnitResult{}
+
+	renderedContent, err := readUnitCommandFile(ctx, baseCtr,
+		withWorkingDir(cmdBuilder.renderJSON(tgRenderedConfigPath), tgWorkDir), tgRenderedConfigPath, false)
+	if err != nil {
+		catalogRes.Err = WrapErrorf(err, "failed to render the configuration of unit %s on working directory: %s", unit, tgWorkDir)
+		resultChan <- catalogRes
+
+		return
+	}
+
+	infoContent, err := readUnitCommandFile(ctx, baseCtr,
+		withWorkingDir(cmdBuilder.info(), tgWorkDir), tgInfoRedirectPath, true)
+	if err != nil {
+		catalogRes.Err = WrapErrorf(err, "failed to get the Terragrunt information of unit %s on working directory: %s", unit, tgWorkDir)
+		resultChan <- catalogRes
+
+		return
+	}
+
+	entry, err := getCatalogUnit(renderedContent, infoContent, tgWorkDir, masker)
+	if err != nil {
+		catalogRes.Err = WrapErrorf(err, "failed to catalog unit %s on working directory: %s", unit, tgWorkDir)
+		resultChan <- catalogRes
+
+		return
+	}
+
+	entry.Environment = environment
+	entry.Stack = stack
+	entry.Unit = unit
+
+	catalogRes.Entry = *entry
+	resultChan <- catalogRes
+}
+
+// readUnitCommandFile runs a command on a unit, and reads the file it writes (or its stdout, when
+// redirectStdout is set) instead of the logs, since the resolved configuration can have secrets.
+func readUnitCommandFile(
+	ctx context.Context,
+	baseCtr *dagger.Container,
+	tgCmd []string,
+	filePath string,
+	redirectStdout bool,
+) (string, error) {
+	execOpts := dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny}
+	if redirectStdout {
+		execOpts.RedirectStdout = filePath
+	}
+
+	execCtr := baseCtr.WithExec(tgCmd, execOpts)
+
+	exitCode, err := execCtr.ExitCode(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if exitCode != 0 {
+		stderr, _ := execCtr.Stderr(ctx)
+
+		return "", fmt.Errorf("exit code %d: %s", exitCode, stderr)
+	}
+
+	return execCtr.File(filePath).Contents(ctx)
+}
+
+// getCatalogUnit builds the catalog entry of a unit from its render-json, and terragrunt-info, output.
+// Errors never include the content, since it can have secrets.
+func getCatalogUnit(renderedContent, infoContent, tgWorkDir string, masker *inputMasker) (*catalogUnit, error) {
+	var rendered tgRenderedConfig
+	if err := json.Unmarshal([]byte(strings.TrimSpace(renderedContent)), &rendered); err != nil {
+		return nil, fmt.Errorf("the rendered configuration isn't a valid JSON document")
+	}
+
+	infoJSON, err := extractJSONDocument(infoContent)
+	if err != nil {
+		return nil, fmt.Errorf("the Terragrunt information has no JSON document")
+	}
+
+	var info tgInfo
+	if err := json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		return nil, fmt.Errorf("the Terragrunt information isn't a valid JSON document")
+	}
+
+	entry := &catalogUnit{
+		ConfigPath:      getCatalogRelativePath(tgWorkDir, info.ConfigPath),
+		TerraformBinary: info.TerraformBinary,
+		Inputs:          map[string]json.RawMessage{},
+		Dependencies:    []string{},
+		GeneratedFiles:  []string{},
+	}
+
+	if rendered.Terraform != nil {
+		entry.ModuleSource = rendered.Terraform.Source
+		entry.ModuleVersion = getModuleSourceVersion(rendered.Terraform.Source)
+	}
+
+	for name, value := range rendered.Inputs {
+		entry.Inputs[name] = masker.mask(name, value)
+	}
+
+	var dependencyPaths []string
+	if rendered.Dependencies != nil {
+		dependencyPaths = append(dependencyPaths, rendered.Dependencies.Paths...)
+	}
+
+	for _, dependency := range rendered.Dependency {
+		dependencyPaths = append(dependencyPaths, dependency.ConfigPath)
+	}
+
+	for _, dependencyPath := range dependencyPaths {
+		entry.Dependencies = append(entry.Dependencies, getCatalogRelativePath(tgWorkDir, dependencyPath))
+	}
+
+	if rendered.RemoteState != nil {
+		entry.RemoteStateBackend = rendered.RemoteState.Backend
+		entry.RemoteStateKey = getRemoteStateKey(rendered.RemoteState.Config)
+
+		if rendered.RemoteState.Generate != nil && rendered.RemoteState.Generate.Path != "" {
+			entry.GeneratedFiles = append(entry.GeneratedFiles, rendered.RemoteState.Generate.Path)
+		}
+	}
+
+	for _, generated := range rendered.Generate {
+		entry.GeneratedFiles = append(entry.GeneratedFiles, generated.Path)
+	}
+
+	// Both lists come (partly) from maps, so they're sorted, and deduplicated.
+	slices.Sort(entry.Dependencies)
+	entry.Dependencies = slices.Compact(entry.Dependencies)
+	slices.Sort(entry.GeneratedFiles)
+	entry.GeneratedFiles = slices.Compact(entry.GeneratedFiles)
+
+	return entry, nil
+}
+
+// inputMasker masks the secrets of the inputs of the units, before they're written into the catalog.
+type inputMasker struct {
+	patterns           []string        // patterns are the secret key patterns.
+	secretValueHashes  map[string]bool // secretValueHashes are the SHA-256 hashes of the secret variables' values.
+	secretValueLengths []int           // secretValueLengths are the lengths (in bytes) of those values, longest first.
+}
+
+// mask masks the value of an input when its name matches a secret key pattern, or it's the value of a
+// secret variable (e.g., pulled in with get_env under an innocuous name). Inside objects, and lists, every
+// nested value whose key matches a pattern (e.g., db = { password = ... }), or that is the value of a
+// secret variable, is masked too, and so are the secret values found inside longer strings (e.g., the
+// password of a connection string).
+func (im *inputMasker) mask(name string, value json.RawMessage) json.RawMessage {
+	maskedValue, _ := json.Marshal(maskedSensitiveValue)
+
+	if isSecretKey(name, im.patterns) {
+		return maskedValue
+	}
+
+	// Numbers are decoded as they are, so the unmasked values are kept as rendered.
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+
+	var decoded any
+	if err := decoder.Decode(&decoded); err != nil {
+		// A value that can't be inspected isn't written as it is, since it could have secrets.
+		return maskedValue
+	}
+
+	masked, err := json.Marshal(im.maskNested(decoded))
+	if err != nil {
+		return maskedValue
+	}
+
+	return masked
+}
+
+// maskNested replaces the values whose key matches a secret key pattern, and the values of secret
+// variables, at any depth.
+func (im *inputMasker) maskNested(value any) any {
+	switch typedValue := value.(type) {
+	case map[string]any:
+		for key, nestedValue := range typedValue {
+			if isSecretKey(key, im.patterns) {
+				typedValue[key] = maskedSensitiveValue
+
+				continue
+			}
+
+			typedValue[key] = im.maskNested(nestedValue)
+		}
+	case []any:
+		for idx, nestedValue := range typedValue {
+			typedValue[idx] = im.maskNested(nestedValue)
+		}
+	case string:
+		if im.secretValueHashes[getSHA256Hex(typedValue)] {
+			return maskedSensitiveValue
+		}
+
+		return im.maskSubstrings(typedValue)
+	}
+
+	return value
+}
+
+// maskSubstrings replaces the secret values found inside a string. Only the hashes of the secret values
+// are known, so every window of the string as long as a secret value is hashed, and compared with them.
+// The longest values are masked first, so a value containing a shorter one is masked as a whole.
+func (im *inputMasker) maskSubstrings(value string) string {
+	for _, length := range im.secretValueLengths {
+		if length < minSecretSubstringLength || length > len(value) {
+			continue
+		}
+
+		var maskedBuilder strings.Builder
+
+		last := 0
+
+		for idx := 0; idx+length <= len(value); {
+			if !im.secretValueHashes[getSHA256Hex(value[idx:idx+length])] {
+				idx++
+
+				continue
+			}
+
+			maskedBuilder.WriteString(value[last:idx])
+			maskedBuilder.WriteString(maskedSensitiveValue)
+
+			idx += length
+			last = idx
+		}
+
+		if last > 0 {
+			maskedBuilder.WriteString(value[last:])
+			value = maskedBuilder.String()
+		}
+	}
+
+	return value
+}
+
+// getContainerSecretValueHashes returns the SHA-256 hashes of the values of the secret variables of the
+// container, and their lengths, so the inputs that got one of them can be masked. The secret variables are
+// the ones set in the container, but not listed as plain variables. Only their hashes, and lengths, are
+// written, to a file instead of the standard output, so they don't show up in the logs either.
+func getContainerSecretValueHashes(ctx context.Context, ctr *dagger.Container) (map[string]bool, []int, error) {
+	plainEnv, err := getContainerPlainEnv(ctx, ctr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The variables the shell sets itself aren't secrets, nor listed as plain variables.
+	shellVariables := []string{"HOME", "HOSTNAME", "OLDPWD", "PWD", "SHLVL", "_"}
+
+	hashScript := `for key in $(awk 'BEGIN { for (key in ENVIRON) print key }'); do
+  case " $* " in *" $key "*) continue ;; esac
+  value="$(printenv "$key")"
+  if [ -n "$value" ]; then
+    printf '%s %s\n' "$(printf '%s' "$value" | wc -c)" "$(printf '%s' "$value" | sha256sum | cut -d' ' -f1)"
+  fi
+done`
+
+	skippedKeys := append(slices.Collect(maps.Keys(plainEnv)), shellVariables...)
+
+	out, err := ctr.
+		WithEnvVariable("CATALOG_CACHE_BUSTER", time.Now().Format(time.RFC3339Nano)).
+		WithExec(append([]string{"sh", "-c", hashScript, "--", "CATALOG_CACHE_BUSTER"}, skippedKeys...), dagger.ContainerWithExecOpts{
+			RedirectStdout: secretHashesPath,
+		}).
+		File(secretHashesPath).
+		Contents(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parseSecretValueHashes(out)
+}
+
+// parseSecretValueHashes parses the lines of the secret values' lengths, and hashes, in the LENGTH HASH
+// format. The lengths are deduplicated, and sorted from the longest.
+func parseSecretValueHashes(content string) (map[string]bool, []int, error) {
+	secretValueHashes := map[string]bool{}
+
+	var secretValueLengths []int
+
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("malformed secret value hash line, expected LENGTH HASH")
+		}
+
+		length, err := strconv.Atoi(fields[0])
+		if err != nil || length <= 0 {
+			return nil, nil, fmt.Errorf("malformed secret value length %q", fields[0])
+		}
+
+		secretValueHashes[fields[1]] = true
+
+		if !slices.Contains(secretValueLengths, length) {
+			secretValueLengths = append(secretValueLengths, length)
+		}
+	}
+
+	slices.Sort(secretValueLengths)
+	slices.Reverse(secretValueLengths)
+
+	return secretValueHashes, secretValueLengths, nil
+}
+
+// getSHA256Hex returns the hex-encoded SHA-256 hash of a value.
+func getSHA256Hex(value string) string {
+	hash := sha256.Sum256([]byte(value))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// getModuleSourceVersion returns the version a module source is pinned to: the ref of a Git source
+// (e.g., git::https://github.com/org/modules.git//vpc?ref=v1.2.0), or the version of a registry source
+// (e.g., tfr:///terraform-aws-modules/vpc/aws?version=5.0.0). Local sources have no version.
+func getModuleSourceVersion(source string) string {
+	_, rawQuery, found := strings.Cut(source, "?")
+	if !found {
+		return ""
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return ""
+	}
+
+	if ref := query.Get("ref"); ref != "" {
+		return ref
+	}
+
+	return query.Get("version")
+}
+
+// getRemoteStateKey returns the key of the state in the remote backend: key for s3 and azurerm, and
+// prefix for gcs.
+func getRemoteStateKey(config map[string]json.RawMessage) string {
+	for _, keyField := range []string{"key", "prefix"} {
+		var key string
+		if err := json.Unmarshal(config[keyField], &key); err == nil && key != "" {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// getCatalogRelativePath returns a path of a unit relative to the root of the Terragrunt configuration
+// (e.g., global/dni/name-generator), so the catalog doesn't depend on where the source is mounted.
+// Relative paths are resolved from the working directory of the unit.
+func getCatalogRelativePath(tgWorkDir, unitPath string) string {
+	if unitPath == "" {
+		return ""
+	}
+
+	// Terragrunt prints absolute paths, under the directory the source is mounted on (e.g., /mnt).
+	if filepath.IsAbs(unitPath) {
+		rootPrefix := "/" + configRefArchRootPath + "/"
+		if idx := strings.Index(unitPath, rootPrefix); idx >= 0 {
+			return filepath.Clean(unitPath[idx+len(rootPrefix):])
+		}
+
+		return filepath.Clean(unitPath)
+	}
+
+	relativePath, err := filepath.Rel(configRefArchRootPath, filepath.Join(tgWorkDir, unitPath))
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		return filepath.Join(tgWorkDir, unitPath)
+	}
+
+	return relativePath
+}
+
+// formatCatalogMarkdown formats the catalog as a Markdown document, with a section per unit.
+func formatCatalogMarkdown(entries []catalogUnit) string {
+	code := func(value string) string {
+		if value == "" {
+			return catalogNoValueMarkdown
+		}
+
+		return "`" + strings.ReplaceAll(value, "`", "'") + "`"
+	}
+
+	codeList := func(values []string) string {
+		if len(values) == 0 {
+			return catalogNoValueMarkdown
+		}
+
+		codeValues := make([]string, 0, len(values))
+		for _, value := range values {
+			codeValues = append(codeValues, code(value))
+		}
+
+		return strings.Join(codeValues, ", ")
+	}
+
+	var catalogBuilder strings.Builder
+	catalogBuilder.WriteString("# Terragrunt catalog\n")
+
+	currentSection := ""
+
+	for _, entry := range entries {
+		if section := entry.Environment + "/" + entry.Stack; section != currentSection {
+			currentSection = section
+			catalogBuilder.WriteString(fmt.Sprintf("\n## %s / %s\n", entry.Environment, entry.Stack))
+		}
+
+		catalogBuilder.WriteString(fmt.Sprintf("\n### %s\n\n", entry.Unit))
+		catalogBuilder.WriteString(fmt.Sprintf("- **Configuration:** %s\n", code(entry.ConfigPath)))
+		catalogBuilder.WriteString(fmt.Sprintf("- **Module source:** %s\n", code(entry.ModuleSource)))
+		catalogBuilder.WriteString(fmt.Sprintf("- **Module version:** %s\n", code(entry.ModuleVersion)))
+		catalogBuilder.WriteString(fmt.Sprintf("- **Remote state:** %s %s\n", code(entry.RemoteStateBackend), code(entry.RemoteStateKey)))
+		catalogBuilder.WriteString(fmt.Sprintf("- **Dependencies:** %s\n", codeList(entry.Dependencies)))
+		catalogBuilder.WriteString(fmt.Sprintf("- **Generated files:** %s\n", codeList(entry.GeneratedFiles)))
+
+		if len(entry.Inputs) == 0 {
+			catalogBuilder.WriteString("- **Inputs:** " + catalogNoValueMarkdown + "\n")
+
+			continue
+		}
+
+		inputNames := make([]string, 0, len(entry.Inputs))
+		for name := range entry.Inputs {
+			inputNames = append(inputNames, name)
+		}
+
+		sort.Strings(inputNames)
+
+		catalogBuilder.WriteString("\n| Input | Value |\n| --- | --- |\n")
+
+		for _, name := range inputNames {
+			// Values are compacted, so multi-line ones (e.g., maps) fit in a table cell.
+			var compactValue bytes.Buffer
+			if err := json.Compact(&compactValue, entry.Inputs[name]); err != nil {
+				compactValue.Reset()
+				compactValue.Write(entry.Inputs[name])
+			}
+
+			value := strings.ReplaceAll(compactValue.String(), "|", "\\|")
+			catalogBuilder.WriteString(fmt.Sprintf("| %s | %s |\n", code(name), code(value)))
+		}
+	}
+
+	return catalogBuilder.String()
+}
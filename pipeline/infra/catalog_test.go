@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestInputMaskerMask(t *testing.T) {
+	const password = "s3cr3t-p4ss"
+
+	secretValueHashes, secretValueLengths, err := parseSecretValueHashes(fmt.Sprintf("%d %s\n3 %s\n", len(password), getSHA256Hex(password), getSHA256Hex("abc")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	masker := &inputMasker{
+		patterns:           defaultSecretKeyPatterns,
+		secretValueHashes:  secretValueHashes,
+		secretValueLengths: secretValueLengths,
+	}
+
+	testCases := []struct {
+		name  string
+		input string
+		value string
+		want  string
+	}{
+		{name: "secret key", input: "db_password", value: `"anything"`, want: `"(sensitive value)"`},
+		{name: "exact secret value", input: "name", value: `"s3cr3t-p4ss"`, want: `"(sensitive value)"`},
+		{name: "short exact secret value", input: "name", value: `"abc"`, want: `"(sensitive value)"`},
+		{
+			name:  "secret value in a connection string",
+			input: "url",
+			value: `"postgres://app:s3cr3t-p4ss@db:5432/app?fallback=s3cr3t-p4ss"`,
+			want:  `"postgres://app:(sensitive value)@db:5432/app?fallback=(sensitive value)"`,
+		},
+		{name: "short secret value isn't masked inside longer values", input: "name", value: `"abcdef"`, want: `"abcdef"`},
+		{
+			name:  "nested values",
+			input: "db",
+			value: `{"token":"x","dsn":"app:s3cr3t-p4ss@db","port":5432}`,
+			want:  `{"dsn":"app:(sensitive value)@db","port":5432,"token":"(sensitive value)"}`,
+		},
+		{name: "plain value", input: "region", value: `"eu-west-1"`, want: `"eu-west-1"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(masker.mask(tc.input, json.RawMessage(tc.value))); got != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseSecretValueHashes(t *testing.T) {
+	_, lengths, err := parseSecretValueHashes("  3 aaa\n11 bbb\n3 ccc\n\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(lengths) != 2 || lengths[0] != 11 || lengths[1] != 3 {
+		t.Fatalf("expected the lengths [11 3], got %v", lengths)
+	}
+
+	for _, invalid := range []string{"aaa", "x aaa", "0 aaa", "3 aaa extra"} {
+		if _, _, err := parseSecretValueHashes(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
@@ -4,6 +4,12 @@
 	"context"
 	"dagger/infra/internal/dagger"
 	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 )
 
 func (m *Infra) JobCDTgStack(
@@ -43,7 +49,7 @@ func (m *Infra) JobCDTgStack(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
@@ -65,7 +71,7 @@ func (m *Infra) JobCDTgStack(
 	stack string,
 	// environment is the environment to run the Terragrunt commands.
 	environment string,
-	// runApply is a flag to run the apply command.
+	// runApply is a flag to run the apply command. Units whose plan has no changes are skipped.
 	// +optional
 	runApply bool,
 	// runDestroy is a flag to run the destroy command.
@@ -75,23 +81,8 @@ func (m *Infra) JobCDTgStack(
 	// +optional
 	runPlan bool,
 ) (string, error) {
-	var jobStackOut string
-	var jobStackErr error
-
-	if !runApply && !runDestroy && !runPlan {
-		return "", fmt.Errorf("either --run-apply (runApply) or --run-destroy (runDestroy) or --run-plan (runPlan) must be set to true")
-	}
-
-	if runApply && runDestroy {
-		return "", fmt.Errorf("cannot set both --run-apply (runApply) and --run-destroy (runDestroy) to true")
-	}
-
-	if runPlan && runApply {
-		return "", fmt.Errorf("cannot set both --run-plan (runPlan) and --run-apply (runApply) to true")
-	}
-
-	if runPlan && runDestroy {
-		return "", fmt.Errorf("cannot set both --run-plan (runPlan) and --run-destroy (runDestroy) to true")
+	if err := validateCDTgStackAction(runApply, runDestroy, runPlan); err != nil {
+		return "", err
 	}
 
 	var remoteStateBucketName string
@@ -109,82 +100,82 @@ func (m *Infra) JobCDTgStack(
 		remoteStateRegion = defaultRemoteStateRegion
 	}
 
-	if runApply {
-		jobStackOut, jobStackErr = m.JobTgStack(ctx,
-			remoteStateBucketName,
-			remoteStateLockTableName,
-			remoteStateRegion,
-			deploymentRegion,
-			awsAccessKeyID,
-			awsSecretAccessKey,
-			awsSessionToken,
-			tfGitlabToken,
-			GitHubToken,
-			loadDotEnvFile,
-			noCache,
-			envVars,
-			tgBinaryVersionOverride,
-			tfBinaryVersionOverride,
-			tfVersionFile,
-			gitSSH,
-			tgLogLevel,
-			[]string{"apply"},
-			[]string{"-auto-approve"},
-			stack,
-			environment,
-		)
-	} else if runDestroy {
-		jobStackOut, jobStackErr = m.JobTgStack(ctx,
-			remoteStateBucketName,
-			remoteStateLockTableName,
-			remoteStateRegion,
-			deploymentRegion,
-			awsAccessKeyID,
-			awsSecretAccessKey,
-			awsSessionToken,
-			tfGitlabToken,
-			GitHubToken,
-			loadDotEnvFile,
-			noCache,
-			envVars,
-			tgBinaryVersionOverride,
-			tfBinaryVersionOverride,
-			tfVersionFile,
-			gitSSH,
-			tgLogLevel,
-			[]string{"destroy"},
-			[]string{"-auto-approve"},
-			stack,
-			environment,
-		)
-	} else if runPlan {
-		jobStackOut, jobStackErr = m.JobTgStack(ctx,
-			remoteStateBucketName,
-			remoteStateLockTableName,
-			remoteStateRegion,
-			deploymentRegion,
-			awsAccessKeyID,
-			awsSecretAccessKey,
-			awsSessionToken,
-			tfGitlabToken,
-			GitHubToken,
-			loadDotEnvFile,
-			noCache,
-			envVars,
-			tgBinaryVersionOverride,
-			tfBinaryVersionOverride,
-			tfVersionFile,
-			gitSSH,
-			tgLogLevel,
-			[]string{"plan"},
-			[]string{},
-			stack,
-			environment,
-		)
+	baseCtr, baseCtrErr := m.withAWSPreflight().JobTg(ctx,
+		remoteStateBucketName,
+		remoteStateLockTableName,
+		remoteStateRegion,
+		deploymentRegion,
+		awsAccessKeyID,
+		awsSecretAccessKey,
+		awsSessionToken,
+		tfGitlabToken,
+		GitHubToken,
+		loadDotEnvFile,
+		noCache,
+		envVars,
+		tgBinaryVersionOverride,
+		tfBinaryVersionOverride,
+		tfVersionFile,
+		gitSSH,
+		tgLogLevel,
+		environment,
+		stack,
+	)
+
+	if baseCtrErr != nil {
+		return "", WrapErrorf(baseCtrErr, "failed to create base jobTg container for the job cd-tg-stack %s", stack)
+	}
+
+	return runCDTgStackAction(ctx, baseCtr, stack, environment, runApply, runDestroy, runPlan)
+}
+
+// validateCDTgStackAction checks that exactly one action (apply, destroy or plan) is set.
+func validateCDTgStackAction(runApply, runDestroy, runPlan bool) error {
+	if !runApply && !runDestroy && !runPlan {
+		return fmt.Errorf("either --run-apply (runApply) or --run-destroy (runDestroy) or --run-plan (runPlan) must be set to true")
+	}
+
+	if runApply && runDestroy {
+		return fmt.Errorf("cannot set both --run-apply (runApply) and --run-destroy (runDestroy) to true")
+	}
+
+	if runPlan && runApply {
+		return fmt.Errorf("cannot set both --run-plan (runPlan) and --run-apply (runApply) to true")
+	}
+
+	if runPlan && runDestroy {
+		return fmt.Errorf("cannot set both --run-plan (runPlan) and --run-destroy (runDestroy) to true")
+	}
+
+	return nil
+}
+
+// runCDTgStackAction runs the action of a CD job on a stack, in a container already configured by JobTg.
+//
+// Parameters:
+//   - ctx: The context for managing the operation's lifecycle.
+//   - baseCtr: The base container, already configured by JobTg.
+//   - stack: The stack to run the action on.
+//   - environment: The environment of the stack.
+//   - runApply: Whether to apply the units whose plan has changes.
+//   - runDestroy: Whether to destroy the stack.
+//   - runPlan: Whether to plan the stack.
+//
+// Returns:
+//   - string: The output of the action.
+//   - error: Any error encountered while running the action.
+func runCDTgStackAction(ctx context.Context, baseCtr *dagger.Container, stack, environment string, runApply, runDestroy, runPlan bool) (string, error) {
+	switch {
+	case runApply:
+		// Applying is done unit by unit, only for those units whose plan has changes.
+		return applyStackUnitsWithChanges(ctx, baseCtr, stack, environment)
+	case runDestroy:
+		return runAllStackCommand(ctx, baseCtr, stack, environment, []string{"destroy"}, []string{"-auto-approve"})
+	case runPlan:
+		return runAllStackCommand(ctx, baseCtr, stack, environment, []string{"plan"}, nil)
 	}
-	// End of Selection
 
-	return jobStackOut, jobStackErr
+	return "", fmt.Errorf("no action to run on stack %s", stack)
 }
 
 func (m *Infra) JobCDTgStackNonDistributable(
@@ -224,7 +215,7 @@ func (m *Infra) JobCDTgStackNonDistributable(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
@@ -244,7 +235,7 @@ func (m *Infra) JobCDTgStackNonDistributable(
 	tgLogLevel string,
 	// environment is the environment to run the Terragrunt commands.
 	environment string,
-	// runApply is a flag to run the apply command.
+	// runApply is a flag to run the apply command. Units whose plan has no changes are skipped.
 	// +optional
 	runApply bool,
 	// runDestroy is a flag to run the destroy command.
@@ -279,3 +270,261 @@ func (m *Infra) JobCDTgStackNonDistributable(
 		runPlan,
 	)
 }
+
+// tgDependencyGraphEdgeRegex matches an edge of the DOT dependency graph, e.g., "dni-generator" -> "age-generator";
+var tgDependencyGraphEdgeRegex = regexp.MustCompile(`^\s*"([^"]+)"\s*->\s*"([^"]+)"\s*;?\s*$`)
+
+// UnitPlanResult represents the result of planning a single unit with -detailed-exitcode.
+type UnitPlanResult struct {
+	Unit       string // Unit is the name of the unit that was planned.
+	WorkDir    string // WorkDir is the Terragrunt working directory of the unit.
+	HasChanges bool   // HasChanges is true when the plan of the unit isn't empty.
+	Output     string // Output contains the output of the plan.
+	Err        error  // Err holds any error encountered while planning the unit.
+}
+
+// applyStackUnitsWithChanges plans every unit of the stack, and applies the units whose plan has changes,
+// along with every unit that depends on them.
+//
+// Each unit is planned concurrently with -detailed-exitcode, which exits with 0 when the plan is empty,
+// and with 2 when there are changes to apply. Since a unit is planned before its dependencies are applied,
+// its plan can't show the changes its dependencies' outputs will bring (or, on a first deploy, it can fail
+// on outputs that don't exist yet). Hence, the dependents of the units with changes are resolved from the
+// dependency graph of the stack, and applied too, whatever their own plan says. The units are applied in a
+// single run-all, restricted to those units, so Terragrunt honours the dependencies' order between them.
+//
+// Parameters:
+//   - ctx: The context for managing the operation's lifecycle.
+//   - baseCtr: The base container, already configured by JobTg.
+//   - stack: The stack to apply.
+//   - environment: The environment to apply.
+//
+// Returns:
+//   - string: A report with the applied and skipped units, followed by the output of the apply.
+//   - error: Any error encountered while planning or applying the units.
+func applyStackUnitsWithChanges(ctx context.Context, baseCtr *dagger.Container, stack, environment string) (string, error) {
+	unitsList, exists := unitsPerStack[stack]
+	if !exists {
+		return "", WrapErrorf(nil, "stack %s not found in unitsPerStack", stack)
+	}
+
+	totalUnits := getTotalUnitsPerStack(stack)
+	if totalUnits == 0 {
+		return "", WrapErrorf(nil, "no units found for stack %s", stack)
+	}
+
+	cmdBuilder, err := newTgCmdBuilder(ctx, baseCtr)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to build the Terragrunt commands for stack %s", stack)
+	}
+
+	stackUnits := make([]string, 0, totalUnits)
+	for _, units := range unitsList {
+		stackUnits = append(stackUnits, units...)
+	}
+
+	stackWorkDir := getTerragruntExecutionPathForStacks(environment, stack)
+
+	graphOut, err := baseCtr.
+		WithExec(withWorkingDir(cmdBuilder.dependencyGraph(), stackWorkDir)).
+		Stdout(ctx)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to get the dependency graph of stack %s", stack)
+	}
+
+	dependents := parseUnitDependents(graphOut, stackUnits)
+
+	var wg sync.WaitGroup
+	resultChan := make(chan UnitPlanResult, totalUnits)
+
+	for _, unit := range stackUnits {
+		wg.Add(1)
+
+		go func(unitName string) {
+			defer wg.Done()
+
+			tgWorkDir := getTerragruntExecutionPath(environment, stack, unitName)
+			planDaggerCtrAsync(ctx, resultChan, baseCtr, cmdBuilder, unitName, tgWorkDir)
+		}(unit)
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	planResults := make(map[string]UnitPlanResult, totalUnits)
+
+	var unitsWithChanges []string
+
+	for result := range resultChan {
+		planResults[result.Unit] = result
+
+		if result.Err == nil && result.HasChanges {
+			unitsWithChanges = append(unitsWithChanges, result.Unit)
+		}
+	}
+
+	unitsToApply := getUnitsWithDependents(unitsWithChanges, dependents)
+
+	var planErrors []error
+	var unitsApplied []UnitPlanResult
+	var unitsSkipped []UnitPlanResult
+
+	for _, unit := range stackUnits {
+		result := planResults[unit]
+
+		switch {
+		case unitsToApply[unit]:
+			// The plan of a dependent can fail on the outputs of a dependency that isn't applied yet, so
+			// it's applied anyway, after its dependencies.
+			unitsApplied = append(unitsApplied, result)
+		case result.Err != nil:
+			planErrors = append(planErrors, result.Err)
+		default:
+			unitsSkipped = append(unitsSkipped, result)
+		}
+	}
+
+	if len(planErrors) > 0 {
+		return "", JoinErrors(planErrors...)
+	}
+
+	report := formatPlanSummaryReport(stack, environment, unitsApplied, unitsSkipped)
+
+	if len(unitsApplied) == 0 {
+		return report + "\nNo units with changes, nothing to apply.\n", nil
+	}
+
+	applyArgs := []string{"apply", "-auto-approve", "--queue-strict-include"}
+	for _, result := range unitsApplied {
+		applyArgs = append(applyArgs, "--queue-include-dir", filepath.Join(defaultMntPath, result.WorkDir))
+	}
+
+	applyCmd := withWorkingDir(cmdBuilder.runAll(applyArgs...), stackWorkDir)
+
+	applyOut, applyErr := baseCtr.
+		WithExec(applyCmd).
+		Stdout(ctx)
+
+	if applyErr != nil {
+		return "", WrapErrorf(applyErr, "failed to apply the units with changes for stack %s", stack)
+	}
+
+	return fmt.Sprintf("%s\nOutput:\n=====================\n%s", report, applyOut), nil
+}
+
+// parseUnitDependents parses the dependency graph of a stack (the DOT output of graph-dependencies) into
+// the units that directly depend on each unit. An edge "A" -> "B" means A depends on B. Nodes are matched
+// to the units of the stack by their directory name, since Terragrunt prints them as relative, or absolute,
+// paths depending on its version. Any other line (e.g., printed by run_cmd) is ignored.
+func parseUnitDependents(graphOut string, units []string) map[string][]string {
+	dependents := map[string][]string{}
+
+	for _, line := range strings.Split(graphOut, "\n") {
+		matches := tgDependencyGraphEdgeRegex.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+
+		dependent, dependency := filepath.Base(matches[1]), filepath.Base(matches[2])
+		if !slices.Contains(units, dependent) || !slices.Contains(units, dependency) {
+			continue
+		}
+
+		if !slices.Contains(dependents[dependency], dependent) {
+			dependents[dependency] = append(dependents[dependency], dependent)
+		}
+	}
+
+	return dependents
+}
+
+// getUnitsWithDependents returns the units, along with every unit that depends on them, transitively.
+func getUnitsWithDependents(units []string, dependents map[string][]string) map[string]bool {
+	resolved := make(map[string]bool, len(units))
+	pending := slices.Clone(units)
+
+	for len(pending) > 0 {
+		unit := pending[0]
+		pending = pending[1:]
+
+		if resolved[unit] {
+			continue
+		}
+
+		resolved[unit] = true
+		pending = append(pending, dependents[unit]...)
+	}
+
+	return resolved
+}
+
+// planDaggerCtrAsync plans a single unit with -detailed-exitcode, and sends the result to the channel.
+//
+// The exit code 0 means the plan is empty, 2 means the plan has changes, and any other exit code
+// is reported as an error.
+func planDaggerCtrAsync(
+	ctx context.Context,
+	resultChan chan<- UnitPlanResult,
+	baseCtr *dagger.Container,
+	cmdBuilder *tgCmdBuilder,
+	unit string,
+	tgWorkDir string,
+) {
+	planRes := UnitPlanResult{Unit: unit, WorkDir: tgWorkDir}
+
+	execCtr := baseCtr.
+		WithExec(withWorkingDir(cmdBuilder.run("plan", "-detailed-exitcode"), tgWorkDir), dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		})
+
+	exitCode, err := execCtr.ExitCode(ctx)
+	if err != nil {
+		planRes.Err = WrapErrorf(err, "failed to plan unit %s on working directory: %s", unit, tgWorkDir)
+		resultChan <- planRes
+
+		return
+	}
+
+	planRes.Output, _ = execCtr.Stdout(ctx)
+
+	switch exitCode {
+	case 0:
+		planRes.HasChanges = false
+	case 2:
+		planRes.HasChanges = true
+	default:
+		stderr, _ := execCtr.Stderr(ctx)
+		planRes.Err = Errorf("plan failed for unit %s on working directory %s (exit code %d): %s", unit, tgWorkDir, exitCode, stderr)
+	}
+
+	resultChan <- planRes
+}
+
+// formatPlanSummaryReport formats the units to apply (with changes, or depending on them), and the skipped
+// ones, into a human readable report.
+func formatPlanSummaryReport(stack, environment string, unitsWithChanges, unitsWithoutChanges []UnitPlanResult) string {
+	unitNames := func(results []UnitPlanResult) string {
+		if len(results) == 0 {
+			return "(none)"
+		}
+
+		names := make([]string, 0, len(results))
+		for _, result := range results {
+			names = append(names, result.Unit)
+		}
+
+		sort.Strings(names)
+
+		return strings.Join(names, ", ")
+	}
+
+	var reportBuilder strings.Builder
+	reportBuilder.WriteString(fmt.Sprintf("Plan summary for stack %s (environment %s)\n", stack, environment))
+	reportBuilder.WriteString("=====================\n")
+	reportBuilder.WriteString(fmt.Sprintf("Units with changes, or depending on them (applied): %s\n", unitNames(unitsWithChanges)))
+	reportBuilder.WriteString(fmt.Sprintf("Units without changes (skipped): %s\n", unitNames(unitsWithoutChanges)))
+
+	return reportBuilder.String()
+}
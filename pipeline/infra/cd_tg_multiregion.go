@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// JobCDTgStackMultiRegion deploys the same stack to several regions concurrently.
+//
+// Each region builds its container once, on its own copy of the module, with the deployment region
+// (TG_STACK_DEPLOYMENT_REGION) set to that region, and with a region-scoped remote state key, so
+// regions never share their state. The region wins over the TG_STACK_DEPLOYMENT_REGION of the .env
+// files. The remote state key of each region is resolved in that same container before anything runs,
+// so the job fails when two regions would share it, and the action then runs on it as JobCDTgStack does. The results are collected through the async JobResult channel, and
+// reported per region.
+//
+// Returns:
+//   - string: A report with the output, or the error, of each region. It's returned even when some regions fail.
+//   - error: The errors of every region that failed, if any.
+func (m *Infra) JobCDTgStackMultiRegion(
+	// Context is the context for managing the operation's lifecycle
+	// +optional
+	ctx context.Context,
+	// remoteStateBucket is the name of the bucket to use for the remote backend.
+	// +optional
+	remoteStateBucket string,
+	// remoteStateLockTable is the name of the lock table to use for the remote backend.
+	// +optional
+	remoteStateLockTable string,
+	// remoteStateRegion is the region of the remote state bucket.
+	// +optional
+	remoteStateRegion string,
+	// awsAccessKeyID is the AWS access key ID.
+	// +optional
+	awsAccessKeyID *dagger.Secret,
+	// awsSecretAccessKey is the AWS secret access key.
+	// +optional
+	awsSecretAccessKey *dagger.Secret,
+	// awsSessionToken is the AWS session token.
+	// +optional
+	awsSessionToken *dagger.Secret,
+	// tfGitlabToken is the Terraform Gitlab token.
+	// +optional
+	tfGitlabToken *dagger.Secret,
+	// GitHubToken is the github token
+	// +optional
+	GitHubToken *dagger.Secret,
+	// loadDotEnvFile is a flag to enable source .env files from the local directory.
+	// +optional
+	loadDotEnvFile bool,
+	// NoCache is a flag to disable caching of the container.
+	// +optional
+	noCache bool,
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
+	// +optional
+	envVars []string,
+	// tgBinaryVersionOverride is the Terragrunt binary version to use.
+	// +optional
+	tgBinaryVersionOverride string,
+	// tfBinaryVersionOverride is the Terraform binary version to use.
+	// +optional
+	tfBinaryVersionOverride string,
+	// tfVersionFile is the Terraform version file to use. I'll generate a .terraform-version file in the working directory.
+	// +optional
+	tfVersionFile string,
+	// gitSSH is a flag to enable SSH for the container.
+	// +optional
+	gitSSH *dagger.Socket,
+	// tgLogLevel is the Terragrunt log level to use.
+	// +optional
+	tgLogLevel string,
+	// stack is the stack to run the Terragrunt commands.
+	stack string,
+	// environment is the environment to run the Terragrunt commands.
+	environment string,
+	// regions are the regions to deploy the stack to (e.g., eu-west-1, us-east-1).
+	regions []string,
+	// runApply is a flag to run the apply command. Units whose plan has no changes are skipped.
+	// +optional
+	runApply bool,
+	// runDestroy is a flag to run the destroy command.
+	// +optional
+	runDestroy bool,
+	// runPlan is a flag to run the plan command.
+	// +optional
+	runPlan bool,
+) (string, error) {
+	if err := validateCDTgStackAction(runApply, runDestroy, runPlan); err != nil {
+		return "", err
+	}
+
+	if len(regions) == 0 {
+		return "", NewError("at least one region must be set to deploy the stack")
+	}
+
+	deploymentRegions := make([]string, 0, len(regions))
+	for _, region := range regions {
+		region = strings.ToLower(strings.TrimSpace(region))
+		if region == "" {
+			return "", NewError("regions cannot contain empty values")
+		}
+
+		if slices.Contains(deploymentRegions, region) {
+			return "", Errorf("region %s is set more than once", region)
+		}
+
+		deploymentRegions = append(deploymentRegions, region)
+	}
+
+	stateKeyUnit, exists := getFirstStackUnit(stack)
+	if !exists {
+		return "", Errorf("no units found for stack %s", stack)
+	}
+
+	remoteStateBucketName := remoteStateBucket
+	remoteStateLockTableName := remoteStateLockTable
+
+	if remoteStateBucket == "" && remoteStateLockTable == "" {
+		remoteStateBucketName = fmt.Sprintf("%s-%s", remoteStateDefaultBucketNamingConvention, environment)
+		remoteStateLockTableName = fmt.Sprintf("%s-%s", remoteStateDefaultLockTableNamingConvention, environment)
+	}
+
+	if remoteStateRegion == "" {
+		remoteStateRegion = defaultRemoteStateRegion
+	}
+
+	// Each region's container is built once, concurrently, and reused to both resolve its remote state key,
+	// and run the action.
+	var prepareWg sync.WaitGroup
+	regionJobChan := make(chan regionJob, len(deploymentRegions))
+
+	for _, region := range deploymentRegions {
+		prepareWg.Add(1)
+
+		go func(deploymentRegion string) {
+			defer prepareWg.Done()
+
+			regionJobChan <- m.prepareRegionJob(ctx,
+				remoteStateBucketName,
+				remoteStateLockTableName,
+				remoteStateRegion,
+				deploymentRegion,
+				awsAccessKeyID,
+				awsSecretAccessKey,
+				awsSessionToken,
+				tfGitlabToken,
+				GitHubToken,
+				loadDotEnvFile,
+				noCache,
+				envVars,
+				tgBinaryVersionOverride,
+				tfBinaryVersionOverride,
+				tfVersionFile,
+				gitSSH,
+				tgLogLevel,
+				stack,
+				environment,
+				stateKeyUnit,
+			)
+		}(region)
+	}
+
+	go func() {
+		prepareWg.Wait()
+		close(regionJobChan)
+	}()
+
+	regionJobs := make([]regionJob, 0, len(deploymentRegions))
+
+	var prepareErrs []error
+
+	for job := range regionJobChan {
+		regionJobs = append(regionJobs, job)
+
+		if job.Err != nil {
+			prepareErrs = append(prepareErrs, job.Err)
+		}
+	}
+
+	if len(prepareErrs) > 0 {
+		return "", JoinErrors(prepareErrs...)
+	}
+
+	// The regions are deployed concurrently, so two regions resolving to the same remote state key (e.g., the
+	// region scoping is disabled by a .env file) would apply on the same state. Nothing runs until every
+	// region's key is known to be its own.
+	sort.Slice(regionJobs, func(i, j int) bool {
+		return regionJobs[i].Region < regionJobs[j].Region
+	})
+
+	regionsPerStateKey := make(map[string]string, len(regionJobs))
+
+	for _, job := range regionJobs {
+		if otherRegion, isShared := regionsPerStateKey[job.StateKey]; isShared {
+			return "", Errorf("regions %s and %s resolve to the same remote state key %s, so they would apply on the same state", otherRegion, job.Region, job.StateKey)
+		}
+
+		regionsPerStateKey[job.StateKey] = job.Region
+	}
+
+	var wg sync.WaitGroup
+	resultChan := make(chan JobResult, len(regionJobs))
+
+	for _, job := range regionJobs {
+		wg.Add(1)
+
+		go func(job regionJob) {
+			defer wg.Done()
+
+			jobRes := JobResult{
+				WorkDir: fmt.Sprintf("%s (region %s)", getTerragruntExecutionPathForStacks(environment, stack), job.Region),
+			}
+
+			regionOut, regionErr := runCDTgStackAction(ctx, job.Ctr, stack, environment, runApply, runDestroy, runPlan)
+
+			jobRes.Output = regionOut
+			if regionErr != nil {
+				jobRes.Err = WrapErrorf(regionErr, "deployment of stack %s failed in region %s", stack, job.Region)
+			}
+
+			resultChan <- jobRes
+		}(job)
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	// Every region is reported, so the output of the regions that were applied isn't lost when others fail.
+	regionResults := make([]JobResult, 0, len(deploymentRegions))
+
+	var regionErrs []error
+
+	for result := range resultChan {
+		regionResults = append(regionResults, result)
+
+		if result.Err != nil {
+			regionErrs = append(regionErrs, result.Err)
+		}
+	}
+
+	report := formatRegionsReport(stack, environment, regionResults)
+	if len(regionErrs) > 0 {
+		return report, JoinErrors(regionErrs...)
+	}
+
+	return report, nil
+}
+
+// regionJob is the container of a region of a multi-region deployment, with its remote state key.
+type regionJob struct {
+	Region   string
+	Ctr      *dagger.Container
+	StateKey string
+	Err      error
+}
+
+// prepareRegionJob builds the container of a region, on its own copy of the module (jobs decorate the
+// module they run on) with a region-scoped remote state, and resolves its remote state key from the
+// given unit.
+func (m *Infra) prepareRegionJob(
+	ctx context.Context,
+	remoteStateBucket, remoteStateLockTable, remoteStateRegion, deploymentRegion string,
+	awsAccessKeyID, awsSecretAccessKey, awsSessionToken, tfGitlabToken, GitHubToken *dagger.Secret,
+	loadDotEnvFile, noCache bool,
+	envVars []string,
+	tgBinaryVersionOverride, tfBinaryVersionOverride, tfVersionFile string,
+	gitSSH *dagger.Socket,
+	tgLogLevel, stack, environment, stateKeyUnit string,
+) regionJob {
+	job := regionJob{Region: deploymentRegion}
+
+	baseCtr, err := m.withAWSPreflight().WithRegionScopedRemoteState().JobTg(ctx,
+		remoteStateBucket,
+		remoteStateLockTable,
+		remoteStateRegion,
+		deploymentRegion,
+		awsAccessKeyID,
+		awsSecretAccessKey,
+		awsSessionToken,
+		tfGitlabToken,
+		GitHubToken,
+		loadDotEnvFile,
+		noCache,
+		envVars,
+		tgBinaryVersionOverride,
+		tfBinaryVersionOverride,
+		tfVersionFile,
+		gitSSH,
+		tgLogLevel,
+		environment,
+		stack,
+	)
+	if err != nil {
+		job.Err = WrapErrorf(err, "failed to create base jobTg container for stack %s in region %s", stack, deploymentRegion)
+
+		return job
+	}
+
+	stateKey, err := getUnitRemoteStateKey(ctx, baseCtr, environment, stack, stateKeyUnit)
+	if err != nil {
+		job.Err = WrapErrorf(err, "failed to resolve the remote state key of stack %s in region %s", stack, deploymentRegion)
+
+		return job
+	}
+
+	job.Ctr = baseCtr
+	job.StateKey = stateKey
+
+	return job
+}
+
+// getFirstStackUnit returns the first unit of a stack, skipping its empty layers. The region is the same
+// part of the remote state key for every unit, so the key of any unit tells whether two regions share it.
+func getFirstStackUnit(stack string) (string, bool) {
+	for _, layer := range unitsPerStack[stack] {
+		if len(layer) > 0 {
+			return layer[0], true
+		}
+	}
+
+	return "", false
+}
+
+// getUnitRemoteStateKey resolves the remote state key of a unit, from its rendered configuration.
+func getUnitRemoteStateKey(ctx context.Context, baseCtr *dagger.Container, environment, stack, unit string) (string, error) {
+	cmdBuilder, err := newTgCmdBuilder(ctx, baseCtr)
+	if err != nil {
+		return "", err
+	}
+
+	tgWorkDir := getTerragruntExecutionPath(environment, stack, unit)
+
+	renderedContent, err := readUnitCommandFile(ctx, baseCtr,
+		withWorkingDir(cmdBuilder.renderJSON(tgRenderedConfigPath), tgWorkDir), tgRenderedConfigPath, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to render the configuration of unit %s: %w", unit, err)
+	}
+
+	var rendered tgRenderedConfig
+	if err := json.Unmarshal([]byte(strings.TrimSpace(renderedContent)), &rendered); err != nil {
+		return "", fmt.Errorf("the rendered configuration of unit %s isn't a valid JSON document", unit)
+	}
+
+	if rendered.RemoteState == nil {
+		return "", fmt.Errorf("unit %s has no remote state", unit)
+	}
+
+	stateKey := getRemoteStateKey(rendered.RemoteState.Config)
+	if stateKey == "" {
+		return "", fmt.Errorf("unit %s has no remote state key", unit)
+	}
+
+	return stateKey, nil
+}
+
+// formatRegionsReport formats the result of every region, applied or failed, into a human readable report.
+func formatRegionsReport(stack, environment string, regionResults []JobResult) string {
+	// The regions finish in any order, so they're sorted for the report to be stable.
+	sort.Slice(regionResults, func(i, j int) bool {
+		return regionResults[i].WorkDir < regionResults[j].WorkDir
+	})
+
+	var reportBuilder strings.Builder
+	reportBuilder.WriteString(fmt.Sprintf("Multi-region deployment of stack %s (environment %s)\n", stack, environment))
+	reportBuilder.WriteString("=====================\n")
+
+	for _, result := range regionResults {
+		status := "succeeded"
+		if result.Err != nil {
+			status = "failed"
+		}
+
+		reportBuilder.WriteString(fmt.Sprintf("--- %s: %s ---\n", result.WorkDir, status))
+
+		switch {
+		case result.Err != nil:
+			reportBuilder.WriteString(fmt.Sprintf("Error: %v\n", result.Err))
+		case result.Output != "":
+			reportBuilder.WriteString(strings.TrimRight(result.Output, "\n") + "\n")
+		default:
+			reportBuilder.WriteString("(No standard output)\n")
+		}
+	}
+
+	return reportBuilder.String()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+)
+
+// JobCDTgStackPreview deploys a stack into an ephemeral preview environment.
+//
+// The preview ID (normally a branch name or a merge request ID) namespaces the remote state key and the
+// resource name prefix, so the stack is applied in isolation from the environment it's based on. The
+// environment argument selects the configuration (infra/terragrunt/<environment>/<stack>) the preview is built from.
+// Once the preview is no longer needed, it should be removed with JobCDTgStackPreviewTeardown.
+func (m *Infra) JobCDTgStackPreview(
+	// Context is the context for managing the operation's lifecycle
+	// +optional
+	ctx context.Context,
+	// remoteStateBucket is the name of the bucket to use for the remote backend.
+	// +optional
+	remoteStateBucket string,
+	// remoteStateLockTable is the name of the lock table to use for the remote backend.
+	// +optional
+	remoteStateLockTable string,
+	// remoteStateRegion is the region of the remote state bucket.
+	// +optional
+	remoteStateRegion string,
+	// deploymentRegion is the AWS region to use for the remote backend.
+	// +optional
+	deploymentRegion string,
+	// awsAccessKeyID is the AWS access key ID.
+	// +optional
+	awsAccessKeyID *dagger.Secret,
+	// awsSecretAccessKey is the AWS secret access key.
+	// +optional
+	awsSecretAccessKey *dagger.Secret,
+	// awsSessionToken is the AWS session token.
+	// +optional
+	awsSessionToken *dagger.Secret,
+	// tfGitlabToken is the Terraform Gitlab token.
+	// +optional
+	tfGitlabToken *dagger.Secret,
+	// GitHubToken is the github token
+	// +optional
+	GitHubToken *dagger.Secret,
+	// loadDotEnvFile is a flag to enable source .env files from the local directory.
+	// +optional
+	loadDotEnvFile bool,
+	// NoCache is a flag to disable caching of the container.
+	// +optional
+	noCache bool,
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
+	// +optional
+	envVars []string,
+	// tgBinaryVersionOverride is the Terragrunt binary version to use.
+	// +optional
+	tgBinaryVersionOverride string,
+	// tfBinaryVersionOverride is the Terraform binary version to use.
+	// +optional
+	tfBinaryVersionOverride string,
+	// tfVersionFile is the Terraform version file to use. I'll generate a .terraform-version file in the working directory.
+	// +optional
+	tfVersionFile string,
+	// gitSSH is a flag to enable SSH for the container.
+	// +optional
+	gitSSH *dagger.Socket,
+	// tgLogLevel is the Terragrunt log level to use.
+	// +optional
+	tgLogLevel string,
+	// stack is the stack to deploy into the preview environment.
+	stack string,
+	// environment is the environment the preview environment is based on.
+	environment string,
+	// previewID is the preview identifier, normally the branch name or the merge request ID.
+	previewID string,
+	// runApply is a flag to run the apply command. Units whose plan has no changes are skipped.
+	// +optional
+	runApply bool,
+	// runPlan is a flag to run the plan command.
+	// +optional
+	runPlan bool,
+) (string, error) {
+	mWithPreview, previewErr := m.WithPreviewEnvironment(previewID)
+	if previewErr != nil {
+		return "", WrapErrorf(previewErr, "failed to set the preview environment for stack %s", stack)
+	}
+
+	return mWithPreview.JobCDTgStack(
+		ctx,
+		remoteStateBucket,
+		remoteStateLockTable,
+		remoteStateRegion,
+		deploymentRegion,
+		awsAccessKeyID,
+		awsSecretAccessKey,
+		awsSessionToken,
+		tfGitlabToken,
+		GitHubToken,
+		loadDotEnvFile,
+		noCache,
+		envVars,
+		tgBinaryVersionOverride,
+		tfBinaryVersionOverride,
+		tfVersionFile,
+		gitSSH,
+		tgLogLevel,
+		stack,
+		environment,
+		runApply,
+		false,
+		runPlan,
+	)
+}
+
+// JobCDTgStackPreviewTeardown destroys everything deployed for a preview environment of a stack.
+//
+// It targets the same namespaced remote state as JobCDTgStackPreview, so only the resources that belong to
+// the given preview ID are destroyed; the environment the preview is based on isn't touched.
+func (m *Infra) JobCDTgStackPreviewTeardown(
+	// Context is the context for managing the operation's lifecycle
+	// +optional
+	ctx context.Context,
+	// remoteStateBucket is the name of the bucket to use for the remote backend.
+	// +optional
+	remoteStateBucket string,
+	// remoteStateLockTable is the name of the lock table to use for the remote backend.
+	// +optional
+	remoteStateLockTable string,
+	// remoteStateRegion is the region of the remote state bucket.
+	// +optional
+	remoteStateRegion string,
+	// deploymentRegion is the AWS region to use for the remote backend.
+	// +optional
+	deploymentRegion string,
+	// awsAccessKeyID is the AWS access key ID.
+	// +optional
+	awsAccessKeyID *dagger.Secret,
+	// awsSecretAccessKey is the AWS secret access key.
+	// +optional
+	awsSecretAccessKey *dagger.Secret,
+	// awsSessionToken is the AWS session token.
+	// +optional
+	awsSessionToken *dagger.Secret,
+	// tfGitlabToken is the Terraform Gitlab token.
+	// +optional
+	tfGitlabToken *dagger.Secret,
+	// GitHubToken is the github token
+	// +optional
+	GitHubToken *dagger.Secret,
+	// loadDotEnvFile is a flag to enable source .env files from the local directory.
+	// +optional
+	loadDotEnvFile bool,
+	// NoCache is a flag to disable caching of the container.
+	// +optional
+	noCache bool,
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
+	// +optional
+	envVars []string,
+	// tgBinaryVersionOverride is the Terragrunt binary version to use.
+	// +optional
+	tgBinaryVersionOverride string,
+	// tfBinaryVersionOverride is the Terraform binary version to use.
+	// +optional
+	tfBinaryVersionOverride string,
+	// tfVersionFile is the Terraform version file to use. I'll generate a .terraform-version file in the working directory.
+	// +optional
+	tfVersionFile string,
+	// gitSSH is a flag to enable SSH for the container.
+	// +optional
+	gitSSH *dagger.Socket,
+	// tgLogLevel is the Terragrunt log level to use.
+	// +optional
+	tgLogLevel string,
+	// stack is the stack whose preview environment is destroyed.
+	stack string,
+	// environment is the environment the preview environment is based on.
+	environment string,
+	// previewID is the preview identifier, normally the branch name or the merge request ID.
+	previewID string,
+) (string, error) {
+	mWithPreview, previewErr := m.WithPreviewEnvironment(previewID)
+	if previewErr != nil {
+		return "", WrapErrorf(previewErr, "failed to set the preview environment for stack %s", stack)
+	}
+
+	return mWithPreview.JobCDTgStack(
+		ctx,
+		remoteStateBucket,
+		remoteStateLockTable,
+		remoteStateRegion,
+		deploymentRegion,
+		awsAccessKeyID,
+		awsSecretAccessKey,
+		awsSessionToken,
+		tfGitlabToken,
+		GitHubToken,
+		loadDotEnvFile,
+		noCache,
+		envVars,
+		tgBinaryVersionOverride,
+		tfBinaryVersionOverride,
+		tfVersionFile,
+		gitSSH,
+		tgLogLevel,
+		stack,
+		environment,
+		false,
+		true,
+		false,
+	)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"dagger/infra/internal/dagger"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	promotionStatusApplied         = "applied"
+	promotionStatusFailed          = "failed"
+	promotionStatusAwaitingApprove = "paused, awaiting approval token"
+	promotionStatusPending         = "pending"
+)
+
+// PromotionStepResult represents the result of promoting a stack into a single environment.
+type PromotionStepResult struct {
+	Environment string // Environment is the environment the stack was promoted to.
+	Status      string // Status is the outcome of the step (applied, failed, paused or pending).
+	Output      string // Output contains the report of the apply on this environment.
+	Err         error  // Err holds any error encountered while applying the stack on this environment.
+}
+
+// JobPromoteStack applies a stack to an ordered list of environments (e.g., dev → staging → prod).
+//
+// Each environment is applied through JobCDTgStack, and the promotion only moves to the next
+// environment once the previous one has been applied successfully. Environments listed in
+// approvalEnvironments are gated: each one has an expected token (expectedApprovalTokens, at the same
+// position), and the promotion pauses there unless an approval token matching it is passed for that
+// environment (approvalTokenEnvironments and approvalTokens, at the same position). Tokens are compared
+// in constant time, and a token that doesn't match fails the job before anything is applied.
+//
+// A paused promotion fails the job by default, with the report of where it stopped, so CI never reports
+// a green run for environments that weren't applied. Set allowApprovalPause to succeed instead. Either
+// way, the promotion is resumed by running the job again with the approval token.
+//
+// Returns:
+//   - string: A combined report, per environment, of the promotion.
+//   - error: Any error encountered while applying the stack, or the pause at a gated environment (unless
+//     allowApprovalPause is set), including the report up to the failed, or paused, environment.
+func (m *Infra) JobPromoteStack(
+	// Context is the context for managing the operation's lifecycle
+	// +optional
+	ctx context.Context,
+	// remoteStateBucket is the name of the bucket to use for the remote backend.
+	// +optional
+	remoteStateBucket string,
+	// remoteStateLockTable is the name of the lock table to use for the remote backend.
+	// +optional
+	remoteStateLockTable string,
+	// remoteStateRegion is the region of the remote state bucket.
+	// +optional
+	remoteStateRegion string,
+	// deploymentRegion is the AWS region to use for the remote backend.
+	// +optional
+	deploymentRegion string,
+	// awsAccessKeyID is the AWS access key ID.
+	// +optional
+	awsAccessKeyID *dagger.Secret,
+	// awsSecretAccessKey is the AWS secret access key.
+	// +optional
+	awsSecretAccessKey *dagger.Secret,
+	// awsSessionToken is the AWS session token.
+	// +optional
+	awsSessionToken *dagger.Secret,
+	// tfGitlabToken is the Terraform Gitlab token.
+	// +optional
+	tfGitlabToken *dagger.Secret,
+	// GitHubToken is the github token
+	// +optional
+	GitHubToken *dagger.Secret,
+	// loadDotEnvFile is a flag to enable source .env files from the local directory.
+	// +optional
+	loadDotEnvFile bool,
+	// NoCache is a flag to disable caching of the container.
+	// +optional
+	noCache bool,
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
+	// +optional
+	envVars []string,
+	// tgBinaryVersionOverride is the Terragrunt binary version to use.
+	// +optional
+	tgBinaryVersionOverride string,
+	// tfBinaryVersionOverride is the Terraform binary version to use.
+	// +optional
+	tfBinaryVersionOverride string,
+	// tfVersionFile is the Terraform version file to use. I'll generate a .terraform-version file in the working directory.
+	// +optional
+	tfVersionFile string,
+	// gitSSH is a flag to enable SSH for the container.
+	// +optional
+	gitSSH *dagger.Socket,
+	// tgLogLevel is the Terragrunt log level to use.
+	// +optional
+	tgLogLevel string,
+	// stack is the stack to promote.
+	stack string,
+	// environments is the ordered list of environments to promote the stack through (e.g., dev, staging, prod).
+	environments []string,
+	// approvalEnvironments is the list of environments that require an approval token before being applied.
+	// +optional
+	approvalEnvironments []string,
+	// expectedApprovalTokens are the tokens that approve each gated environment, in the same order as approvalEnvironments.
+	// +optional
+	expectedApprovalTokens []*dagger.Secret,
+	// approvalTokenEnvironments are the environments approved by approvalTokens, in the same order.
+	// +optional
+	approvalTokenEnvironments []string,
+	// approvalTokens are the approval tokens passed for this run, in the same order as approvalTokenEnvironments.
+	// +optional
+	approvalTokens []*dagger.Secret,
+	// allowApprovalPause makes the job succeed when the promotion pauses at a gated environment, instead of failing.
+	// +optional
+	allowApprovalPause bool,
+) (string, error) {
+	// The environments are validated before anything runs, so a typo never applies part of the promotion.
+	environments, err := getPromotionEnvironments(environments, approvalEnvironments)
+	if err != nil {
+		return "", WrapErrorf(err, "invalid environments for the promotion of stack %s", stack)
+	}
+
+	approvedEnvironments, approvalErr := getApprovedEnvironments(ctx, approvalEnvironments, expectedApprovalTokens,
+		approvalTokenEnvironments, approvalTokens)
+	if approvalErr != nil {
+		return "", WrapErrorf(approvalErr, "invalid approval tokens for the promotion of stack %s", stack)
+	}
+
+	requiresApproval := make(map[string]bool, len(approvalEnvironments))
+	for _, env := range approvalEnvironments {
+		requiresApproval[strings.TrimSpace(env)] = true
+	}
+
+	steps := make([]PromotionStepResult, 0, len(environments))
+	for idx, environment := range environments {
+		if requiresApproval[environment] && !approvedEnvironments[environment] {
+			steps = append(steps, PromotionStepResult{Environment: environment, Status: promotionStatusAwaitingApprove})
+
+			for _, pendingEnv := range environments[idx+1:] {
+				steps = append(steps, PromotionStepResult{Environment: pendingEnv, Status: promotionStatusPending})
+			}
+
+			if allowApprovalPause {
+				return formatPromotionReport(stack, steps), nil
+			}
+
+			return "", Errorf("promotion of stack %s paused at environment %s, awaiting an approval token\n%s", stack, environment, formatPromotionReport(stack, steps))
+		}
+
+		// Each environment gets its own copy of the module, so the configuration of one
+		// environment doesn't leak into the next one.
+		stepOut, stepErr := m.clone().JobCDTgStack(
+			ctx,
+			remoteStateBucket,
+			remoteStateLockTable,
+			remoteStateRegion,
+			deploymentRegion,
+			awsAccessKeyID,
+			awsSecretAccessKey,
+			awsSessionToken,
+			tfGitlabToken,
+			GitHubToken,
+			loadDotEnvFile,
+			noCache,
+			envVars,
+			tgBinaryVersionOverride,
+			tfBinaryVersionOverride,
+			tfVersionFile,
+			gitSSH,
+			tgLogLevel,
+			stack,
+			environment,
+			true,
+			false,
+			false,
+		)
+
+		if stepErr != nil {
+			steps = append(steps, PromotionStepResult{Environment: environment, Status: promotionStatusFailed, Err: stepErr})
+
+			for _, pendingEnv := range environments[idx+1:] {
+				steps = append(steps, PromotionStepResult{Environment: pendingEnv, Status: promotionStatusPending})
+			}
+
+			return "", WrapErrorf(stepErr, "promotion of stack %s stopped at environment %s\n%s", stack, environment, formatPromotionReport(stack, steps))
+		}
+
+		steps = append(steps, PromotionStepResult{Environment: environment, Status: promotionStatusApplied, Output: stepOut})
+	}
+
+	return formatPromotionReport(stack, steps), nil
+}
+
+// getPromotionEnvironments trims the environments to promote the stack through, and checks that none of
+// them is empty, or listed twice, and that every gated environment is one of them.
+func getPromotionEnvironments(environments, approvalEnvironments []string) ([]string, error) {
+	if len(environments) == 0 {
+		return nil, fmt.Errorf("at least one environment must be set to promote the stack")
+	}
+
+	promotionEnvironments := make([]string, 0, len(environments))
+
+	for idx, env := range environments {
+		env = strings.TrimSpace(env)
+		if env == "" {
+			return nil, fmt.Errorf("environment at position %d is empty", idx)
+		}
+
+		if slices.Contains(promotionEnvironments, env) {
+			return nil, fmt.Errorf("environment %s is listed more than once", env)
+		}
+
+		promotionEnvironments = append(promotionEnvironments, env)
+	}
+
+	gatedEnvironments := make([]string, 0, len(approvalEnvironments))
+
+	for idx, env := range approvalEnvironments {
+		env = strings.TrimSpace(env)
+		if env == "" {
+			return nil, fmt.Errorf("gated environment at position %d is empty", idx)
+		}
+
+		if slices.Contains(gatedEnvironments, env) {
+			return nil, fmt.Errorf("gated environment %s is listed more than once", env)
+		}
+
+		if !slices.Contains(promotionEnvironments, env) {
+			return nil, fmt.Errorf("gated environment %s isn't one of the environments to promote the stack through", env)
+		}
+
+		gatedEnvironments = append(gatedEnvironments, env)
+	}
+
+	return promotionEnvironments, nil
+}
+
+// getApprovedEnvironments checks the approval tokens passed for this run against the expected tokens of
+// the gated environments, and returns the environments they approve. Tokens are compared in constant time,
+// and never part of the errors.
+func getApprovedEnvironments(
+	ctx context.Context,
+	approvalEnvironments []string,
+	expectedApprovalTokens []*dagger.Secret,
+	approvalTokenEnvironments []string,
+	approvalTokens []*dagger.Secret,
+) (map[string]bool, error) {
+	if len(approvalEnvironments) != len(expectedApprovalTokens) {
+		return nil, fmt.Errorf("got %d gated environments and %d expected approval tokens, each gated environment needs exactly one",
+			len(approvalEnvironments), len(expectedApprovalTokens))
+	}
+
+	if len(approvalTokenEnvironments) != len(approvalTokens) {
+		return nil, fmt.Errorf("got %d approved environments and %d approval tokens, each approved environment needs exactly one",
+			len(approvalTokenEnvironments), len(approvalTokens))
+	}
+
+	expectedTokens := make(map[string]*dagger.Secret, len(approvalEnvironments))
+	for idx, env := range approvalEnvironments {
+		expectedTokens[strings.TrimSpace(env)] = expectedApprovalTokens[idx]
+	}
+
+	approvedEnvironments := make(map[string]bool, len(approvalTokenEnvironments))
+
+	for idx, env := range approvalTokenEnvironments {
+		env = strings.TrimSpace(env)
+
+		expectedToken, isGated := expectedTokens[env]
+		if !isGated {
+			return nil, fmt.Errorf("approval token at position %d is for environment %s, which isn't gated", idx, env)
+		}
+
+		if approvedEnvironments[env] {
+			return nil, fmt.Errorf("approval token of environment %s is passed more than once", env)
+		}
+
+		if approvalTokens[idx] == nil || expectedToken == nil {
+			return nil, fmt.Errorf("approval token of environment %s is missing", env)
+		}
+
+		token, err := approvalTokens[idx].Plaintext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the approval token of environment %s: %w", env, err)
+		}
+
+		expected, err := expectedToken.Plaintext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the expected approval token of environment %s: %w", env, err)
+		}
+
+		token, expected = strings.TrimSpace(token), strings.TrimSpace(expected)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			return nil, fmt.Errorf("approval token of environment %s doesn't match its expected token", env)
+		}
+
+		approvedEnvironments[env] = true
+	}
+
+	return approvedEnvironments, nil
+}
+
+// formatPromotionReport formats the result of every promotion step into a combined report.
+func formatPromotionReport(stack string, steps []PromotionStepResult) string {
+	environments := make([]string, 0, len(steps))
+	for _, step := range steps {
+		environments = append(environments, step.Environment)
+	}
+
+	var reportBuilder strings.Builder
+	reportBuilder.WriteString(fmt.Sprintf("Promotion of stack %s: %s\n", stack, strings.Join(environments, " → ")))
+	reportBuilder.WriteString("=====================\n")
+
+	for idx, step := range steps {
+		reportBuilder.WriteString(fmt.Sprintf("[%d/%d] Environment: %s - %s\n", idx+1, len(steps), step.Environment, step.Status))
+
+		if step.Err != nil {
+			reportBuilder.WriteString(fmt.Sprintf("Error: %v\n", step.Err))
+		}
+
+		if step.Output != "" {
+			reportBuilder.WriteString(step.Output)
+
+			if !strings.HasSuffix(step.Output, "\n") {
+				reportBuilder.WriteString("\n")
+			}
+		}
+
+		reportBuilder.WriteString("--------------------\n")
+	}
+
+	return reportBuilder.String()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGetPromotionEnvironments(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		environments         []string
+		approvalEnvironments []string
+		want                 []string
+		wantErr              string
+	}{
+		{name: "trimmed", environments: []string{" dev", "staging ", "prod"}, approvalEnvironments: []string{" prod "}, want: []string{"dev", "staging", "prod"}},
+		{name: "no environments", wantErr: "at least one environment"},
+		{name: "empty environment", environments: []string{"dev", " ", "prod"}, wantErr: "position 1 is empty"},
+		{name: "duplicate environment", environments: []string{"dev", "prod", "dev"}, wantErr: "dev is listed more than once"},
+		{name: "empty gated environment", environments: []string{"dev", "prod"}, approvalEnvironments: []string{""}, wantErr: "position 0 is empty"},
+		{name: "duplicate gated environment", environments: []string{"dev", "prod"}, approvalEnvironments: []string{"prod", "prod"}, wantErr: "prod is listed more than once"},
+		{name: "unknown gated environment", environments: []string{"dev", "prod"}, approvalEnvironments: []string{"production"}, wantErr: "production isn't one of the environments"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getPromotionEnvironments(tc.environments, tc.approvalEnvironments)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -85,7 +85,7 @@ func (m *Infra) JobCITgStackStaticAnalysis(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
@@ -141,12 +141,19 @@ func (m *Infra) JobCITgStackStaticAnalysis(
 		tfVersionFile,
 		gitSSH,
 		tgLogLevel,
+		environment,
+		stack,
 	)
 
 	if baseCtrErr != nil {
 		return "", WrapErrorf(baseCtrErr, "failed to create base jobTg container for stack %s", stack)
 	}
 
+	cmdBuilder, err := newTgCmdBuilder(ctx, baseCtr)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to build the Terragrunt commands for stack %s", stack)
+	}
+
 	// Get the units for the specified stack
 	unitsList, exists := unitsPerStack[stack]
 	if !exists {
@@ -180,12 +187,11 @@ func (m *Infra) JobCITgStackStaticAnalysis(
 
 				// Define the commands to execute
 				commands := [][]string{
-					{"terragrunt", "init", "--working-dir", tgWorkDir},
-					{"terragrunt", "terragrunt-info", "--working-dir", tgWorkDir},
-					// FIXME: This command is going tom be deprecated in further versions of Terragrunt. Plan to remove it.
-					{"terragrunt", "hclfmt", "--check", "--diff", "--working-dir", tgWorkDir},
-					{"terragrunt", "validate-inputs", "--working-dir", tgWorkDir},
-					{"terragrunt", "hclvalidate", "--show-config-path", "--working-dir", tgWorkDir},
+					withWorkingDir(cmdBuilder.run("init"), tgWorkDir),
+					withWorkingDir(cmdBuilder.info(), tgWorkDir),
+					withWorkingDir(cmdBuilder.hclFmtCheck(), tgWorkDir),
+					withWorkingDir(cmdBuilder.validateInputs(), tgWorkDir),
+					withWorkingDir(cmdBuilder.hclValidate(), tgWorkDir),
 				}
 
 				// Execute commands asynchronously using the helper function
@@ -249,7 +255,7 @@ func (m *Infra) JobCITgStackNonDistributableStaticAnalysis(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
@@ -331,7 +337,7 @@ func (m *Infra) JobCITgStackDniGeneratorStaticAnalysis(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
@@ -413,7 +419,7 @@ func (m *Infra) JobCITgStackAgeGeneratorStaticAnalysis(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
@@ -495,7 +501,7 @@ func (m *Infra) JobCITgStackNameGeneratorStaticAnalysis(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
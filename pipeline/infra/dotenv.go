@@ -0,0 +1,548 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	dotEnvBaseFile       = ".env"
+	dotEnvFileSuffix     = ".env"
+	dotEnvLayerSeparator = "."
+)
+
+var dotEnvKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// dotEnvVar represents a variable loaded from the dot env layers, and the file it came from.
+type dotEnvVar struct {
+	Key    string // Key is the name of the variable.
+	Value  string // Value is the value of the variable, after the layers are merged.
+	Source string // Source is the file the value came from (the last layer that defines the key).
+	Secret bool   // Secret is whether the value is set as a secret variable.
+}
+
+// dotEnvParser parses the content of a .env file, following the common dotenv semantics:
+//
+//   - Empty lines, and lines starting with #, are ignored. An 'export ' prefix before the key is allowed.
+//   - Unquoted values are trimmed, and a # preceded by whitespace starts an inline comment.
+//   - Single-quoted (and backtick-quoted) values are literal: no escapes, nor expansion.
+//   - Double-quoted values support the \n, \r, \t, \\, \" and \$ escapes.
+//   - Quoted values can span several lines.
+//   - Unquoted and double-quoted values expand ${VAR}, $VAR, ${VAR:-default} and ${VAR-default}, from the
+//     keys defined before them (or the lookup function), and expand to an empty string when they're not set.
+//
+// Errors are reported with the file and line they happened on, but never with the values, since they can be secrets.
+type dotEnvParser struct {
+	file       string
+	content    []rune
+	pos        int
+	line       int
+	values     map[string]string
+	lookup     func(key string) (string, bool)
+	references []string // references are the keys the value being parsed expanded, so far.
+}
+
+// parseDotEnvContent parses the content of a .env file into its KEY=VALUE pairs, in the order they're defined.
+// When a key is defined more than once, the last definition wins. Keys that aren't defined in the file are
+// expanded through lookup (e.g., the values of the .env files loaded before), which can be nil.
+func parseDotEnvContent(file, fileContent string, lookup func(key string) (string, bool)) ([]EnvVarDagger, error) {
+	envVars, _, err := parseDotEnvContentWithReferences(file, fileContent, lookup)
+
+	return envVars, err
+}
+
+// parseDotEnvContentWithReferences parses the content of a .env file like parseDotEnvContent, and also
+// returns the keys each value expanded (e.g., DB_PASSWORD for DB_URL=postgres://u:${DB_PASSWORD}@h), so
+// a value built from a secret can be set as a secret too.
+func parseDotEnvContentWithReferences(
+	file, fileContent string,
+	lookup func(key string) (string, bool),
+) ([]EnvVarDagger, map[string][]string, error) {
+	parser := &dotEnvParser{
+		file:    file,
+		content: []rune(strings.ReplaceAll(fileContent, "\r\n", "\n")),
+		line:    1,
+		values:  map[string]string{},
+		lookup:  lookup,
+	}
+
+	envVars := []EnvVarDagger{}
+	keyIndex := map[string]int{}
+	references := map[string][]string{}
+
+	for {
+		key, value, found, err := parser.next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !found {
+			break
+		}
+
+		parser.values[key] = value
+		references[key] = parser.references
+
+		if idx, duplicated := keyIndex[key]; duplicated {
+			envVars[idx].Value = value
+
+			continue
+		}
+
+		keyIndex[key] = len(envVars)
+		envVars = append(envVars, EnvVarDagger{Key: key, Value: value})
+	}
+
+	return envVars, references, nil
+}
+
+// getDotEnvLayerFiles returns the .env files to load, in the order they're layered:
+//
+//  1. The base files: .env, and then every other *.env file, sorted by name.
+//  2. The environment layer: .env.<environment>.
+//  3. The stack layer: .env.<environment>.<stack>.
+//
+// A layer is skipped when its file doesn't exist, or the environment (or stack) isn't set.
+func getDotEnvLayerFiles(entries []string, environment, stack string) []string {
+	exists := make(map[string]bool, len(entries))
+	baseFiles := []string{}
+
+	for _, entry := range entries {
+		exists[entry] = true
+
+		if entry != dotEnvBaseFile && strings.HasSuffix(entry, dotEnvFileSuffix) {
+			baseFiles = append(baseFiles, entry)
+		}
+	}
+
+	sort.Strings(baseFiles)
+
+	layerFiles := []string{}
+	if exists[dotEnvBaseFile] {
+		layerFiles = append(layerFiles, dotEnvBaseFile)
+	}
+
+	layerFiles = append(layerFiles, baseFiles...)
+
+	if environment == "" {
+		return layerFiles
+	}
+
+	environmentFile := dotEnvBaseFile + dotEnvLayerSeparator + environment
+	if exists[environmentFile] {
+		layerFiles = append(layerFiles, environmentFile)
+	}
+
+	if stack != "" {
+		stackFile := environmentFile + dotEnvLayerSeparator + stack
+		if exists[stackFile] {
+			layerFiles = append(layerFiles, stackFile)
+		}
+	}
+
+	return layerFiles
+}
+
+// formatDotEnvLayersReport formats which file each key of the dot env layers came from. Values are never
+// part of the report, only whether they're set as secrets.
+func formatDotEnvLayersReport(environment, stack string, layerFiles []string, dotEnvVars []dotEnvVar) string {
+	var reportBuilder strings.Builder
+
+	reportBuilder.WriteString(fmt.Sprintf("Dot env layers (environment: %s, stack: %s): %s\n",
+		getValueOrNone(environment), getValueOrNone(stack), strings.Join(layerFiles, " → ")))
+	reportBuilder.WriteString("=====================\n")
+
+	keyWidth := 0
+	for _, envVar := range dotEnvVars {
+		keyWidth = max(keyWidth, len(envVar.Key))
+	}
+
+	for _, envVar := range dotEnvVars {
+		source := envVar.Source
+		if envVar.Secret {
+			source += " (secret)"
+		}
+
+		reportBuilder.WriteString(fmt.Sprintf("%-*s  %s\n", keyWidth, envVar.Key, source))
+	}
+
+	return reportBuilder.String()
+}
+
+// getValueOrNone returns the value, or '(none)' when it's empty, for reports.
+func getValueOrNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+
+	return value
+}
+
+// next parses the next KEY=VALUE statement. It returns false once there are no more statements.
+func (p *dotEnvParser) next() (string, string, bool, error) {
+	p.skipBlankLinesAndComments()
+
+	if p.eof() {
+		return "", "", false, nil
+	}
+
+	statementLine := p.line
+	p.references = nil
+
+	p.skipExportPrefix()
+
+	key := p.readWhile(func(r rune) bool {
+		return r != '=' && r != '\n' && r != ' ' && r != '\t'
+	})
+
+	if key == "" {
+		return "", "", false, p.errorf(statementLine, "expected a variable name")
+	}
+
+	if !dotEnvKeyRegex.MatchString(key) {
+		// The name itself isn't part of the error, since a malformed line can be (part of) a value.
+		return "", "", false, p.errorf(statementLine, "invalid variable name, it must start with a letter or '_', followed by letters, digits, '_' or '.'")
+	}
+
+	p.skipInlineWhitespace()
+
+	if p.eof() || p.peek() != '=' {
+		return "", "", false, p.errorf(statementLine, "missing '=' after the variable name")
+	}
+
+	p.pos++
+	p.skipInlineWhitespace()
+
+	var (
+		value string
+		err   error
+	)
+
+	switch p.peekOrZero() {
+	case '\'', '`':
+		value, err = p.readLiteralQuoted(key)
+	case '"':
+		value, err = p.readDoubleQuoted(key)
+	default:
+		value, err = p.readUnquoted(key)
+	}
+
+	if err != nil {
+		return "", "", false, err
+	}
+
+	return key, value, true, nil
+}
+
+// readUnquoted reads an unquoted value, up to the end of the line, or an inline comment.
+func (p *dotEnvParser) readUnquoted(key string) (string, error) {
+	valueLine := p.line
+	raw := p.readWhile(func(r rune) bool { return r != '\n' })
+
+	runes := []rune(raw)
+	for idx, r := range runes {
+		if r == '#' && (idx == 0 || runes[idx-1] == ' ' || runes[idx-1] == '\t') {
+			raw = string(runes[:idx])
+
+			break
+		}
+	}
+
+	value, err := p.expand(strings.TrimSpace(raw), false)
+	if err != nil {
+		return "", p.errorf(valueLine, "invalid value of %s: %v", key, err)
+	}
+
+	return value, nil
+}
+
+// readLiteralQuoted reads a single-quoted, or backtick-quoted, value, as it is.
+func (p *dotEnvParser) readLiteralQuoted(key string) (string, error) {
+	openLine := p.line
+	quote := p.content[p.pos]
+	p.pos++
+
+	var value strings.Builder
+
+	for !p.eof() && p.peek() != quote {
+		value.WriteRune(p.advance())
+	}
+
+	if p.eof() {
+		return "", p.errorf(openLine, "unterminated %c-quoted value of %s", quote, key)
+	}
+
+	p.pos++
+
+	if err := p.expectEndOfValue(key); err != nil {
+		return "", err
+	}
+
+	return value.String(), nil
+}
+
+// readDoubleQuoted reads a double-quoted value, processing its escapes, and expanding its variables.
+func (p *dotEnvParser) readDoubleQuoted(key string) (string, error) {
+	openLine := p.line
+	p.pos++
+
+	var raw strings.Builder
+
+	for !p.eof() && p.peek() != '"' {
+		r := p.advance()
+		raw.WriteRune(r)
+
+		// An escaped character (including a quote) never closes the value.
+		if r == '\\' && !p.eof() {
+			raw.WriteRune(p.advance())
+		}
+	}
+
+	if p.eof() {
+		return "", p.errorf(openLine, "unterminated double-quoted value of %s", key)
+	}
+
+	p.pos++
+
+	if err := p.expectEndOfValue(key); err != nil {
+		return "", err
+	}
+
+	value, err := p.expand(raw.String(), true)
+	if err != nil {
+		return "", p.errorf(openLine, "invalid value of %s: %v", key, err)
+	}
+
+	return value, nil
+}
+
+// expectEndOfValue checks that only whitespace, or a comment, follows a quoted value in its line.
+func (p *dotEnvParser) expectEndOfValue(key string) error {
+	p.skipInlineWhitespace()
+
+	if p.eof() || p.peek() == '\n' {
+		return nil
+	}
+
+	if p.peek() == '#' {
+		p.readWhile(func(r rune) bool { return r != '\n' })
+
+		return nil
+	}
+
+	return p.errorf(p.line, "unexpected characters after the closing quote of the value of %s", key)
+}
+
+// expand expands the variable references of a value and, for double-quoted values, processes its escapes.
+func (p *dotEnvParser) expand(raw string, processEscapes bool) (string, error) {
+	runes := []rune(raw)
+
+	var expanded strings.Builder
+
+	for idx := 0; idx < len(runes); idx++ {
+		r := runes[idx]
+
+		switch {
+		case r == '\\' && idx+1 < len(runes) && runes[idx+1] == '$':
+			expanded.WriteRune('$')
+			idx++
+		case r == '\\' && processEscapes && idx+1 < len(runes):
+			idx++
+
+			switch runes[idx] {
+			case 'n':
+				expanded.WriteRune('\n')
+			case 'r':
+				expanded.WriteRune('\r')
+			case 't':
+				expanded.WriteRune('\t')
+			case '\\', '"':
+				expanded.WriteRune(runes[idx])
+			default:
+				expanded.WriteRune('\\')
+				expanded.WriteRune(runes[idx])
+			}
+		case r == '$' && idx+1 < len(runes) && runes[idx+1] == '{':
+			end := indexClosingBrace(runes[idx+2:])
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference ${")
+			}
+
+			reference := string(runes[idx+2 : idx+2+end])
+
+			value, err := p.resolveReference(reference)
+			if err != nil {
+				return "", err
+			}
+
+			expanded.WriteString(value)
+			idx += 2 + end
+		case r == '$' && idx+1 < len(runes) && isDotEnvNameStart(runes[idx+1]):
+			end := idx + 1
+			for end < len(runes) && isDotEnvNameChar(runes[end]) {
+				end++
+			}
+
+			value, _ := p.resolve(string(runes[idx+1 : end]))
+			expanded.WriteString(value)
+			idx = end - 1
+		default:
+			expanded.WriteRune(r)
+		}
+	}
+
+	return expanded.String(), nil
+}
+
+// resolveReference resolves a ${...} reference: ${VAR}, ${VAR:-default} (default when unset, or empty)
+// or ${VAR-default} (default when unset).
+func (p *dotEnvParser) resolveReference(reference string) (string, error) {
+	// The name ends at the operator, so the default value can have its own references (e.g., ${A:-${B}}).
+	nameEnd := 0
+	for nameEnd < len(reference) && (isDotEnvNameChar(rune(reference[nameEnd])) || reference[nameEnd] == '.') {
+		nameEnd++
+	}
+
+	name, operator := reference[:nameEnd], reference[nameEnd:]
+	defaultValue, useDefaultIfEmpty, hasDefault := "", false, false
+
+	switch {
+	case operator == "":
+	case strings.HasPrefix(operator, ":-"):
+		defaultValue, useDefaultIfEmpty, hasDefault = operator[2:], true, true
+	case strings.HasPrefix(operator, "-"):
+		defaultValue, hasDefault = operator[1:], true
+	default:
+		return "", fmt.Errorf("invalid variable reference ${%s}, only ${VAR}, ${VAR:-default} and ${VAR-default} are supported", name)
+	}
+
+	if !dotEnvKeyRegex.MatchString(name) {
+		return "", fmt.Errorf("invalid variable reference ${%s}", name)
+	}
+
+	value, isSet := p.resolve(name)
+
+	if hasDefault && (!isSet || (useDefaultIfEmpty && value == "")) {
+		return p.expand(defaultValue, false)
+	}
+
+	return value, nil
+}
+
+// resolve returns the value of a key defined before in the file, or else through the lookup function.
+// The key is recorded as a reference of the value being parsed.
+func (p *dotEnvParser) resolve(name string) (string, bool) {
+	if !slices.Contains(p.references, name) {
+		p.references = append(p.references, name)
+	}
+
+	if value, ok := p.values[name]; ok {
+		return value, true
+	}
+
+	if p.lookup != nil {
+		return p.lookup(name)
+	}
+
+	return "", false
+}
+
+func (p *dotEnvParser) skipBlankLinesAndComments() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\n':
+			p.advance()
+		case '#':
+			p.readWhile(func(r rune) bool { return r != '\n' })
+		default:
+			return
+		}
+	}
+}
+
+func (p *dotEnvParser) skipExportPrefix() {
+	const exportPrefix = "export"
+
+	end := p.pos + len(exportPrefix)
+	if end < len(p.content) && string(p.content[p.pos:end]) == exportPrefix &&
+		(p.content[end] == ' ' || p.content[end] == '\t') {
+		p.pos = end
+		p.skipInlineWhitespace()
+	}
+}
+
+func (p *dotEnvParser) skipInlineWhitespace() {
+	p.readWhile(func(r rune) bool { return r == ' ' || r == '\t' })
+}
+
+func (p *dotEnvParser) readWhile(accept func(r rune) bool) string {
+	start := p.pos
+	for !p.eof() && accept(p.peek()) {
+		p.advance()
+	}
+
+	return string(p.content[start:p.pos])
+}
+
+func (p *dotEnvParser) advance() rune {
+	r := p.content[p.pos]
+	p.pos++
+
+	if r == '\n' {
+		p.line++
+	}
+
+	return r
+}
+
+func (p *dotEnvParser) peek() rune {
+	return p.content[p.pos]
+}
+
+func (p *dotEnvParser) peekOrZero() rune {
+	if p.eof() {
+		return 0
+	}
+
+	return p.peek()
+}
+
+func (p *dotEnvParser) eof() bool {
+	return p.pos >= len(p.content)
+}
+
+func (p *dotEnvParser) errorf(line int, format string, args ...interface{}) error {
+	return Errorf("invalid dot env file '%s' on line %d: %s", p.file, line, fmt.Sprintf(format, args...))
+}
+
+// indexClosingBrace returns the index of the brace that closes a ${ reference, skipping the braces of the
+// references nested in its default value (e.g., ${A:-${B}}).
+func indexClosingBrace(runes []rune) int {
+	depth := 0
+
+	for idx, r := range runes {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return idx
+			}
+
+			depth--
+		}
+	}
+
+	return -1
+}
+
+func isDotEnvNameStart(r rune) bool {
+	return r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z')
+}
+
+func isDotEnvNameChar(r rune) bool {
+	return isDotEnvNameStart(r) || (r >= '0' && r <= '9')
+}
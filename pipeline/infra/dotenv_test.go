@@ -0,0 +1,188 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDotEnvContent(t *testing.T) {
+	lookup := func(key string) (string, bool) {
+		values := map[string]string{"FROM_LAYER": "layer", "EMPTY_LAYER": ""}
+		value, ok := values[key]
+
+		return value, ok
+	}
+
+	testCases := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "plain values",
+			content: "A=1\nB = two \n\n# comment\nC=",
+			want:    map[string]string{"A": "1", "B": "two", "C": ""},
+		},
+		{
+			name:    "export prefix",
+			content: "export A=1\nexport\tB=\"two\"",
+			want:    map[string]string{"A": "1", "B": "two"},
+		},
+		{
+			name:    "inline comments",
+			content: "A=1 # comment\nB=a#b\nC=\"quoted # not a comment\" # comment\nD='x' # comment",
+			want:    map[string]string{"A": "1", "B": "a#b", "C": "quoted # not a comment", "D": "x"},
+		},
+		{
+			name:    "escaped quotes",
+			content: `A="say \"hi\""` + "\n" + `B="back\\slash\tand\nnewline"` + "\n" + `C='no \"escapes\"'`,
+			want:    map[string]string{"A": `say "hi"`, "B": "back\\slash\tand\nnewline", "C": `no \"escapes\"`},
+		},
+		{
+			name:    "multi-line quotes",
+			content: "A=\"line 1\nline 2\"\nB='line 1\nline 2'\nC=after",
+			want:    map[string]string{"A": "line 1\nline 2", "B": "line 1\nline 2", "C": "after"},
+		},
+		{
+			name:    "variable expansion",
+			content: "A=1\nB=${A}-$A\nC=\"${FROM_LAYER}\"\nD='${A}'\nE=${UNSET}\nF=\\${A}",
+			want:    map[string]string{"A": "1", "B": "1-1", "C": "layer", "D": "${A}", "E": "", "F": "${A}"},
+		},
+		{
+			name:    "default values",
+			content: "A=1\nB=${UNSET:-x}\nC=${EMPTY_LAYER:-x}\nD=${EMPTY_LAYER-x}\nE=${UNSET-x}\nF=${A:-x}",
+			want:    map[string]string{"A": "1", "B": "x", "C": "x", "D": "", "E": "x", "F": "1"},
+		},
+		{
+			name:    "nested default values",
+			content: "A=1\nB=${C:-${A}}\nD=${C:-${E:-${A}}}\nF=${A:-${C}}",
+			want:    map[string]string{"A": "1", "B": "1", "D": "1", "F": "1"},
+		},
+		{
+			name:    "redefined key",
+			content: "A=1\nA=2",
+			want:    map[string]string{"A": "2"},
+		},
+		{
+			name:    "error on invalid variable name",
+			content: "A=1\n\n1A=2",
+			wantErr: "on line 3",
+		},
+		{
+			name:    "error on missing equals",
+			content: "A=1\nB",
+			wantErr: "on line 2",
+		},
+		{
+			name:    "error on unterminated double quote",
+			content: "A=1\nB=\"open\nC=2",
+			wantErr: "on line 2",
+		},
+		{
+			name:    "error on unterminated single quote",
+			content: "A='open",
+			wantErr: "on line 1",
+		},
+		{
+			name:    "error on characters after closing quote",
+			content: "A=1\nB=\"x\" y",
+			wantErr: "on line 2",
+		},
+		{
+			name:    "error on unterminated reference",
+			content: "A=1\nB=${A:-${C}",
+			wantErr: "on line 2",
+		},
+		{
+			name:    "error on unsupported reference operator",
+			content: "A=${B:=x}",
+			wantErr: "on line 1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			envVars, err := parseDotEnvContent(".env", tc.content, lookup)
+
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected an error containing %q, got none", tc.wantErr)
+				}
+
+				if !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected an error containing %q, got %q", tc.wantErr, err.Error())
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make(map[string]string, len(envVars))
+			for _, envVar := range envVars {
+				got[envVar.Key] = envVar.Value
+			}
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %d variables, got %d: %v", len(tc.want), len(got), got)
+			}
+
+			for key, wantValue := range tc.want {
+				if gotValue, ok := got[key]; !ok || gotValue != wantValue {
+					t.Errorf("%s: expected %q, got %q (set: %t)", key, wantValue, gotValue, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestGetDotEnvLayerFiles(t *testing.T) {
+	entries := []string{".env", "b.env", "a.env", ".env.dev", ".env.dev.dni", ".env.prod", ".env.example"}
+
+	testCases := []struct {
+		name        string
+		environment string
+		stack       string
+		want        []string
+	}{
+		{name: "no environment", want: []string{".env", "a.env", "b.env"}},
+		{name: "environment", environment: "dev", want: []string{".env", "a.env", "b.env", ".env.dev"}},
+		{name: "environment and stack", environment: "dev", stack: "dni", want: []string{".env", "a.env", "b.env", ".env.dev", ".env.dev.dni"}},
+		{name: "missing stack layer", environment: "prod", stack: "dni", want: []string{".env", "a.env", "b.env", ".env.prod"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := getDotEnvLayerFiles(entries, tc.environment, tc.stack)
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseDotEnvContentWithReferences(t *testing.T) {
+	content := "DB_PASSWORD=s3cr3t\nDB_URL=postgres://u:${DB_PASSWORD}@h\nHOST=h\nDSN=\"$DB_URL?x=${UNSET:-${HOST}}\"\nPLAIN='${DB_PASSWORD}'"
+
+	_, references, err := parseDotEnvContentWithReferences(".env", content, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]string{
+		"DB_PASSWORD": "",
+		"DB_URL":      "DB_PASSWORD",
+		"HOST":        "",
+		"DSN":         "DB_URL,UNSET,HOST",
+		"PLAIN":       "",
+	}
+
+	for key, wantReferences := range want {
+		if got := strings.Join(references[key], ","); got != wantReferences {
+			t.Errorf("%s: expected references %q, got %q", key, wantReferences, got)
+		}
+	}
+}
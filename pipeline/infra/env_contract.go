@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEnvContractFile = ".env.example"
+	// Annotations of the env contract, in the comments right above each key.
+	envContractAnnotationPrefix   = "@"
+	envContractAnnotationRequired = "required"
+	envContractAnnotationOptional = "optional"
+	envContractAnnotationType     = "type"
+	envContractAnnotationEnum     = "enum"
+	// Types of the values of the env contract.
+	envContractTypeString    = "string"
+	envContractTypeBool      = "bool"
+	envContractTypeInt       = "int"
+	envContractTypeDuration  = "duration"
+	envContractTypeAWSRegion = "aws_region"
+	envContractTypeVersion   = "version"
+)
+
+var (
+	envContractKeyRegex     = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)\s*=`)
+	envContractAWSRegionRe  = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]*)?-[a-z]+-\d+$`)
+	envContractVersionRegex = regexp.MustCompile(`^v?\d+\.\d+\.\d+([-+][0-9A-Za-z.-]+)?$`)
+
+	// envContractTypeValidators checks a value is of a given type of the env contract.
+	envContractTypeValidators = map[string]func(value string) bool{
+		envContractTypeString: func(string) bool { return true },
+		envContractTypeBool: func(value string) bool {
+			_, err := strconv.ParseBool(value)
+			return err == nil
+		},
+		envContractTypeInt: func(value string) bool {
+			_, err := strconv.Atoi(value)
+			return err == nil
+		},
+		envContractTypeDuration: func(value string) bool {
+			_, err := time.ParseDuration(value)
+			return err == nil
+		},
+		envContractTypeAWSRegion: envContractAWSRegionRe.MatchString,
+		envContractTypeVersion:   envContractVersionRegex.MatchString,
+	}
+)
+
+// envContractRule represents the rule a variable of the env contract must follow.
+type envContractRule struct {
+	Key      string   // Key is the name of the variable.
+	Required bool     // Required is whether the variable must be set (and not be empty).
+	Type     string   // Type is the type of the value (string, bool, int, duration, aws_region or version).
+	Enum     []string // Enum are the allowed values. Empty means any value of the type is allowed.
+}
+
+// WithEnvContract makes the jobs validate their environment against an env contract, once every variable
+// (e.g., from the .env files) is set, before running Terragrunt. See WithEnvContractValidation for the format.
+//
+// Parameters:
+//   - contractFile: Optional. The env contract file, relative to the source directory. Defaults to .env.example.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the env contract set
+func (m *Infra) WithEnvContract(
+	// contractFile is the env contract file, relative to the source directory. Defaults to .env.example.
+	// +optional
+	contractFile string,
+) *Infra {
+	if contractFile == "" {
+		contractFile = defaultEnvContractFile
+	}
+
+	m.EnvContractFile = contractFile
+
+	return m
+}
+
+// WithEnvContractValidation checks the environment of the container against an env contract.
+//
+// The contract is a .env file (.env.example by default) where the comments right above each key declare
+// its rule, with annotations:
+//
+//	# @required
+//	# @type=aws_region
+//	# @enum=us-east-1,eu-west-1
+//	TG_STACK_REMOTE_STATE_REGION="us-east-1"
+//
+// Keys are optional, and of type string, unless annotated otherwise. Supported types are string, bool,
+// int, duration, aws_region and version. Secret variables are only checked to be set, since their values
+// can't be read without exposing them. Every missing or invalid variable is listed in a single error, and
+// values are never part of it.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - contractFile: Optional. The env contract file, relative to the source directory. Defaults to .env.example.
+//
+// Returns:
+//   - *Infra: The updated Infra instance, once its environment is validated
+//   - error: An error listing every missing or invalid variable, or if the contract can't be read
+func (m *Infra) WithEnvContractValidation(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// contractFile is the env contract file, relative to the source directory. Defaults to .env.example.
+	// +optional
+	contractFile string,
+) (*Infra, error) {
+	if contractFile == "" {
+		contractFile = defaultEnvContractFile
+	}
+
+	if m.Src == nil {
+		return nil, Errorf("failed to read the env contract %s, the source directory is nil", contractFile)
+	}
+
+	contractContent, err := m.Src.File(contractFile).Contents(ctx)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to read the env contract %s from the source directory", contractFile)
+	}
+
+	rules, err := parseEnvContract(contractFile, contractContent)
+	if err != nil {
+		return nil, err
+	}
+
+	plainEnv, err := getContainerPlainEnv(ctx, m.Ctr)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to get the environment of the container")
+	}
+
+	// Keys that aren't plain variables might still be set as secret variables.
+	var unresolvedKeys []string
+	for _, rule := range rules {
+		if _, isPlain := plainEnv[rule.Key]; !isPlain && rule.Required {
+			unresolvedKeys = append(unresolvedKeys, rule.Key)
+		}
+	}
+
+	setSecretKeys, err := getContainerSetKeys(ctx, m.Ctr, unresolvedKeys)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to check the secret variables of the container")
+	}
+
+	if problems := validateEnvContract(rules, plainEnv, setSecretKeys); len(problems) > 0 {
+		return nil, Errorf("the environment doesn't satisfy the env contract %s, %d problems found:\n  - %s",
+			contractFile, len(problems), strings.Join(problems, "\n  - "))
+	}
+
+	m.Ctr = m.Ctr.
+		WithExec([]string{"echo", fmt.Sprintf("Env contract %s satisfied: %d variables checked", contractFile, len(rules))})
+
+	return m, nil
+}
+
+// parseEnvContract parses the rules of an env contract, from the annotations in the comments right above each key.
+func parseEnvContract(file, content string) ([]envContractRule, error) {
+	var (
+		rules   []envContractRule
+		pending = envContractRule{Type: envContractTypeString}
+		seen    = map[string]int{}
+	)
+
+	for lineNum, line := range strings.Split(content, "\n") {
+		trimmedLine := strings.TrimSpace(line)
+
+		if trimmedLine == "" {
+			// Annotations only apply to the key right below them.
+			pending = envContractRule{Type: envContractTypeString}
+
+			continue
+		}
+
+		if strings.HasPrefix(trimmedLine, "#") {
+			annotation := strings.TrimSpace(strings.TrimPrefix(trimmedLine, "#"))
+			if !strings.HasPrefix(annotation, envContractAnnotationPrefix) {
+				continue
+			}
+
+			if err := applyEnvContractAnnotation(&pending, strings.TrimPrefix(annotation, envContractAnnotationPrefix)); err != nil {
+				return nil, WrapErrorf(err, "invalid env contract %s on line %d", file, lineNum+1)
+			}
+
+			continue
+		}
+
+		matches := envContractKeyRegex.FindStringSubmatch(trimmedLine)
+		if matches == nil {
+			// Continuation lines of multi-line values aren't keys, hence they're skipped.
+			continue
+		}
+
+		pending.Key = matches[1]
+
+		// A key declared more than once (e.g., overridden further down) keeps a single rule, the last one.
+		if idx, duplicated := seen[pending.Key]; duplicated {
+			rules[idx] = pending
+		} else {
+			seen[pending.Key] = len(rules)
+			rules = append(rules, pending)
+		}
+
+		pending = envContractRule{Type: envContractTypeString}
+	}
+
+	return rules, nil
+}
+
+// applyEnvContractAnnotation applies an annotation (without its '@' prefix) to the rule of the next key.
+func applyEnvContractAnnotation(rule *envContractRule, annotation string) error {
+	name, value, _ := strings.Cut(annotation, "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+
+	switch name {
+	case envContractAnnotationRequired:
+		rule.Required = true
+	case envContractAnnotationOptional:
+		rule.Required = false
+	case envContractAnnotationType:
+		if _, supported := envContractTypeValidators[value]; !supported {
+			return fmt.Errorf("unsupported type %q, it must be one of: %s", value, strings.Join(getEnvContractTypes(), ", "))
+		}
+
+		rule.Type = value
+	case envContractAnnotationEnum:
+		var enum []string
+		for _, allowed := range strings.Split(value, ",") {
+			if allowed = strings.TrimSpace(allowed); allowed != "" {
+				enum = append(enum, allowed)
+			}
+		}
+
+		if len(enum) == 0 {
+			return errors.New("@enum must list at least one allowed value, e.g., @enum=a,b")
+		}
+
+		rule.Enum = enum
+	default:
+		return fmt.Errorf("unknown annotation @%s, it must be one of: @required, @optional, @type=<type>, @enum=<values>", name)
+	}
+
+	return nil
+}
+
+// validateEnvContract checks the plain variables, and the keys set as secret variables, against the rules
+// of the env contract. It returns every problem found; values are never part of them.
+func validateEnvContract(rules []envContractRule, plainEnv map[string]string, setSecretKeys map[string]bool) []string {
+	var problems []string
+
+	for _, rule := range rules {
+		value, isPlain := plainEnv[rule.Key]
+
+		if !isPlain {
+			if rule.Required && !setSecretKeys[rule.Key] {
+				problems = append(problems, fmt.Sprintf("%s is required, but it isn't set", rule.Key))
+			}
+
+			continue
+		}
+
+		if value == "" {
+			if rule.Required {
+				problems = append(problems, fmt.Sprintf("%s is required, but it's empty", rule.Key))
+			}
+
+			continue
+		}
+
+		if !envContractTypeValidators[rule.Type](value) {
+			problems = append(problems, fmt.Sprintf("%s must be of type %s", rule.Key, rule.Type))
+
+			continue
+		}
+
+		if len(rule.Enum) > 0 && !slices.Contains(rule.Enum, value) {
+			problems = append(problems, fmt.Sprintf("%s must be one of: %s", rule.Key, strings.Join(rule.Enum, ", ")))
+		}
+	}
+
+	return problems
+}
+
+// getContainerPlainEnv returns the plain (non-secret) environment variables of the container.
+func getContainerPlainEnv(ctx context.Context, ctr *dagger.Container) (map[string]string, error) {
+	envVariables, err := ctr.EnvVariables(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	plainEnv := make(map[string]string, len(envVariables))
+
+	for _, envVariable := range envVariables {
+		name, err := envVariable.Name(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := envVariable.Value(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		plainEnv[name] = value
+	}
+
+	return plainEnv, nil
+}
+
+// getContainerSetKeys checks, inside the container, which of the keys are set to a non-empty value. It's
+// meant for secret variables: only the names of the keys that are set are printed, never their values.
+func getContainerSetKeys(ctx context.Context, ctr *dagger.Container, keys []string) (map[string]bool, error) {
+	setKeys := make(map[string]bool, len(keys))
+	if len(keys) == 0 {
+		return setKeys, nil
+	}
+
+	checkScript := `for key in "$@"; do if [ -n "$(printenv "$key")" ]; then echo "$key"; fi; done`
+
+	out, err := ctr.
+		WithEnvVariable("ENV_CONTRACT_CACHE_BUSTER", time.Now().Format(time.RFC3339Nano)).
+		WithExec(append([]string{"sh", "-c", checkScript, "--"}, keys...)).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range strings.Fields(out) {
+		setKeys[key] = true
+	}
+
+	return setKeys, nil
+}
+
+// getEnvContractTypes returns the supported types of the env contract, sorted.
+func getEnvContractTypes() []string {
+	types := make([]string, 0, len(envContractTypeValidators))
+	for envContractType := range envContractTypeValidators {
+		types = append(types, envContractType)
+	}
+
+	slices.Sort(types)
+
+	return types
+}
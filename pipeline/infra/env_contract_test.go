@@ -0,0 +1,159 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvContract(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		want    []envContractRule
+		wantErr string
+	}{
+		{
+			name:    "keys default to optional strings",
+			content: "A=1\nexport B=\"two\"",
+			want:    []envContractRule{{Key: "A", Type: "string"}, {Key: "B", Type: "string"}},
+		},
+		{
+			name:    "annotations",
+			content: "# Some comment\n# @required\n# @type=aws_region\n# @enum=us-east-1, eu-west-1\nREGION=us-east-1",
+			want:    []envContractRule{{Key: "REGION", Required: true, Type: "aws_region", Enum: []string{"us-east-1", "eu-west-1"}}},
+		},
+		{
+			name:    "annotations reset on blank lines",
+			content: "# @required\n# @type=int\n\nA=1\n# @type=bool\nB=true\nC=x",
+			want:    []envContractRule{{Key: "A", Type: "string"}, {Key: "B", Type: "bool"}, {Key: "C", Type: "string"}},
+		},
+		{
+			name:    "optional overrides required",
+			content: "# @required\n# @optional\nA=",
+			want:    []envContractRule{{Key: "A", Type: "string"}},
+		},
+		{
+			name:    "duplicate keys keep the last rule",
+			content: "# @required\nA=1\nB=2\n# @type=int\nA=3",
+			want:    []envContractRule{{Key: "A", Type: "int"}, {Key: "B", Type: "string"}},
+		},
+		{
+			name:    "multi-line values are skipped",
+			content: "A=\"first\nnot a key\"\nB=1",
+			want:    []envContractRule{{Key: "A", Type: "string"}, {Key: "B", Type: "string"}},
+		},
+		{
+			name:    "unsupported type",
+			content: "# @type=float\nA=1.5",
+			wantErr: "unsupported type",
+		},
+		{
+			name:    "empty enum",
+			content: "# @enum= ,\nA=1",
+			wantErr: "at least one allowed value",
+		},
+		{
+			name:    "unknown annotation",
+			content: "# @secret\nA=1",
+			wantErr: "unknown annotation",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := parseEnvContract(".env.example", tc.content)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(rules) != len(tc.want) {
+				t.Fatalf("expected %d rules, got %d: %+v", len(tc.want), len(rules), rules)
+			}
+
+			for idx, want := range tc.want {
+				got := rules[idx]
+				if got.Key != want.Key || got.Required != want.Required || got.Type != want.Type || !slices.Equal(got.Enum, want.Enum) {
+					t.Errorf("expected %+v, got %+v", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateEnvContract(t *testing.T) {
+	rules := []envContractRule{
+		{Key: "REGION", Required: true, Type: envContractTypeAWSRegion},
+		{Key: "NON_INTERACTIVE", Type: envContractTypeBool},
+		{Key: "RETRIES", Type: envContractTypeInt},
+		{Key: "CACHE_MAX_AGE", Type: envContractTypeDuration},
+		{Key: "TF_VERSION", Type: envContractTypeVersion},
+		{Key: "LOG_LEVEL", Type: envContractTypeString, Enum: []string{"debug", "info"}},
+		{Key: "API_TOKEN", Required: true, Type: envContractTypeString},
+		{Key: "OPTIONAL", Type: envContractTypeInt},
+	}
+
+	testCases := []struct {
+		name          string
+		plainEnv      map[string]string
+		setSecretKeys map[string]bool
+		wantProblems  []string
+	}{
+		{
+			name: "valid",
+			plainEnv: map[string]string{
+				"REGION": "eu-west-1", "NON_INTERACTIVE": "true", "RETRIES": "3", "CACHE_MAX_AGE": "168h",
+				"TF_VERSION": "1.11.3", "LOG_LEVEL": "info", "OPTIONAL": "",
+			},
+			setSecretKeys: map[string]bool{"API_TOKEN": true},
+		},
+		{
+			name:         "missing and empty required keys",
+			plainEnv:     map[string]string{"REGION": ""},
+			wantProblems: []string{"REGION is required, but it's empty", "API_TOKEN is required, but it isn't set"},
+		},
+		{
+			name: "type and enum failures",
+			plainEnv: map[string]string{
+				"REGION": "europe", "NON_INTERACTIVE": "maybe", "RETRIES": "three", "CACHE_MAX_AGE": "7 days",
+				"TF_VERSION": "latest", "LOG_LEVEL": "trace",
+			},
+			setSecretKeys: map[string]bool{"API_TOKEN": true},
+			wantProblems: []string{
+				"REGION must be of type aws_region",
+				"NON_INTERACTIVE must be of type bool",
+				"RETRIES must be of type int",
+				"CACHE_MAX_AGE must be of type duration",
+				"TF_VERSION must be of type version",
+				"LOG_LEVEL must be one of: debug, info",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			problems := validateEnvContract(rules, tc.plainEnv, tc.setSecretKeys)
+
+			if !slices.Equal(problems, tc.wantProblems) {
+				t.Fatalf("expected the problems %q, got %q", tc.wantProblems, problems)
+			}
+
+			for _, problem := range problems {
+				for key, value := range tc.plainEnv {
+					if value != "" && strings.Contains(problem, value) && !strings.Contains(key, value) {
+						t.Fatalf("the problem %q has the value of %s", problem, key)
+					}
+				}
+			}
+		})
+	}
+}
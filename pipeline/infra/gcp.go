@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const (
+	configGCPCredentialsFileName     = "gcp-credentials.json"
+	configGCPOIDCTokenFileName       = "gcp-oidc-token"
+	gcpWorkloadIdentitySTSTokenURL   = "https://sts.googleapis.com/v1/token"
+	gcpWorkloadIdentityTokenType     = "urn:ietf:params:oauth:token-type:jwt"
+	gcpServiceAccountImpersonateURL  = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken"
+	gcpCredentialsTypeServiceAccount = "service_account"
+	gcpCredentialsTypeExternal       = "external_account"
+)
+
+var (
+	// gcpWorkloadIdentityProviderRegex matches the full resource name of a workload identity pool provider.
+	gcpWorkloadIdentityProviderRegex = regexp.MustCompile(`^//iam\.googleapis\.com/projects/\d+/locations/global/workloadIdentityPools/[a-z0-9-]+/providers/[a-z0-9-]+$`)
+	gcpServiceAccountEmailRegex      = regexp.MustCompile(`^[a-z0-9-]+@[a-z0-9.-]+\.gserviceaccount\.com$`)
+	gcpProjectIDRegex                = regexp.MustCompile(`^[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+)
+
+// gcpServiceAccountKey are the fields of a service account key the google provider needs.
+type gcpServiceAccountKey struct {
+	Type        string `json:"type"`
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// WithGCPServiceAccount sets the Google Cloud credentials of a service account, with a JSON key.
+//
+// The key is validated, and mounted as a secret file the google provider (and gcloud) reads, through
+// GOOGLE_APPLICATION_CREDENTIALS.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - serviceAccountKey: The JSON key of the service account.
+//   - project: Optional. The Google Cloud project to deploy to. Defaults to the project of the key.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the Google Cloud credentials set
+//   - error: An error if the key isn't a service account JSON key, or the project is malformed
+func (m *Infra) WithGCPServiceAccount(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// serviceAccountKey is the JSON key of the service account.
+	serviceAccountKey *dagger.Secret,
+	// project is the Google Cloud project to deploy to. Defaults to the project of the key.
+	// +optional
+	project string,
+) (*Infra, error) {
+	if serviceAccountKey == nil {
+		return nil, NewError("the JSON key of the Google Cloud service account is required")
+	}
+
+	keyValue, err := serviceAccountKey.Plaintext(ctx)
+	if err != nil {
+		return nil, WrapError(err, "failed to read the Google Cloud service account key")
+	}
+
+	key, err := parseGCPServiceAccountKey(keyValue)
+	if err != nil {
+		return nil, WrapError(err, "invalid Google Cloud service account key")
+	}
+
+	if project == "" {
+		project = key.ProjectID
+	}
+
+	credentialsPath := filepath.Join(configOIDCTokenMountRootPath, configGCPCredentialsFileName)
+
+	m.Ctr = m.Ctr.
+		WithMountedSecret(credentialsPath, serviceAccountKey, dagger.ContainerWithMountedSecretOpts{
+			Mode: 0o400,
+		}).
+		WithEnvVariable("GOOGLE_APPLICATION_CREDENTIALS", credentialsPath)
+
+	return m.withGCPProject(project)
+}
+
+// WithGCPWorkloadIdentity sets the Google Cloud credentials of a workload identity federation, with an OIDC token.
+//
+// The token (e.g., GitLab's id_tokens, or GitHub Actions' ID token) is validated, and mounted as a secret
+// file. An external account credential configuration that exchanges it (and —if set— impersonates the
+// service account) is written next to it, and the google provider (and gcloud) reads it through
+// GOOGLE_APPLICATION_CREDENTIALS. No long-lived service account key is needed.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - workloadIdentityProvider: The workload identity pool provider (//iam.googleapis.com/projects/NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER).
+//   - oidcToken: The OIDC JWT token.
+//   - serviceAccountEmail: Optional. The service account to impersonate.
+//   - project: Optional. The Google Cloud project to deploy to.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the Google Cloud credentials set
+//   - error: An error if the provider, or the service account, is malformed, or the token is invalid, or expired
+func (m *Infra) WithGCPWorkloadIdentity(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// workloadIdentityProvider is the workload identity pool provider (//iam.googleapis.com/projects/NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER).
+	workloadIdentityProvider string,
+	// oidcToken is the OIDC JWT token.
+	oidcToken *dagger.Secret,
+	// serviceAccountEmail is the service account to impersonate.
+	// +optional
+	serviceAccountEmail string,
+	// project is the Google Cloud project to deploy to.
+	// +optional
+	project string,
+) (*Infra, error) {
+	if oidcToken == nil {
+		return nil, NewError("the OIDC token is required for Google Cloud workload identity federation")
+	}
+
+	oidcTokenPath := filepath.Join(configOIDCTokenMountRootPath, configGCPOIDCTokenFileName)
+
+	credentialsConfig, err := getGCPWorkloadIdentityCredentialsConfig(workloadIdentityProvider, serviceAccountEmail, oidcTokenPath)
+	if err != nil {
+		return nil, WrapError(err, "failed to set the Google Cloud workload identity credentials")
+	}
+
+	oidcTokenValue, err := oidcToken.Plaintext(ctx)
+	if err != nil {
+		return nil, WrapError(err, "failed to read the OIDC token")
+	}
+
+	if _, err := validateOIDCToken(oidcTokenValue, time.Now()); err != nil {
+		return nil, WrapErrorf(err, "invalid OIDC token for the workload identity provider %s", workloadIdentityProvider)
+	}
+
+	// The configuration only references the token file, so it isn't a secret.
+	credentialsPath := filepath.Join(configOIDCTokenMountRootPath, configGCPCredentialsFileName)
+
+	m.Ctr = m.Ctr.
+		WithMountedSecret(oidcTokenPath, oidcToken, dagger.ContainerWithMountedSecretOpts{
+			Mode: 0o400,
+		}).
+		WithNewFile(credentialsPath, credentialsConfig).
+		WithEnvVariable("GOOGLE_APPLICATION_CREDENTIALS", credentialsPath)
+
+	return m.withGCPProject(project)
+}
+
+// withGCPProject sets the Google Cloud project the google provider (and gcloud) deploys to, when it's set.
+func (m *Infra) withGCPProject(project string) (*Infra, error) {
+	if project == "" {
+		return m, nil
+	}
+
+	if !gcpProjectIDRegex.MatchString(project) {
+		return nil, Errorf("the Google Cloud project ID %q must have 6 to 30 lowercase letters, digits or hyphens, and start with a letter", project)
+	}
+
+	m.Ctr = m.Ctr.
+		WithEnvVariable("GOOGLE_PROJECT", project).
+		WithEnvVariable("CLOUDSDK_CORE_PROJECT", project)
+
+	return m, nil
+}
+
+// parseGCPServiceAccountKey parses, and checks, a service account JSON key. Errors never include the
+// content of the key, since it's a secret.
+func parseGCPServiceAccountKey(content string) (*gcpServiceAccountKey, error) {
+	var key gcpServiceAccountKey
+	if err := json.Unmarshal([]byte(content), &key); err != nil {
+		return nil, fmt.Errorf("the service account key must be a JSON key file")
+	}
+
+	if key.Type != gcpCredentialsTypeServiceAccount {
+		return nil, fmt.Errorf("the service account key must be of type %q, got %q", gcpCredentialsTypeServiceAccount, key.Type)
+	}
+
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("the service account key must have the client_email, and private_key, fields")
+	}
+
+	return &key, nil
+}
+
+// getGCPWorkloadIdentityCredentialsConfig returns the external account credential configuration that
+// exchanges the OIDC token file for Google Cloud credentials.
+func getGCPWorkloadIdentityCredentialsConfig(workloadIdentityProvider, serviceAccountEmail, oidcTokenPath string) (string, error) {
+	if !gcpWorkloadIdentityProviderRegex.MatchString(workloadIdentityProvider) {
+		return "", fmt.Errorf("the workload identity provider %q must be in the format "+
+			"//iam.googleapis.com/projects/NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER", workloadIdentityProvider)
+	}
+
+	credentialsConfig := map[string]any{
+		"type":               gcpCredentialsTypeExternal,
+		"audience":           workloadIdentityProvider,
+		"subject_token_type": gcpWorkloadIdentityTokenType,
+		"token_url":          gcpWorkloadIdentitySTSTokenURL,
+		"credential_source": map[string]string{
+			"file": oidcTokenPath,
+		},
+	}
+
+	if serviceAccountEmail != "" {
+		if !gcpServiceAccountEmailRegex.MatchString(serviceAccountEmail) {
+			return "", fmt.Errorf("the service account %q must be a service account email (e.g., NAME@PROJECT.iam.gserviceaccount.com)", serviceAccountEmail)
+		}
+
+		credentialsConfig["service_account_impersonation_url"] = fmt.Sprintf(gcpServiceAccountImpersonateURL, serviceAccountEmail)
+	}
+
+	credentialsConfigJSON, err := json.MarshalIndent(credentialsConfig, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the credential configuration: %w", err)
+	}
+
+	return string(credentialsConfigJSON), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"dagger/infra/internal/dagger"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultGitCredentialUsername = "oauth2"
+	gitCredentialEnvVarPrefix    = "GIT_CREDENTIAL_TOKEN_"
+)
+
+var (
+	gitCredentialEnvVarInvalidCharsRegex = regexp.MustCompile(`[^A-Z0-9]+`)
+	// gitCredentialUsernameRegex limits usernames to characters safe in the shell of the credential helper.
+	gitCredentialUsernameRegex = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+)
+
+// gitURLRewrite is an insteadOf rule of the git config: URLs starting with From are fetched from To.
+type gitURLRewrite struct {
+	From string
+	To   string
+}
+
+// gitCredentialHost is a host Git authenticates on over HTTPS, with a login.
+type gitCredentialHost struct {
+	Host     string
+	Username string
+}
+
+// WithGitURLRewrite rewrites the Git URLs Terraform fetches module sources from.
+//
+// It writes a url.<to>.insteadOf <from> rule into the global git config of the container, so module
+// sources starting with 'from' (e.g., git@github.com:) are fetched from 'to' instead (e.g.,
+// https://github.com/, or an internal mirror). When a token is passed, Git authenticates on the 'to'
+// host with it, through a credential helper that reads it from a secret variable, so the token is
+// never written into the git config, nor the URLs.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - from: The URL prefix to rewrite (e.g., git@github.com:).
+//   - to: The URL prefix to fetch from instead (e.g., https://github.com/).
+//   - token: Optional. The token to authenticate on the 'to' host with. It requires an HTTPS 'to' URL.
+//   - username: Optional. The username to authenticate with the token. Defaults to oauth2.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the Git URL rewrite rule set
+//   - error: An error if the rule is malformed
+func (m *Infra) WithGitURLRewrite(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// from is the URL prefix to rewrite (e.g., git@github.com:).
+	from string,
+	// to is the URL prefix to fetch from instead (e.g., https://github.com/).
+	to string,
+	// token is the token to authenticate on the 'to' host with. It requires an HTTPS 'to' URL.
+	// +optional
+	token *dagger.Secret,
+	// username is the username to authenticate with the token. Defaults to oauth2.
+	// +optional
+	username string,
+) (*Infra, error) {
+	rewrite, err := getGitURLRewrite(from, to)
+	if err != nil {
+		return nil, WrapError(err, "invalid Git URL rewrite rule")
+	}
+
+	// --add keeps the other rules of the same 'to' URL, e.g., when both the SSH and the git:// URLs are rewritten.
+	m.Ctr = m.Ctr.
+		WithExec([]string{"git", "config", "--global", "--add", fmt.Sprintf("url.%s.insteadOf", rewrite.To), rewrite.From})
+
+	if token == nil {
+		return m, nil
+	}
+
+	toURL, err := url.Parse(rewrite.To)
+	if err != nil || toURL.Scheme != "https" || toURL.Host == "" {
+		return nil, Errorf("the Git URL rewrite rule to %s has a token, so it must rewrite to an https:// URL", rewrite.To)
+	}
+
+	return m.WithGitCredential(ctx, toURL.Host, token, username)
+}
+
+// WithGitCredential authenticates Git on an HTTPS host with a token.
+//
+// The token is set as a secret variable, and a credential helper scoped to the host reads it from there,
+// so it's never written into the git config, nor the URLs.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - host: The host to authenticate on (e.g., gitlab.mycorp.internal).
+//   - token: The token to authenticate with.
+//   - username: Optional. The username to authenticate with the token. Defaults to oauth2.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the Git credential set
+//   - error: An error if the host, or the username, is malformed
+func (m *Infra) WithGitCredential(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// host is the host to authenticate on (e.g., gitlab.mycorp.internal).
+	host string,
+	// token is the token to authenticate with.
+	token *dagger.Secret,
+	// username is the username to authenticate with the token. Defaults to oauth2.
+	// +optional
+	username string,
+) (*Infra, error) {
+	if token == nil {
+		return nil, Errorf("the token of the Git credential for host %s is required", host)
+	}
+
+	credentialHost, err := getGitCredentialHost(host, username)
+	if err != nil {
+		return nil, WrapError(err, "invalid Git credential")
+	}
+
+	tokenEnvVar := getGitCredentialEnvVar(credentialHost.Host)
+
+	// The helper only answers 'get', and reads the token from the variable when Git runs it, so the
+	// git config only has the name of the variable.
+	credentialHelper := fmt.Sprintf(`!f() { test "$1" = get || exit 0; echo "username=%s"; echo "password=${%s}"; }; f`,
+		credentialHost.Username, tokenEnvVar)
+
+	m.Ctr = m.Ctr.
+		WithSecretVariable(tokenEnvVar, token).
+		WithExec([]string{"git", "config", "--global", fmt.Sprintf("credential.https://%s.helper", credentialHost.Host), credentialHelper})
+
+	return m, nil
+}
+
+// getGitURLRewrite validates the prefixes of a Git URL rewrite rule.
+func getGitURLRewrite(from, to string) (gitURLRewrite, error) {
+	rewrite := gitURLRewrite{From: strings.TrimSpace(from), To: strings.TrimSpace(to)}
+
+	if rewrite.From == "" || rewrite.To == "" {
+		return gitURLRewrite{}, fmt.Errorf("both the URL prefix to rewrite, and the one to fetch from instead, are required")
+	}
+
+	// Prefixes aren't part of the errors until they're checked, since a malformed one could have a token.
+	for _, prefix := range []struct{ name, value string }{{"from", rewrite.From}, {"to", rewrite.To}} {
+		if strings.ContainsAny(prefix.value, " \t\r\n") {
+			return gitURLRewrite{}, fmt.Errorf("the %s URL prefix must have no whitespace", prefix.name)
+		}
+
+		// Credentials in the URLs would end up in the git config, and in the logs. SSH URLs keep their
+		// user (e.g., ssh://git@github.com/), since it's not a credential.
+		if parsedURL, err := url.Parse(prefix.value); err == nil && parsedURL.User != nil {
+			_, hasPassword := parsedURL.User.Password()
+			if hasPassword || parsedURL.Scheme == "https" || parsedURL.Scheme == "http" {
+				return gitURLRewrite{}, fmt.Errorf("the %s URL prefix must have no credentials, pass a token instead", prefix.name)
+			}
+		}
+	}
+
+	if rewrite.From == rewrite.To {
+		return gitURLRewrite{}, fmt.Errorf("the URL prefix %s is rewritten to itself", rewrite.From)
+	}
+
+	return rewrite, nil
+}
+
+// getGitCredentialHost validates the host, and the username, of a Git credential.
+func getGitCredentialHost(host, username string) (gitCredentialHost, error) {
+	credentialHost := gitCredentialHost{Host: strings.ToLower(strings.TrimSpace(host)), Username: strings.TrimSpace(username)}
+
+	if credentialHost.Username == "" {
+		credentialHost.Username = defaultGitCredentialUsername
+	}
+
+	// The host can have a port (e.g., git.mycorp.internal:8443), but no scheme, nor path.
+	hostname, port, hasPort := strings.Cut(credentialHost.Host, ":")
+	if !sshHostRegex.MatchString(hostname) || (hasPort && !isNumeric(port)) {
+		return gitCredentialHost{}, fmt.Errorf("Git credential host %q must be a hostname, as HOST or HOST:PORT", host)
+	}
+
+	// The username is written into the credential helper, so it's limited to characters safe in a shell.
+	if !gitCredentialUsernameRegex.MatchString(credentialHost.Username) {
+		return gitCredentialHost{}, fmt.Errorf("Git credential username %q must only have letters, digits, '.', '_', '@' or '-'", username)
+	}
+
+	return credentialHost, nil
+}
+
+// getGitCredentialEnvVar returns the secret variable the token of a Git credential host is read from.
+// Hosts that only differ in the characters that aren't valid in a variable name (e.g., git.a-b.com and
+// git.a.b.com) would share it, so the name ends with a short hash of the host.
+func getGitCredentialEnvVar(host string) string {
+	hostHash := sha256.Sum256([]byte(strings.ToLower(host)))
+	sanitizedHost := strings.Trim(gitCredentialEnvVarInvalidCharsRegex.ReplaceAllString(strings.ToUpper(host), "_"), "_")
+
+	return fmt.Sprintf("%s%s_%X", gitCredentialEnvVarPrefix, sanitizedHost, hostHash[:4])
+}
+
+// isNumeric checks whether the value is a non-empty string of digits.
+func isNumeric(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	for _, char := range value {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -43,7 +43,7 @@ func (m *Infra) JobTg(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
@@ -61,9 +61,15 @@ func (m *Infra) JobTg(
 	// tgLogLevel is the Terragrunt log level to use.
 	// +optional
 	tgLogLevel string,
+	// environment is the environment the job runs on. It's used to resolve per-environment settings (e.g., the AWS role mappings set with WithAWSRoleMappings).
+	// +optional
+	environment string,
+	// stack is the stack the job runs on. It's used to resolve per-stack settings (e.g., the AWS role mappings set with WithAWSRoleMappings).
+	// +optional
+	stack string,
 ) (*dagger.Container, error) {
 	if len(envVars) > 0 {
-		mWithEnvVars, err := m.WithEnvVars(envVars)
+		mWithEnvVars, err := m.WithEnvVars(ctx, envVars)
 		if err != nil {
 			return nil, WrapErrorf(err, "failed to set environment variables")
 		}
@@ -74,10 +80,6 @@ func (m *Infra) JobTg(
 	// No interactivity is mandatory, since it's a CI/CD pipeline.
 	m = m.WithTerragruntNonInteractive()
 
-	if deploymentRegion != "" {
-		m = m.WithTrragruntDeploymentRegion(deploymentRegion)
-	}
-
 	if tgBinaryVersionOverride != "" {
 		m = m.WithTerragrunt(tgBinaryVersionOverride)
 	}
@@ -110,11 +112,18 @@ func (m *Infra) JobTg(
 	}
 
 	if gitSSH != nil {
-		m = m.WithSSHAuthSocket(gitSSH, "", "", false, true)
+		mDecorated, err := m.WithSSHAuthSocket(gitSSH, "", "", false, true, nil, "")
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to configure the SSH known hosts")
+		}
+
+		m = mDecorated
 	}
 
+	// The .env files are loaded on top of the variables set by the chained With* functions (e.g.,
+	// WithAWSConfig), so a key set in both takes the value of the .env files.
 	if loadDotEnvFile {
-		mDecorated, err := m.WithDotEnvFile(ctx, m.Src)
+		mDecorated, err := m.WithDotEnvFile(ctx, m.Src, m.SOPSAgeKey, environment, stack)
 		if err != nil {
 			return nil, WrapErrorf(err, "failed to source .env files from the local directory")
 		}
@@ -122,6 +131,20 @@ func (m *Infra) JobTg(
 		m = mDecorated
 	}
 
+	// The deployment region is set after the .env files, so an explicit region (e.g., each region of a
+	// multi-region deployment) wins over the TG_STACK_DEPLOYMENT_REGION of the .env files.
+	if deploymentRegion != "" {
+		m = m.WithTrragruntDeploymentRegion(deploymentRegion)
+	}
+
+	// The same goes for the preview ID: a TG_STACK_PREVIEW_ID of the .env files (even an empty one) would
+	// otherwise point the preview, and its teardown, to the regular environment's state.
+	if m.PreviewID != "" {
+		m.Ctr = m.Ctr.
+			WithoutSecretVariable("TG_STACK_PREVIEW_ID").
+			WithEnvVariable("TG_STACK_PREVIEW_ID", m.PreviewID)
+	}
+
 	if awsAccessKeyID != nil && awsSecretAccessKey != nil {
 		m = m.WithAWSKeys(ctx, awsAccessKeyID, awsSecretAccessKey, deploymentRegion, awsSessionToken)
 	}
@@ -134,10 +157,61 @@ func (m *Infra) JobTg(
 		m = m.WithGitHubToken(ctx, GitHubToken)
 	}
 
+	// The role is assumed once every other credential is set, since it's assumed with them.
+	if len(m.AWSRoleMappings) > 0 {
+		roleMappings, err := getAWSRoleMappings(m.AWSRoleMappings)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to parse the AWS role mappings")
+		}
+
+		roleARN, err := resolveAWSRoleARN(roleMappings, environment, stack)
+		if err != nil {
+			return nil, WrapError(err, "failed to resolve the AWS role to assume")
+		}
+
+		mDecorated, err := m.WithAWSAssumeRole(ctx, roleARN, "")
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to assume the AWS role mapped to environment %s, stack %s", environment, stack)
+		}
+
+		m = mDecorated
+	}
+
+	// The env contract is checked once every variable is set, so it sees the environment Terragrunt will use.
+	if m.EnvContractFile != "" {
+		mDecorated, err := m.WithEnvContractValidation(ctx, m.EnvContractFile)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to validate the environment before running Terragrunt")
+		}
+
+		m = mDecorated
+	}
+
+	// The preflight runs last, so it checks the credentials Terragrunt will actually use. Only the CD jobs
+	// run it, and jobs without any AWS credentials source (e.g., GCP-only stacks) skip it, unless an expected
+	// account ID is passed.
+	if m.awsPreflight && !m.SkipAWSPreflight {
+		mDecorated, err := m.WithAWSCredentialsPreflight(ctx, m.AWSExpectedAccountID)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to validate the AWS credentials before running Terragrunt")
+		}
+
+		m = mDecorated
+	}
+
 	return m.Ctr, nil
 }
 
-// JobTg performs a command on Terragrunt by:
+// JobTgExec runs a Terragrunt command on a single unit of a stack, and returns its output.
+//
+// The command is run with the syntax of the installed Terragrunt version: on v0.78.0 and later (the
+// redesigned CLI), the legacy commands are rewritten to their new form, e.g., run-all becomes run --all,
+// hclfmt becomes hcl fmt, terragrunt-info becomes info print, and render-json becomes render --json --write.
+// Other commands (e.g., plan, apply, output) are passed as they are.
+//
+// Returns:
+//   - string: The output of the Terragrunt command.
+//   - error: An error if the container can't be built, or the command fails.
 func (m *Infra) JobTgExec(
 	// Context is the context for managing the operation's lifecycle
 	// +optional
@@ -175,7 +249,7 @@ func (m *Infra) JobTgExec(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
@@ -193,7 +267,7 @@ func (m *Infra) JobTgExec(
 	// tgLogLevel is the Terragrunt log level to use.
 	// +optional
 	tgLogLevel string,
-	// cmd is the command to execute on the container.
+	// cmd is the Terragrunt command to run (e.g., plan). Legacy commands are rewritten on the redesigned CLI.
 	cmd []string,
 	// environment is the environment to use for the container.
 	// +optional
@@ -203,6 +277,10 @@ func (m *Infra) JobTgExec(
 	// unit is the unit to use for the container.
 	unit string,
 ) (string, error) {
+	if environment == "" {
+		environment = defaultRefArchEnv
+	}
+
 	// Getting the base container
 	jobTgCtrBase, jobTgErr := m.JobTg(ctx,
 		remoteStateBucket,
@@ -222,22 +300,23 @@ func (m *Infra) JobTgExec(
 		tfVersionFile,
 		gitSSH,
 		tgLogLevel,
+		environment,
+		layer,
 	)
 
 	if jobTgErr != nil {
 		return "", WrapErrorf(jobTgErr, "failed to create base jobTg container for environment %s, stack %s, unit %s", environment, layer, unit)
 	}
 
-	if environment == "" {
-		environment = defaultRefArchEnv
-	}
-
 	// Getting the Terragrunt working directory
 	tgWorkDir := getTerragruntExecutionPath(environment, layer, unit)
 
-	tgCmd := []string{"terragrunt"}
-	tgCmd = append(tgCmd, cmd...)
-	tgCmd = append(tgCmd, "--working-dir", tgWorkDir)
+	cmdBuilder, err := newTgCmdBuilder(ctx, jobTgCtrBase)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to build the Terragrunt command for environment %s, stack %s, unit %s", environment, layer, unit)
+	}
+
+	tgCmd := withWorkingDir(cmdBuilder.run(cmd...), tgWorkDir)
 
 	stdout, err := jobTgCtrBase.
 		WithExec(tgCmd).
@@ -306,7 +385,7 @@ func (m *Infra) JobTgStack(
 	// NoCache is a flag to disable caching of the container.
 	// +optional
 	noCache bool,
-	// envVars are the environment variables to set in the container.
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
 	// +optional
 	envVars []string,
 	// tgBinaryVersionOverride is the Terragrunt binary version to use.
@@ -352,18 +431,43 @@ func (m *Infra) JobTgStack(
 		tfVersionFile,
 		gitSSH,
 		tgLogLevel,
+		environment,
+		stack,
 	)
 
+	if baseCtrErr != nil {
+		return "", WrapErrorf(baseCtrErr, "failed to create base jobTg container for the job tg-stack %s", stack)
+	}
+
+	return runAllStackCommand(ctx, baseCtr, stack, environment, tgCmd, tgCmdArgs)
+}
+
+// runAllStackCommand runs a Terragrunt command on every unit of a stack (run-all), in a container
+// already configured by JobTg.
+//
+// Parameters:
+//   - ctx: The context for managing the operation's lifecycle.
+//   - baseCtr: The base container, already configured by JobTg.
+//   - stack: The stack to run the command on.
+//   - environment: The environment of the stack.
+//   - tgCmd: The command to run (e.g., plan).
+//   - tgCmdArgs: The arguments of the command (e.g., -auto-approve).
+//
+// Returns:
+//   - string: The output of the Terragrunt command.
+//   - error: Any error encountered while running the command.
+func runAllStackCommand(ctx context.Context, baseCtr *dagger.Container, stack, environment string, tgCmd, tgCmdArgs []string) (string, error) {
 	if len(tgCmd) == 0 {
 		return "", WrapErrorf(nil, "no commands to run for stack %s", stack)
 	}
 
-	tgCmd = append([]string{"terragrunt", "run-all"}, tgCmd...)
-
-	if baseCtrErr != nil {
-		return "", WrapErrorf(baseCtrErr, "failed to create base jobTg container for the job tg-stack %s", stack)
+	cmdBuilder, err := newTgCmdBuilder(ctx, baseCtr)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to build the Terragrunt commands for stack %s", stack)
 	}
 
+	tgCmd = cmdBuilder.runAll(tgCmd...)
+
 	// Define the working directory for this unit
 	tgWorkDir := getTerragruntExecutionPathForStacks(environment, stack)
 
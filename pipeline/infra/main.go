@@ -5,6 +5,7 @@
 	"dagger/infra/internal/dagger"
 	"fmt"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -26,6 +27,14 @@
 	// Default for AWS
 	defaultAWSRegion              = "eu-west-1"
 	defaultAWSOidcTokenSecretName = "AWS_OIDC_TOKEN"
+	// Preview environments
+	previewIDMaxLength = 32
+	// previewIDHashLength is the length of the hash that ends the truncated preview IDs.
+	previewIDHashLength = 8
+	// Secrets
+	// secretNameHashLength is the length of the hash that ends the names of the secrets set by the module,
+	// derived from what they're for (e.g., the host), so their names, and the cache, are stable across runs.
+	secretNameHashLength = 12
 	// TODO: Change this to the actual region based on your own convention
 	defaultRemoteStateRegion = "us-east-1"
 	// Configuration
@@ -34,12 +43,16 @@
 	configterraformPluginCachePath         = "/root/.terraform.d/plugin-cache"
 	configterragruntCachePath              = "/root/.terragrunt-cache"
 	configNetrcRootPath                    = "/root/.netrc"
+	configOIDCTokenMountRootPath           = "/run/secrets"
 	// tfConfig
 	// TODO: Change this to the actual bucket and lock table names
 	remoteStateDefaultBucketNamingConvention    = "terraform-state-makemyinfra"
 	remoteStateDefaultLockTableNamingConvention = "terraform-state-makemyinfra"
 )
 
+// defaultSecretKeyPatterns are the key patterns whose values are always set as secret variables.
+var defaultSecretKeyPatterns = []string{"*_TOKEN", "TOKEN", "*_SECRET", "SECRET", "*_KEY", "*PASSWORD*"}
+
 // Terragrunt represents a structure that encapsulates operations related to Terragrunt,
 // a tool for managing Terraform configurations. This struct can be extended with methods
 // that perform various tasks such as executing commands in containers, managing directories,
@@ -50,6 +63,40 @@ type Infra struct {
 
 	// Src is the source code for the Terragrunt project.
 	Src *dagger.Directory
+
+	// SecretKeyPatterns are the key patterns (e.g., *_TOKEN), on top of the default ones, whose values
+	// (from .env files, or envVars) are set as secret variables instead of plain environment variables.
+	SecretKeyPatterns []string
+
+	// NetrcMachines are the machines of the .netrc file built with WithNetrcMachine.
+	NetrcMachines []string
+
+	// Netrc is the .netrc file built with WithNetrcMachine, mounted at /root/.netrc.
+	Netrc *dagger.Secret
+
+	// AWSRoleMappings are the environments, or stacks, mapped to the IAM role the jobs assume, set with
+	// WithAWSRoleMappings.
+	AWSRoleMappings []string
+
+	// AWSExpectedAccountID is the AWS account ID the credentials must belong to, set with WithAWSExpectedAccountID.
+	AWSExpectedAccountID string
+
+	// SkipAWSPreflight skips checking the AWS credentials before running Terragrunt, set with WithoutAWSPreflight.
+	SkipAWSPreflight bool
+
+	// awsPreflight makes JobTg check the AWS credentials before running Terragrunt. Only the CD jobs set it
+	// (see withAWSPreflight), since the CI jobs only run static analysis.
+	awsPreflight bool
+
+	// SOPSAgeKey is the age key the SOPS-encrypted files are decrypted with, set with WithSOPSAgeKey.
+	SOPSAgeKey *dagger.Secret
+
+	// EnvContractFile is the env contract the jobs validate their environment against, set with WithEnvContract.
+	EnvContractFile string
+
+	// PreviewID is the normalised preview ID set with WithPreviewEnvironment. JobTg sets it again after
+	// the .env files, so a TG_STACK_PREVIEW_ID of theirs can't point a preview to the regular state.
+	PreviewID string
 }
 
 func New(
@@ -79,34 +126,45 @@ func New(
 	// srcDir is the directory to mount as the source code.
 	// +optional
 	// +defaultPath="/"
-	// +ignore=["*", "!**/*.hcl", "!**/*.tfvars", "!**/.git/**", "!**/*.tfvars.json", "!**/*.tf", "!*.env"]
+	// +ignore=["*", "!**/*.hcl", "!**/*.tfvars", "!**/.git/**", "!**/*.tfvars.json", "!**/*.tf", "!*.env", "!.env.*", "!*.json"]
 	srcDir *dagger.Directory,
 
 	// EnvVars are the environment variables that will be used to run the Terragrunt commands.
 	//
 	// +optional
 	envVars []string,
+
+	// secretKeyPatterns are extra key patterns (e.g., *_CREDENTIALS), on top of the default ones
+	// (*_TOKEN, *_SECRET, *_KEY, *PASSWORD*, etc.), whose values are set as secret variables.
+	//
+	// +optional
+	secretKeyPatterns []string,
 ) (*Infra, error) {
-	if ctr != nil {
-		mod := &Infra{Ctr: ctr}
-		mod, enVarError := mod.WithEnvVars(envVars)
-		if enVarError != nil {
-			return nil, WrapErrorf(enVarError, "failed to initialise dagger module with environment variables")
-		}
+	if err := validateSecretKeyPatterns(secretKeyPatterns); err != nil {
+		return nil, WrapErrorf(err, "failed to initialise dagger module with secret key patterns")
+	}
 
+	if ctr != nil {
+		mod := &Infra{Ctr: ctr, SecretKeyPatterns: secretKeyPatterns}
+		// The source directory is mounted first, since environment variables can reference its files.
 		modWithSRC, modWithSRCError := mod.WithSRC(ctx, defaultMntPath, srcDir)
 		if modWithSRCError != nil {
 			return nil, WrapErrorf(modWithSRCError, "failed to initialise dagger module with source directory")
 		}
 
 		mod = modWithSRC
+		mod, enVarError := mod.WithEnvVars(ctx, envVars)
+		if enVarError != nil {
+			return nil, WrapErrorf(enVarError, "failed to initialise dagger module with environment variables")
+		}
+
 		mod = mod.CommonSetup(tfVersion, tgVersion)
 
 		return mod, nil
 	}
 
 	if imageURL != "" {
-		mod := &Infra{}
+		mod := &Infra{SecretKeyPatterns: secretKeyPatterns}
 		mod.Ctr = dag.Container().From(imageURL)
 		modWithSRC, modWithSRCError := mod.WithSRC(ctx, defaultMntPath, srcDir)
 		if modWithSRCError != nil {
@@ -114,7 +172,7 @@ func New(
 		}
 
 		mod = modWithSRC
-		mod, enVarError := mod.WithEnvVars(envVars)
+		mod, enVarError := mod.WithEnvVars(ctx, envVars)
 
 		if enVarError != nil {
 			return nil, WrapErrorf(enVarError, "failed to initialise dagger module with environment variables")
@@ -125,7 +183,7 @@ func New(
 	}
 
 	// We'll use the binary that should be downloaded from its source, or github repository.
-	mod := &Infra{}
+	mod := &Infra{SecretKeyPatterns: secretKeyPatterns}
 	if tfVersion == "" {
 		tfVersion = defaultTerraformVersion
 	}
@@ -146,7 +204,7 @@ func New(
 	}
 
 	mod = modWithSRC
-	mod, enVarError := mod.WithEnvVars(envVars)
+	mod, enVarError := mod.WithEnvVars(ctx, envVars)
 
 	if enVarError != nil {
 		return nil, enVarError
@@ -180,6 +238,14 @@ func (m *Infra) CommonSetup(tfVersion, tgVersion string) *Infra {
 	return m
 }
 
+// clone returns a shallow copy of the module, so jobs that run several times (e.g., once per environment)
+// can decorate their own copy without leaking the configuration of one run into the next.
+func (m *Infra) clone() *Infra {
+	cloned := *m
+
+	return &cloned
+}
+
 // OpenTerminal returns a terminal
 //
 // It returns a terminal for the container.
@@ -205,7 +271,7 @@ func (m *Infra) OpenTerminal(
 	}
 
 	if loadEnvFiles {
-		m.WithDotEnvFile(ctx, m.Src)
+		m.WithDotEnvFile(ctx, m.Src, nil, "", "")
 	}
 
 	return m.
@@ -370,7 +436,10 @@ func (m *Infra) WithTerragruntCache() *Infra {
 
 // WithSecrets mounts secrets into the container.
 //
-// This method mounts secrets into the container for use by Terragrunt.
+// This method mounts secrets into the container for use by Terragrunt. Each secret is set as
+// an environment variable named after the secret, hence it only suits secrets created with a
+// name within Dagger (e.g., dag.SetSecret). Secrets passed from the CLI (e.g., env:MY_VAR) have
+// no name; use WithNamedSecrets for those.
 //
 // Parameters:
 //   - ctx: The context for the operation
@@ -378,44 +447,180 @@ func (m *Infra) WithTerragruntCache() *Infra {
 //
 // Returns:
 //   - The updated Infra instance with secrets mounted
-func (m *Infra) WithSecrets(ctx context.Context, secrets []*dagger.Secret) *Infra {
-	for _, secret := range secrets {
-		// FIXME: This is suitable when secrets are created within dagger. Assumming there's a name set.
-		secretName, _ := secret.Name(ctx)
+//   - An error if a secret has no name, or its name isn't a valid environment variable name
+func (m *Infra) WithSecrets(ctx context.Context, secrets []*dagger.Secret) (*Infra, error) {
+	for idx, secret := range secrets {
+		secretName, err := secret.Name(ctx)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to get the name of secret %d", idx+1)
+		}
+
+		if secretName == "" {
+			return nil, Errorf("secret %d has no name, so it can't be set as an environment variable; use WithNamedSecrets instead", idx+1)
+		}
+
+		if !envVarNameRegex.MatchString(secretName) {
+			return nil, Errorf("the name of secret %d, %q, isn't a valid environment variable name", idx+1, secretName)
+		}
 
 		m.Ctr = m.
 			Ctr.
 			WithSecretVariable(secretName, secret)
 	}
 
-	return m
+	return m, nil
+}
+
+// WithNamedSecrets sets secrets into the container, under explicit names.
+//
+// Each secret is paired, by position, with a key. A key is either the name of the environment
+// variable to set the secret as (e.g., DATADOG_API_KEY), or file: followed by an absolute path
+// to mount the secret as a file at (e.g., file:/root/.config/gcloud/credentials.json). Mounted
+// files are only readable by their owner.
+//
+// Parameters:
+//   - keys: The environment variable names, or file:/absolute/path keys, one per secret.
+//   - secrets: The secrets to set, in the same order as the keys.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the secrets set
+//   - error: An error if the keys and secrets don't pair up, or any key is invalid or duplicated
+func (m *Infra) WithNamedSecrets(
+	// keys are the environment variable names, or file:/absolute/path keys, one per secret.
+	keys []string,
+	// secrets are the secrets to set, in the same order as the keys.
+	secrets []*dagger.Secret,
+) (*Infra, error) {
+	if len(keys) != len(secrets) {
+		return nil, Errorf("got %d secret keys and %d secrets, each secret needs exactly one key", len(keys), len(secrets))
+	}
+
+	targets, err := getNamedSecretTargets(keys)
+	if err != nil {
+		return nil, WrapError(err, "failed to parse the secret keys")
+	}
+
+	for idx, target := range targets {
+		if target.FilePath != "" {
+			//nolint:exhaustruct // Only the mode is relevant for secret files.
+			m.Ctr = m.Ctr.WithMountedSecret(target.FilePath, secrets[idx], dagger.ContainerWithMountedSecretOpts{Mode: 0o400})
+
+			continue
+		}
+
+		m.Ctr = m.Ctr.WithSecretVariable(target.EnvVar, secrets[idx])
+	}
+
+	return m, nil
 }
 
 // WithEnvVars adds environment variables to the Terraformci container.
 //
 // This method allows setting multiple environment variables in key=value format.
 // It performs validation to ensure each environment variable is correctly formatted.
+// The value is everything after the first '=', so it can contain '=' itself. It can also
+// reference a host variable (KEY=env:HOST_VAR), a file of the source directory
+// (KEY=file:path/in/src), or a Dagger secret URI (KEY=secret:op://vault/item/field). A value that
+// starts with one of these prefixes itself is passed with the literal: prefix (e.g., KEY=literal:env:x).
+// Host variables and secret URIs are always set as secret variables; other values are
+// set as secret variables when their key matches a secret key pattern (see WithSecretKeyPatterns),
+// so they don't leak into logs, nor cache keys.
 //
 // Parameters:
-//   - envVars: A slice of environment variables in "KEY=VALUE" format
+//   - ctx: The context for the Dagger container.
+//   - envVars: A slice of environment variables in "KEY=VALUE" format (see above for the env:, file:, secret: and literal: prefixes)
 //
 // Returns:
 //   - The updated Infra instance with environment variables set
-//   - An error if any environment variable is incorrectly formatted
-func (m *Infra) WithEnvVars(envVars []string) (*Infra, error) {
+//   - An error if any environment variable is incorrectly formatted, or its reference can't be resolved
+func (m *Infra) WithEnvVars(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// envVars are the environment variables, in the KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI format (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
+	envVars []string,
+) (*Infra, error) {
 	envVarsDagger, err := getEnvVarsDaggerFromSlice(envVars)
 
 	if err != nil {
 		return nil, err
 	}
 
+	secretKeyPatterns := m.getSecretKeyPatterns()
+
 	for _, envVar := range envVarsDagger {
+		switch envVar.Source {
+		case envVarSourceEnv:
+			m.Ctr = m.Ctr.WithSecretVariable(envVar.Key, dag.Secret("env://"+envVar.Ref))
+
+			continue
+		case envVarSourceSecret:
+			m.Ctr = m.Ctr.WithSecretVariable(envVar.Key, dag.Secret(envVar.Ref))
+
+			continue
+		case envVarSourceFile:
+			if m.Src == nil {
+				return nil, Errorf("environment variable %s references the file %s, but there's no source directory", envVar.Key, envVar.Ref)
+			}
+
+			fileContent, fileErr := m.Src.File(envVar.Ref).Contents(ctx)
+			if fileErr != nil {
+				return nil, WrapErrorf(fileErr, "environment variable %s references the file %s, which can't be read from the source directory", envVar.Key, envVar.Ref)
+			}
+
+			envVar.Value = strings.TrimRight(fileContent, "\r\n")
+		}
+
+		if isSecretKey(envVar.Key, secretKeyPatterns) {
+			m.Ctr = m.Ctr.WithSecretVariable(envVar.Key, dag.SetSecret(fmt.Sprintf("%s_env_var", envVar.Key), envVar.Value))
+
+			continue
+		}
+
 		m.Ctr = m.Ctr.WithEnvVariable(envVar.Key, envVar.Value)
 	}
 
 	return m, nil
 }
 
+// WithSecretKeyPatterns adds key patterns whose values are set as secret variables.
+//
+// The patterns are matched, case-insensitively, against the keys of the .env files and envVars,
+// with the path.Match syntax (e.g., *_TOKEN, DB_*_PASSWORD). They're added on top of the default
+// ones: *_TOKEN, TOKEN, *_SECRET, SECRET, *_KEY and *PASSWORD*.
+//
+// Parameters:
+//   - patterns: The key patterns to add.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the secret key patterns set
+//   - error: An error if any of the patterns is malformed
+func (m *Infra) WithSecretKeyPatterns(
+	// patterns are the key patterns to add (e.g., *_CREDENTIALS).
+	patterns []string,
+) (*Infra, error) {
+	if err := validateSecretKeyPatterns(patterns); err != nil {
+		return nil, err
+	}
+
+	// A new slice is built, so copies of the module (see clone) never share the patterns they add.
+	secretKeyPatterns := slices.Clone(m.SecretKeyPatterns)
+	for _, pattern := range patterns {
+		if !slices.Contains(secretKeyPatterns, pattern) {
+			secretKeyPatterns = append(secretKeyPatterns, pattern)
+		}
+	}
+
+	m.SecretKeyPatterns = secretKeyPatterns
+
+	return m, nil
+}
+
+// getSecretKeyPatterns returns the default secret key patterns, and the ones added to the module.
+func (m *Infra) getSecretKeyPatterns() []string {
+	return append(slices.Clone(defaultSecretKeyPatterns), m.SecretKeyPatterns...)
+}
+
 // WithToken adds a token to the Terragrunt container.
 //
 // This method adds a token to the container, making it available as an environment variable.
@@ -426,7 +631,8 @@ func (m *Infra) WithEnvVars(envVars []string) (*Infra, error) {
 //
 // Returns:
 //   - The updated Infra instance with the token added
-func (m *Infra) WithToken(ctx context.Context, tokenValue *dagger.Secret) *Infra {
+//   - An error if the token has no name (see WithSecrets)
+func (m *Infra) WithToken(ctx context.Context, tokenValue *dagger.Secret) (*Infra, error) {
 	return m.WithSecrets(ctx, []*dagger.Secret{tokenValue})
 }
 
@@ -452,75 +658,82 @@ func (m *Infra) WithTerragrunt(version string) *Infra {
 	return m
 }
 
-// WithNewNetrcFileGitHub creates a new .netrc file with the GitHub credentials.
+// WithNewNetrcFileGitHub adds the GitHub credentials to the .netrc file.
 //
-// The .netrc file is created in the root directory of the container.
+// The .netrc file is mounted in the root directory of the container, as a secret file.
+// See WithNetrcMachine.
 func (m *Infra) WithNewNetrcFileGitHub(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
 	username string,
 	password string,
-) *Infra {
-	machineCMD := "machine github.com\nlogin " + username + "\npassword " + password + "\n"
-
-	m.Ctr = m.Ctr.WithNewFile(configNetrcRootPath, machineCMD)
-
-	return m
+) (*Infra, error) {
+	return m.WithNetrcMachine(ctx, "github.com", username, dag.SetSecret(fmt.Sprintf("netrc_github_%s", getSHA256Hex("github.com/" + username)[:secretNameHashLength]), password))
 }
 
-// WithNewNetrcFileAsSecretGitHub creates a new .netrc file with the GitHub credentials.
+// WithNewNetrcFileAsSecretGitHub adds the GitHub credentials to the .netrc file.
 //
-// The .netrc file is created in the root directory of the container.
-// The argument 'password' is a secret that is not exposed in the logs.
-func (m *Infra) WithNewNetrcFileAsSecretGitHub(username string, password *dagger.Secret) *Infra {
-	passwordTxtValue, _ := password.Plaintext(context.Background())
-	machineCMD := fmt.Sprintf("machine github.com\nlogin %s\npassword %s\n", username, passwordTxtValue)
-	//nolint:exhaustruct // This is a method that is used to set the base image and version.
-	m.Ctr = m.Ctr.WithNewFile(configNetrcRootPath, machineCMD)
-
-	return m
+// The .netrc file is mounted in the root directory of the container, as a secret file.
+// The argument 'password' is a secret that is not exposed in the logs. See WithNetrcMachine.
+func (m *Infra) WithNewNetrcFileAsSecretGitHub(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	username string,
+	password *dagger.Secret,
+) (*Infra, error) {
+	return m.WithNetrcMachine(ctx, "github.com", username, password)
 }
 
-// WithNewNetrcFileGitLab creates a new .netrc file with the GitLab credentials.
+// WithNewNetrcFileGitLab adds the GitLab credentials to the .netrc file.
 //
-// The .netrc file is created in the root directory of the container.
+// The .netrc file is mounted in the root directory of the container, as a secret file.
+// See WithNetrcMachine.
 func (m *Infra) WithNewNetrcFileGitLab(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
 	username string,
 	password string,
-) *Infra {
-	machineCMD := "machine gitlab.com\nlogin " + username + "\npassword " + password + "\n"
-
-	m.Ctr = m.Ctr.WithNewFile(configNetrcRootPath, machineCMD)
-
-	return m
+) (*Infra, error) {
+	return m.WithNetrcMachine(ctx, "gitlab.com", username, dag.SetSecret(fmt.Sprintf("netrc_gitlab_%s", getSHA256Hex("gitlab.com/" + username)[:secretNameHashLength]), password))
 }
 
-// WithNewNetrcFileAsSecretGitLab creates a new .netrc file with the GitLab credentials.
+// WithNewNetrcFileAsSecretGitLab adds the GitLab credentials to the .netrc file.
 //
-// The .netrc file is created in the root directory of the container.
-// The argument 'password' is a secret that is not exposed in the logs.
-func (m *Infra) WithNewNetrcFileAsSecretGitLab(username string, password *dagger.Secret) *Infra {
-	passwordTxtValue, _ := password.Plaintext(context.Background())
-	machineCMD := fmt.Sprintf("machine gitlab.com\nlogin %s\npassword %s\n", username, passwordTxtValue)
-
-	//nolint:exhaustruct // This is a method that is used to set the base image and version.
-	m.Ctr = m.Ctr.WithNewFile(configNetrcRootPath, machineCMD)
-
-	return m
+// The .netrc file is mounted in the root directory of the container, as a secret file.
+// The argument 'password' is a secret that is not exposed in the logs. See WithNetrcMachine.
+func (m *Infra) WithNewNetrcFileAsSecretGitLab(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	username string,
+	password *dagger.Secret,
+) (*Infra, error) {
+	return m.WithNetrcMachine(ctx, "gitlab.com", username, password)
 }
 
 // WithSSHAuthSocket configures SSH authentication for Terraform modules with Git SSH sources.
 //
 // This function mounts an SSH authentication socket into the container, enabling Terraform to authenticate
 // when fetching modules from Git repositories using SSH URLs (e.g., git@github.com:org/repo.git).
+// Self-hosted Git hosts are added with sshHosts; their host keys can be pinned with knownHosts, so
+// they're not trusted on first use (see WithSSHKnownHosts).
 //
 // Parameters:
-//   - sshAuthSocket: The SSH authentication socket to mount in the container.
+//   - sshAuthSocket: Optional. The SSH authentication socket to mount in the container. Without it, only the known hosts are added (e.g., for WithSSHDeployKey).
 //   - socketPath: The path where the SSH socket will be mounted in the container.
 //   - owner: Optional. The owner of the mounted socket in the container.
+//   - sshHosts: Optional. The Git hosts to add to the known hosts, as HOST or HOST:PORT.
+//   - knownHosts: Optional. The pinned known_hosts content of the sshHosts.
 //
 // Returns:
 //   - *Infra: The updated Infra instance with SSH authentication configured for Terraform modules.
+//   - error: An error if a host is malformed, or has no entry in the pinned known_hosts content
 func (m *Infra) WithSSHAuthSocket(
 	// sshAuthSocket is the SSH socket to use for authentication.
+	// +optional
 	sshAuthSocket *dagger.Socket,
 	// socketPath is the path where the SSH socket will be mounted in the container.
 	// +optional
@@ -534,7 +747,13 @@ func (m *Infra) WithSSHAuthSocket(
 	// enableGithubKnownHosts adds the Github known hosts to the container.
 	// +optional
 	enableGithubKnownHosts bool,
-) *Infra {
+	// sshHosts are the Git hosts to add to the known hosts, as HOST or HOST:PORT (e.g., gitlab.mycorp.internal:2222).
+	// +optional
+	sshHosts []string,
+	// knownHosts is the pinned known_hosts content of the sshHosts. Without it, host keys are fetched with ssh-keyscan.
+	// +optional
+	knownHosts string,
+) (*Infra, error) {
 	// Default the socket path if not provided
 	if socketPath == "" {
 		socketPath = "/var/run/host.sock"
@@ -547,7 +766,7 @@ func (m *Infra) WithSSHAuthSocket(
 	}
 
 	// Ensure .ssh directory exists before running ssh-keyscan
-	m.Ctr = m.Ctr.WithExec([]string{"mkdir", "-p", "/root/.ssh"})
+	m.Ctr = m.Ctr.WithExec([]string{"mkdir", "-p", configSSHRootPath})
 
 	if enableGitlabKnownHosts {
 		m.Ctr = m.Ctr.
@@ -559,13 +778,19 @@ func (m *Infra) WithSSHAuthSocket(
 			WithExec([]string{"sh", "-c", "ssh-keyscan github.com >> /root/.ssh/known_hosts"})
 	}
 
-	m.Ctr = m.Ctr.
-		WithExec([]string{"chmod", "600", "/root/.ssh/known_hosts"})
+	mDecorated, err := m.WithSSHKnownHosts(sshHosts, knownHosts)
+	if err != nil {
+		return nil, err
+	}
 
-	m.Ctr = m.Ctr.WithUnixSocket(socketPath, sshAuthSocket, socketOpts).
-		WithEnvVariable("SSH_AUTH_SOCK", socketPath)
+	m = mDecorated
 
-	return m
+	if sshAuthSocket != nil {
+		m.Ctr = m.Ctr.WithUnixSocket(socketPath, sshAuthSocket, socketOpts).
+			WithEnvVariable("SSH_AUTH_SOCK", socketPath)
+	}
+
+	return m, nil
 }
 
 // WithTrragruntDeploymentRegion sets the Terragrunt deployment region in the container.
@@ -629,11 +854,28 @@ func (m *Infra) WithAWSKeys(
 	return m
 }
 
-// WithAWSOIDC sets the AWS OIDC credentials in the container.
+// WithAWSOIDC sets the AWS OIDC (web identity) credentials in the container.
 //
-// This method sets the AWS OIDC credentials in the container, making them available as environment variables.
-// It also mounts the AWS OIDC credentials as secrets into the container.
+// The OIDC token is mounted as a secret file under /run/secrets, and AWS_WEB_IDENTITY_TOKEN_FILE points to it,
+// so the AWS SDKs (and Terraform's AWS provider) assume the role with it. Before mounting it, the token is
+// checked to be a well-formed JWT that hasn't expired, so an invalid token fails fast instead of in the middle
+// of a Terragrunt run. If set, the AWS keys are removed, since they take precedence over the web identity.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - roleARN: The ARN of the IAM role to assume.
+//   - oidcToken: The OIDC JWT token (e.g., GitLab's GITLAB_OIDC_TOKEN).
+//   - oidcTokenName: Optional. The name of the token file, under /run/secrets.
+//   - awsRegion: Optional. The AWS region.
+//   - awsRoleSessionName: Optional. The name of the assumed role session.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the OIDC credentials set
+//   - error: An error if the role ARN, or the OIDC token, is invalid
 func (m *Infra) WithAWSOIDC(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
 	// roleARN is the ARN of the IAM role to assume.
 	roleARN string,
 	// oidcToken is the Dagger Secret containing the OIDC JWT token from GitLab.
@@ -647,18 +889,39 @@ func (m *Infra) WithAWSOIDC(
 	// awsRoleSessionName is an optional name for the assumed role session.
 	// +optional
 	awsRoleSessionName string,
-) *Infra {
+) (*Infra, error) {
+	if oidcToken == nil {
+		return nil, NewError("the OIDC token is required to assume the AWS role with web identity")
+	}
+
+	if _, err := getAWSAccountIDFromRoleARN(roleARN); err != nil {
+		return nil, WrapErrorf(err, "failed to set the AWS OIDC credentials")
+	}
+
 	awsRegion = getDefaultAWSRegionIfNotSet(awsRegion)
 
 	if oidcTokenName == "" {
 		oidcTokenName = defaultAWSOidcTokenSecretName
 	}
 
+	if oidcTokenName != filepath.Base(oidcTokenName) || oidcTokenName == "." || oidcTokenName == ".." {
+		return nil, Errorf("invalid OIDC token name %q, it must be a file name, not a path", oidcTokenName)
+	}
+
 	if awsRoleSessionName == "" {
 		awsRoleSessionName = fmt.Sprintf("terragrunt-dagger-%s", uuid.New().String())
 	}
 
-	oidcTokenPath := "run/secrets/" + oidcTokenName
+	oidcTokenValue, err := oidcToken.Plaintext(ctx)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to read the OIDC token")
+	}
+
+	if _, err := validateOIDCToken(oidcTokenValue, time.Now()); err != nil {
+		return nil, WrapErrorf(err, "invalid OIDC token to assume the AWS role %s", roleARN)
+	}
+
+	oidcTokenPath := filepath.Join(configOIDCTokenMountRootPath, oidcTokenName)
 
 	m.Ctr = m.Ctr.
 		WithEnvVariable("AWS_REGION", awsRegion).
@@ -669,9 +932,12 @@ func (m *Infra) WithAWSOIDC(
 		WithoutEnvVariable("AWS_ACCESS_KEY_ID").
 		WithoutEnvVariable("AWS_SECRET_ACCESS_KEY").
 		WithoutEnvVariable("AWS_SESSION_TOKEN").
-		WithSecretVariable(oidcTokenName, oidcToken)
+		WithoutEnvVariable("AWS_PROFILE").
+		WithMountedSecret(oidcTokenPath, oidcToken, dagger.ContainerWithMountedSecretOpts{
+			Mode: 0o400,
+		})
 
-	return m
+	return m, nil
 }
 
 // WithGitlabToken sets the GitLab token in the container.
@@ -702,16 +968,28 @@ func (m *Infra) WithGitHubToken(ctx context.Context, token *dagger.Secret) *Infr
 
 // WithTerraformToken sets the Terraform token in the container.
 //
-// This method sets the Terraform token in the container, making it available as an environment variable.
+// This method sets the token Terraform authenticates on a registry (or Terraform Cloud) host with,
+// as the TF_TOKEN_<host> environment variable Terraform reads it from. See WithTerraformRegistryToken.
 //
 // Parameters:
 //   - ctx: The context for the Dagger container.
 //   - token: The Terraform token to set.
-func (m *Infra) WithTerraformToken(ctx context.Context, token *dagger.Secret) *Infra {
-	m.Ctr = m.Ctr.
-		WithSecretVariable("TF_TOKEN", token)
+//   - host: The hostname the token is for. Defaults to app.terraform.io.
+func (m *Infra) WithTerraformToken(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// token is the Terraform token to set.
+	token *dagger.Secret,
+	// host is the hostname the token is for. Defaults to app.terraform.io.
+	// +optional
+	host string,
+) (*Infra, error) {
+	if host == "" {
+		host = defaultTerraformRegistryHost
+	}
 
-	return m
+	return m.WithTerraformRegistryToken(host, token)
 }
 
 // WithTerragruntLogLevel sets the Terragrunt log level in the container.
@@ -755,53 +1033,108 @@ func (m *Infra) WithTerragruntNoColor() *Infra {
 
 // WithDotEnvFile loads and processes environment variables from .env files in the provided directory.
 //
-// This method finds all .env files in the given directory, reads their contents, and sets
-// environment variables in the Terragrunt container. Files containing "secret" in their name
-// will have their values added as secret variables rather than regular environment variables.
+// This method finds the .env files in the given directory, reads their contents, and sets
+// environment variables in the Terragrunt container. Each key is classified by its name: keys matching
+// a secret key pattern (e.g., *_TOKEN, *PASSWORD*, plus the ones added with WithSecretKeyPatterns) are
+// set as secret variables, and so are the values that expand one of them (e.g., a URL built with
+// ${DB_PASSWORD}). Every key of a SOPS-encrypted file, or of a file with "secret" in its name, is secret
+// too. Every other key is set as a regular environment variable.
+//
+// Files are layered in order: .env and the other *.env files first, then .env.<environment>,
+// and then .env.<environment>.<stack>. A key defined in a later layer overrides the earlier one,
+// and the file each key came from is reported in the logs (without its value).
 //
-// The method supports standard .env file formats with KEY=VALUE pairs on each line.
-// Comments (lines starting with #) and empty lines are ignored. Values can be optionally
-// quoted with single or double quotes, which will be automatically removed.
+// The method follows the common dotenv semantics: KEY=VALUE pairs with an optional 'export' prefix,
+// comments (full-line, and inline after whitespace), single-quoted literal values, double-quoted
+// values with escapes, multi-line quoted values, and ${VAR}, $VAR and ${VAR:-default} expansion.
+//
+// SOPS-encrypted .env, .tfvars and .json files are detected as well, and decrypted inside the container
+// with the age key passed. Every decrypted value is set only as a secret variable; values from .tfvars
+// and .tfvars.json files are set as TF_VAR_<name>. Without an age key, the encrypted .tfvars and .json
+// files are skipped with a warning, while an encrypted .env layer still fails.
 //
 // Parameters:
 //   - ctx: Context for the Dagger operations
 //   - src: Directory containing the .env files to process
+//   - sopsAgeKey: Optional. The age key to decrypt the SOPS-encrypted files with
+//   - environment: Optional. The environment that selects the .env.<environment> layer
+//   - stack: Optional. The stack that selects the .env.<environment>.<stack> layer
 //
 // Returns:
 //   - *Infra: The updated Infra instance with environment variables set
-//   - error: An error if file reading or parsing fails
-func (m *Infra) WithDotEnvFile(ctx context.Context, src *dagger.Directory) (*Infra, error) {
+//   - error: An error if file reading, parsing or decryption fails
+func (m *Infra) WithDotEnvFile(
+	// ctx is the context for the Dagger container.
+	ctx context.Context,
+	// src is the directory containing the .env files to process.
+	src *dagger.Directory,
+	// sopsAgeKey is the age key to decrypt the SOPS-encrypted files with.
+	// +optional
+	sopsAgeKey *dagger.Secret,
+	// environment is the environment that selects the .env.<environment> layer.
+	// +optional
+	environment string,
+	// stack is the stack that selects the .env.<environment>.<stack> layer.
+	// +optional
+	stack string,
+) (*Infra, error) {
 	if src == nil {
 		return nil, NewError("failed to load .env file, the source directory is nil")
 	}
 
-	// Check if there's any dotenv file on the source directory passed, or set.
-	entries, err := src.Entries(ctx)
-	if err != nil {
-		return nil, WrapErrorf(err, "failed to list files in source directory")
+	layerFiles, dotEnvVars, decrypter, loadErr := m.loadDotEnvLayers(ctx, src, sopsAgeKey, environment, stack)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	encryptedFiles, sopsErr := findSOPSEncryptedFiles(ctx, src)
+	if sopsErr != nil {
+		return nil, WrapErrorf(sopsErr, "failed to look for SOPS-encrypted files")
 	}
 
-	foundDotEnvFiles := []string{}
-	for _, entry := range entries {
-		if strings.HasSuffix(entry, ".env") {
-			foundDotEnvFiles = append(foundDotEnvFiles, entry)
+	// Without an age key, the encrypted .tfvars and .json files aren't consumed (e.g., a job that only needs
+	// the .env files), so they're skipped with a warning, instead of failing the job.
+	var skippedFiles []string
+	if sopsAgeKey == nil {
+		for _, encryptedFile := range encryptedFiles {
+			skippedFiles = append(skippedFiles, encryptedFile.Path)
 		}
+
+		encryptedFiles = nil
 	}
 
-	if len(foundDotEnvFiles) == 0 {
+	if len(layerFiles) == 0 && len(encryptedFiles) == 0 {
 		return nil, NewError("No .env files found when inspecting the source directory")
 	}
 
-	dotEnvFilesInSrc, srcError := src.Glob(ctx, "*.env")
+	ctrWithDotEnvFiles := m.Ctr
+	for _, envVar := range dotEnvVars {
+		if envVar.Secret {
+			// Use a distinct name for the Dagger secret object itself
+			secretName := fmt.Sprintf("%s_secret_%s", envVar.Key, envVar.Source)
+			ctrWithDotEnvFiles = ctrWithDotEnvFiles.WithSecretVariable(envVar.Key, dag.SetSecret(secretName, envVar.Value))
+		} else {
+			ctrWithDotEnvFiles = ctrWithDotEnvFiles.WithEnvVariable(envVar.Key, envVar.Value)
+		}
+	}
 
-	if srcError != nil {
-		return nil, WrapErrorf(srcError, "failed to glob dot env files")
+	if len(encryptedFiles) > 0 {
+		ctrWithDecryptedFiles, decryptErr := withSOPSDecryptedFiles(ctx, ctrWithDotEnvFiles, encryptedFiles, decrypter)
+		if decryptErr != nil {
+			return nil, WrapErrorf(decryptErr, "failed to load SOPS-encrypted files")
+		}
+
+		ctrWithDotEnvFiles = ctrWithDecryptedFiles
 	}
 
-	ctrWithDotEnvFiles, dotEnvFilesParseErr := parseDotEnvFiles(ctx, m.Ctr, src, dotEnvFilesInSrc)
+	if len(layerFiles) > 0 {
+		ctrWithDotEnvFiles = ctrWithDotEnvFiles.
+			WithExec([]string{"echo", formatDotEnvLayersReport(environment, stack, layerFiles, dotEnvVars)})
+	}
 
-	if dotEnvFilesParseErr != nil {
-		return nil, WrapErrorf(dotEnvFilesParseErr, "failed to parse dot env files")
+	if len(skippedFiles) > 0 {
+		ctrWithDotEnvFiles = ctrWithDotEnvFiles.
+			WithExec([]string{"echo", fmt.Sprintf("⚠️ Skipped the SOPS-encrypted files (no age key passed): %s", strings.Join(skippedFiles, ", "))})
 	}
 
 	m.Ctr = ctrWithDotEnvFiles
@@ -809,6 +1142,68 @@ func (m *Infra) WithDotEnvFile(ctx context.Context, src *dagger.Directory) (*Inf
 	return m, nil
 }
 
+// DotEnvLayers reports which .env file each key comes from, for the given environment and stack.
+//
+// It loads the same layers as WithDotEnvFile (.env and the other *.env files, then .env.<environment>,
+// and then .env.<environment>.<stack>), without setting them in the container. Values are never
+// part of the report.
+//
+// Returns:
+//   - string: The report, with the layers loaded, and the file each key came from
+//   - error: An error if file reading, parsing or decryption fails
+func (m *Infra) DotEnvLayers(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// environment is the environment that selects the .env.<environment> layer.
+	// +optional
+	environment string,
+	// stack is the stack that selects the .env.<environment>.<stack> layer.
+	// +optional
+	stack string,
+	// sopsAgeKey is the age key to decrypt the SOPS-encrypted files with.
+	// +optional
+	sopsAgeKey *dagger.Secret,
+) (string, error) {
+	if m.Src == nil {
+		return "", NewError("failed to load .env files, the source directory is nil")
+	}
+
+	layerFiles, dotEnvVars, _, loadErr := m.loadDotEnvLayers(ctx, m.Src, sopsAgeKey, environment, stack)
+	if loadErr != nil {
+		return "", loadErr
+	}
+
+	if len(layerFiles) == 0 {
+		return "", NewError("No .env files found when inspecting the source directory")
+	}
+
+	return formatDotEnvLayersReport(environment, stack, layerFiles, dotEnvVars), nil
+}
+
+// loadDotEnvLayers finds the .env layers in the source directory, and merges them, in order.
+func (m *Infra) loadDotEnvLayers(
+	ctx context.Context,
+	src *dagger.Directory,
+	sopsAgeKey *dagger.Secret,
+	environment, stack string,
+) ([]string, []dotEnvVar, *sopsDecrypter, error) {
+	entries, err := src.Entries(ctx)
+	if err != nil {
+		return nil, nil, nil, WrapErrorf(err, "failed to list files in source directory")
+	}
+
+	layerFiles := getDotEnvLayerFiles(entries, environment, stack)
+	decrypter := newSOPSDecrypter(m.Ctr, src, sopsAgeKey)
+
+	dotEnvVars, parseErr := parseDotEnvFiles(ctx, src, layerFiles, decrypter, m.getSecretKeyPatterns())
+	if parseErr != nil {
+		return nil, nil, nil, WrapErrorf(parseErr, "failed to parse dot env files")
+	}
+
+	return layerFiles, dotEnvVars, decrypter, nil
+}
+
 // WithRemoteBackendConfiguration sets the remote backend configuration in the container.
 //
 // This method sets the remote backend configuration in the container, making it available as environment variables.
@@ -832,6 +1227,46 @@ func (m *Infra) WithRemoteBackendConfiguration(bucket, locktable, region string)
 	return m
 }
 
+// WithRegionScopedRemoteState makes the deployment region part of the remote state key.
+//
+// This method sets the TG_STACK_REMOTE_STATE_KEY_REGION_SCOPED environment variable, so the same stack can be
+// deployed to several regions (see WithTrragruntDeploymentRegion) without the regions sharing their state.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the region-scoped remote state enabled
+func (m *Infra) WithRegionScopedRemoteState() *Infra {
+	m.Ctr = m.Ctr.
+		WithEnvVariable("TG_STACK_REMOTE_STATE_KEY_REGION_SCOPED", "true")
+
+	return m
+}
+
+// WithPreviewEnvironment namespaces the deployment into an ephemeral preview environment.
+//
+// This method sets the TG_STACK_PREVIEW_ID environment variable, which the Terragrunt configuration uses to
+// namespace the remote state key and the resource name prefix, so a stack can be applied into an isolated preview.
+// The preview ID is normalised, so a branch name (e.g., "feature/My-Change") or a merge request ID can be passed as is.
+// It wins over a TG_STACK_PREVIEW_ID set by the .env files, even an empty one.
+//
+// Parameters:
+//   - previewID: The preview identifier, normally a branch name or a merge request ID.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the preview environment set
+//   - error: An error if the preview ID is empty once normalised
+func (m *Infra) WithPreviewEnvironment(previewID string) (*Infra, error) {
+	normalisedPreviewID, err := getNormalisedPreviewID(previewID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.PreviewID = normalisedPreviewID
+	m.Ctr = m.Ctr.
+		WithEnvVariable("TG_STACK_PREVIEW_ID", normalisedPreviewID)
+
+	return m, nil
+}
+
 // WithDotTerraformVersionFileGeneration sets the Terragrunt dot terraform version file generation in the container.
 //
 // This method sets the Terragrunt dot terraform version file generation in the container, making it available as an environment variable.
@@ -900,6 +1335,7 @@ func (m *Infra) WithTerragruntNoInteractive() *Infra {
 // WithTerraformGitlabToken sets the Terraform Gitlab token in the container.
 //
 // This method sets the Terraform Gitlab token in the container, making it available as an environment variable.
+// It's only for gitlab.com; use WithTerraformRegistryToken for self-hosted GitLab instances.
 //
 // Parameters:
 //   - ctx: The context for the Dagger container.
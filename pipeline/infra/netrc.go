@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// WithNetrcMachine adds a machine entry to the .netrc file of the container.
+//
+// Entries accumulate: each call adds a machine (e.g., github.com, and then gitlab.example.com), so
+// modules sourced from different Git hosts can authenticate in the same run. The file is kept as a
+// Dagger secret, and mounted at /root/.netrc only readable by its owner, so passwords never end up
+// in a plain file, nor in the logs.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - machine: The host to authenticate on (e.g., github.com).
+//   - login: The login (username) to authenticate with.
+//   - password: The password, or token, to authenticate with.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the machine added to the .netrc file
+//   - error: An error if the entry is malformed, or the machine is already in the .netrc file
+func (m *Infra) WithNetrcMachine(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// machine is the host to authenticate on (e.g., github.com).
+	machine string,
+	// login is the login (username) to authenticate with.
+	login string,
+	// password is the password, or token, to authenticate with.
+	password *dagger.Secret,
+) (*Infra, error) {
+	machine, login = strings.TrimSpace(machine), strings.TrimSpace(login)
+
+	if err := validateNetrcToken("machine", machine); err != nil {
+		return nil, WrapError(err, "invalid .netrc entry")
+	}
+
+	if err := validateNetrcToken("login", login); err != nil {
+		return nil, WrapErrorf(err, "invalid .netrc entry for machine %s", machine)
+	}
+
+	if slices.Contains(m.NetrcMachines, machine) {
+		return nil, Errorf("machine %s is already in the .netrc file", machine)
+	}
+
+	if password == nil {
+		return nil, Errorf("the password of the .netrc entry for machine %s is required", machine)
+	}
+
+	passwordValue, err := password.Plaintext(ctx)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to read the password of the .netrc entry for machine %s", machine)
+	}
+
+	// The value itself isn't part of the error, since it's a secret.
+	if passwordValue == "" || strings.ContainsAny(passwordValue, " \t\r\n") {
+		return nil, Errorf("the password of the .netrc entry for machine %s must be non-empty, and have no whitespace", machine)
+	}
+
+	netrcContent := ""
+	if m.Netrc != nil {
+		netrcContent, err = m.Netrc.Plaintext(ctx)
+		if err != nil {
+			return nil, WrapError(err, "failed to read the current .netrc file")
+		}
+	}
+
+	netrcContent += fmt.Sprintf("machine %s\nlogin %s\npassword %s\n", machine, login, passwordValue)
+
+	// A new slice is built, so copies of the module (see clone) never share the machines they add.
+	m.NetrcMachines = append(slices.Clone(m.NetrcMachines), machine)
+	// The name is derived from the machines, so the same .netrc file keeps the same name, and cache, across runs.
+	m.Netrc = dag.SetSecret(fmt.Sprintf("netrc_%s", getSHA256Hex(strings.Join(m.NetrcMachines, ","))[:secretNameHashLength]), netrcContent)
+
+	// Mounting it again replaces the previous .netrc file, with the one that has every entry.
+	//nolint:exhaustruct // Only the mode is relevant for the .netrc file.
+	m.Ctr = m.Ctr.WithMountedSecret(configNetrcRootPath, m.Netrc, dagger.ContainerWithMountedSecretOpts{Mode: 0o600})
+
+	return m, nil
+}
+
+// validateNetrcToken checks a token (machine, or login) of a .netrc entry can be written unquoted.
+func validateNetrcToken(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("the %s is required", name)
+	}
+
+	if strings.ContainsAny(value, " \t\r\n#") {
+		return fmt.Errorf("the %s %q must have no whitespace, nor '#'", name, value)
+	}
+
+	return nil
+}
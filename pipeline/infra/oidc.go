@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultGitHubActionsOIDCAudience is the audience AWS STS expects in the GitHub Actions ID tokens.
+	defaultGitHubActionsOIDCAudience = "sts.amazonaws.com"
+	// gitHubActionsOIDCTokenName is the name of the token file the GitHub Actions ID token is mounted as.
+	gitHubActionsOIDCTokenName = "GITHUB_ACTIONS_OIDC_TOKEN"
+	// gitHubActionsOIDCRequestTimeout is the timeout of the request to the GitHub Actions ID token endpoint.
+	gitHubActionsOIDCRequestTimeout = 30 * time.Second
+	// oidcTokenClockSkew is the leeway allowed when checking the expiry, and the not-before time, of an OIDC token.
+	oidcTokenClockSkew = 30 * time.Second
+)
+
+// oidcTokenClaims represents the claims of an OIDC token that are checked before using it.
+type oidcTokenClaims struct {
+	Issuer    string  `json:"iss"` // Issuer is the identity provider that issued the token.
+	Subject   string  `json:"sub"` // Subject is the identity the token was issued for (e.g., a project, or a repository).
+	ExpiresAt float64 `json:"exp"` // ExpiresAt is the expiry time of the token, in seconds since the epoch.
+	NotBefore float64 `json:"nbf"` // NotBefore is the time before which the token isn't valid, in seconds since the epoch.
+}
+
+// validateOIDCToken checks an OIDC token is a well-formed JWT (header.payload.signature), and that it's
+// valid at the given time. The signature isn't verified, since that's done by AWS STS when the role is
+// assumed; the goal is to fail early, with a clear error, on tokens that can't work.
+// The token is never part of the returned errors.
+func validateOIDCToken(token string, now time.Time) (*oidcTokenClaims, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return nil, NewError("the OIDC token is empty")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, Errorf("the OIDC token must be a JWT with 3 parts (header.payload.signature), but it has %d", len(parts))
+	}
+
+	for idx, part := range parts {
+		if part == "" {
+			return nil, Errorf("the OIDC token has an empty JWT part at position %d", idx)
+		}
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil || !json.Valid(header) {
+		return nil, NewError("the OIDC token header isn't valid base64url-encoded JSON")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, NewError("the OIDC token payload isn't valid base64url")
+	}
+
+	var claims oidcTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, NewError("the OIDC token payload isn't valid JSON, or its claims have the wrong type")
+	}
+
+	if claims.ExpiresAt == 0 {
+		return nil, NewError("the OIDC token has no expiry (exp) claim")
+	}
+
+	expiresAt := time.Unix(int64(claims.ExpiresAt), 0)
+	if now.After(expiresAt.Add(oidcTokenClockSkew)) {
+		return nil, Errorf("the OIDC token expired at %s", expiresAt.UTC().Format(time.RFC3339))
+	}
+
+	if claims.NotBefore != 0 {
+		notBefore := time.Unix(int64(claims.NotBefore), 0)
+		if now.Add(oidcTokenClockSkew).Before(notBefore) {
+			return nil, Errorf("the OIDC token isn't valid before %s", notBefore.UTC().Format(time.RFC3339))
+		}
+	}
+
+	return &claims, nil
+}
+
+// gitHubActionsIDTokenResponse represents the response of the GitHub Actions ID token endpoint.
+type gitHubActionsIDTokenResponse struct {
+	Value string `json:"value"`
+}
+
+// WithGitHubActionsOIDC sets the AWS OIDC (web identity) credentials in the container, using a GitHub Actions ID token.
+//
+// The ID token is requested from the GitHub Actions endpoint (ACTIONS_ID_TOKEN_REQUEST_URL), authenticated with
+// the request token (ACTIONS_ID_TOKEN_REQUEST_TOKEN), both available in workflows with the 'id-token: write'
+// permission. The token is then set up the same way as WithAWSOIDC, mounted as a secret file.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - roleARN: The ARN of the IAM role to assume.
+//   - requestURL: The GitHub Actions ID token endpoint (ACTIONS_ID_TOKEN_REQUEST_URL).
+//   - requestToken: The bearer token to request the ID token with (ACTIONS_ID_TOKEN_REQUEST_TOKEN).
+//   - audience: Optional. The audience of the ID token. Defaults to sts.amazonaws.com.
+//   - awsRegion: Optional. The AWS region.
+//   - awsRoleSessionName: Optional. The name of the assumed role session.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the OIDC credentials set
+//   - error: An error if the ID token can't be fetched, or it isn't valid
+func (m *Infra) WithGitHubActionsOIDC(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// roleARN is the ARN of the IAM role to assume.
+	roleARN string,
+	// requestURL is the GitHub Actions ID token endpoint (ACTIONS_ID_TOKEN_REQUEST_URL).
+	requestURL string,
+	// requestToken is the bearer token to request the ID token with (ACTIONS_ID_TOKEN_REQUEST_TOKEN).
+	requestToken *dagger.Secret,
+	// audience is the audience of the ID token. Defaults to sts.amazonaws.com.
+	// +optional
+	audience string,
+	// awsRegion is the AWS region.
+	// +optional
+	awsRegion string,
+	// awsRoleSessionName is an optional name for the assumed role session.
+	// +optional
+	awsRoleSessionName string,
+) (*Infra, error) {
+	if requestToken == nil {
+		return nil, NewError("the GitHub Actions ID token request token (ACTIONS_ID_TOKEN_REQUEST_TOKEN) is required")
+	}
+
+	requestTokenValue, err := requestToken.Plaintext(ctx)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to read the GitHub Actions ID token request token")
+	}
+
+	client := &http.Client{Timeout: gitHubActionsOIDCRequestTimeout}
+
+	idToken, err := fetchGitHubActionsIDToken(ctx, client, requestURL, requestTokenValue, audience)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to fetch the GitHub Actions ID token")
+	}
+
+	oidcToken := dag.SetSecret(gitHubActionsOIDCTokenName+"_"+uuid.New().String(), idToken)
+
+	return m.WithAWSOIDC(ctx, roleARN, oidcToken, gitHubActionsOIDCTokenName, awsRegion, awsRoleSessionName)
+}
+
+// fetchGitHubActionsIDToken requests an ID token, for the given audience, from the GitHub Actions ID token endpoint.
+// Neither the request token, nor the ID token, are ever part of the returned errors.
+func fetchGitHubActionsIDToken(ctx context.Context, client *http.Client, requestURL, requestToken, audience string) (string, error) {
+	requestURL = strings.TrimSpace(requestURL)
+	if requestURL == "" {
+		return "", NewError("the GitHub Actions ID token request URL (ACTIONS_ID_TOKEN_REQUEST_URL) is required")
+	}
+
+	if strings.TrimSpace(requestToken) == "" {
+		return "", NewError("the GitHub Actions ID token request token (ACTIONS_ID_TOKEN_REQUEST_TOKEN) is empty")
+	}
+
+	if audience == "" {
+		audience = defaultGitHubActionsOIDCAudience
+	}
+
+	endpoint, err := url.Parse(requestURL)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return "", Errorf("invalid GitHub Actions ID token request URL %q", requestURL)
+	}
+
+	// The request URL already carries its own query (e.g., api-version), so the audience is appended to it.
+	query := endpoint.Query()
+	query.Set("audience", audience)
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to create the GitHub Actions ID token request")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+requestToken)
+	req.Header.Set("Accept", "application/json; api-version=2.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to request the GitHub Actions ID token from %s", endpoint.Host)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", Errorf("the GitHub Actions ID token endpoint %s returned status %d", endpoint.Host, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to read the GitHub Actions ID token response")
+	}
+
+	var tokenResp gitHubActionsIDTokenResponse
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", NewError("the GitHub Actions ID token response isn't valid JSON")
+	}
+
+	if strings.TrimSpace(tokenResp.Value) == "" {
+		return "", NewError("the GitHub Actions ID token response has no token value")
+	}
+
+	return strings.TrimSpace(tokenResp.Value), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchGitHubActionsIDToken(t *testing.T) {
+	const requestToken = "request-token"
+
+	testCases := []struct {
+		name         string
+		audience     string
+		status       int
+		body         string
+		wantAudience string
+		want         string
+		wantErr      string
+	}{
+		{
+			name:         "happy path",
+			audience:     "sts.amazonaws.com",
+			status:       http.StatusOK,
+			body:         `{"count": 1, "value": "id-token"}`,
+			wantAudience: "sts.amazonaws.com",
+			want:         "id-token",
+		},
+		{
+			name:         "default audience",
+			status:       http.StatusOK,
+			body:         `{"value": " id-token "}`,
+			wantAudience: defaultGitHubActionsOIDCAudience,
+			want:         "id-token",
+		},
+		{
+			name:    "non-200 response",
+			status:  http.StatusForbidden,
+			body:    `{"message": "forbidden"}`,
+			wantErr: "returned status 403",
+		},
+		{
+			name:    "missing value",
+			status:  http.StatusOK,
+			body:    `{"count": 0}`,
+			wantErr: "has no token value",
+		},
+		{
+			name:    "invalid JSON",
+			status:  http.StatusOK,
+			body:    `not json`,
+			wantErr: "isn't valid JSON",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer "+requestToken {
+					t.Errorf("unexpected Authorization header %q", got)
+				}
+
+				if got := r.URL.Query().Get("api-version"); got != "2.0" {
+					t.Errorf("expected the query of the request URL to be kept, got api-version %q", got)
+				}
+
+				if tc.wantAudience != "" && r.URL.Query().Get("audience") != tc.wantAudience {
+					t.Errorf("expected audience %q, got %q", tc.wantAudience, r.URL.Query().Get("audience"))
+				}
+
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			got, err := fetchGitHubActionsIDToken(context.Background(), server.Client(), server.URL+"/token?api-version=2.0", requestToken, tc.audience)
+
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected an error containing %q, got none", tc.wantErr)
+				}
+
+				if !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected an error containing %q, got %q", tc.wantErr, err.Error())
+				}
+
+				if strings.Contains(err.Error(), requestToken) {
+					t.Fatalf("the error has the request token: %q", err.Error())
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFetchGitHubActionsIDTokenRequiresRequestToken(t *testing.T) {
+	_, err := fetchGitHubActionsIDToken(context.Background(), http.DefaultClient, "https://token.actions.example.com", " ", "")
+	if err == nil || !strings.Contains(err.Error(), "ACTIONS_ID_TOKEN_REQUEST_TOKEN") {
+		t.Fatalf("expected an error about the missing request token, got %v", err)
+	}
+}
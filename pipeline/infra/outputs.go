@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	tgOutputsRedirectPath = "/tmp/terragrunt-outputs.json"
+	// maskedSensitiveValue replaces the sensitive values of the outputs, and inputs (see Catalog).
+	maskedSensitiveValue = "(sensitive value)"
+)
+
+// tfOutput is an output of a unit, as printed by terragrunt output -json.
+type tfOutput struct {
+	Sensitive bool            `json:"sensitive"`
+	Type      json.RawMessage `json:"type,omitempty"`
+	Value     json.RawMessage `json:"value"`
+}
+
+// unitOutputsResult is the result of reading the outputs of a unit.
+type unitOutputsResult struct {
+	Unit    string
+	WorkDir string
+	Outputs map[string]tfOutput
+	Err     error
+}
+
+// stackOutputs are the outputs of every unit of a stack, keyed by unit, and output name.
+type stackOutputs struct {
+	Environment string                         `json:"environment"`
+	Stack       string                         `json:"stack"`
+	Units       map[string]map[string]tfOutput `json:"units"`
+}
+
+// StackOutputs exports the outputs of every unit of a stack, as a single JSON document.
+//
+// It runs terragrunt output -json on each unit, and merges the results, keyed by unit. The values of
+// sensitive outputs are masked, unless showSensitive is set. The outputs are read from a file, instead
+// of the logs, so other pipelines can consume the document as it is.
+//
+// This function takes the following parameters:
+//   - ctx: The context for managing the operation's lifecycle.
+//   - stack: The stack to export the outputs of (e.g., "non-distributable", "domain", "landing-zone", "repositories").
+//   - environment: The environment to export the outputs of.
+//   - showSensitive: A flag to export the values of the sensitive outputs, instead of masking them.
+func (m *Infra) StackOutputs(
+	// Context is the context for managing the operation's lifecycle
+	// +optional
+	ctx context.Context,
+	// remoteStateBucket is the name of the bucket to use for the remote backend.
+	// +optional
+	remoteStateBucket string,
+	// remoteStateLockTable is the name of the lock table to use for the remote backend.
+	// +optional
+	remoteStateLockTable string,
+	// remoteStateRegion is the region of the remote state bucket.
+	// +optional
+	remoteStateRegion string,
+	// deploymentRegion is the AWS region to use for the remote backend.
+	// +optional
+	deploymentRegion string,
+	// awsAccessKeyID is the AWS access key ID.
+	// +optional
+	awsAccessKeyID *dagger.Secret,
+	// awsSecretAccessKey is the AWS secret access key.
+	// +optional
+	awsSecretAccessKey *dagger.Secret,
+	// awsSessionToken is the AWS session token.
+	// +optional
+	awsSessionToken *dagger.Secret,
+	// tfGitlabToken is the Terraform Gitlab token.
+	// +optional
+	tfGitlabToken *dagger.Secret,
+	// GitHubToken is the github token
+	// +optional
+	GitHubToken *dagger.Secret,
+	// loadDotEnvFile is a flag to enable source .env files from the local directory.
+	// +optional
+	loadDotEnvFile bool,
+	// NoCache is a flag to disable caching of the container.
+	// +optional
+	noCache bool,
+	// envVars are the environment variables to set in the container, as KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI (KEY=literal:VALUE keeps a value starting with env:, file:, secret: or literal: as it is).
+	// +optional
+	envVars []string,
+	// tgBinaryVersionOverride is the Terragrunt binary version to use.
+	// +optional
+	tgBinaryVersionOverride string,
+	// tfBinaryVersionOverride is the Terraform binary version to use.
+	// +optional
+	tfBinaryVersionOverride string,
+	// tfVersionFile is the Terraform version file to use. I'll generate a .terraform-version file in the working directory.
+	// +optional
+	tfVersionFile string,
+	// gitSSH is a flag to enable SSH for the container.
+	// +optional
+	gitSSH *dagger.Socket,
+	// tgLogLevel is the Terragrunt log level to use.
+	// +optional
+	tgLogLevel string,
+	// stack is the stack to export the outputs of.
+	stack string,
+	// environment is the environment to export the outputs of.
+	environment string,
+	// showSensitive exports the values of the sensitive outputs, instead of masking them.
+	// +optional
+	showSensitive bool,
+) (string, error) {
+	var remoteStateBucketName string
+	var remoteStateLockTableName string
+
+	if remoteStateBucket == "" && remoteStateLockTable == "" {
+		remoteStateBucketName = fmt.Sprintf("%s-%s", remoteStateDefaultBucketNamingConvention, environment)
+		remoteStateLockTableName = fmt.Sprintf("%s-%s", remoteStateDefaultLockTableNamingConvention, environment)
+	} else {
+		remoteStateBucketName = remoteStateBucket
+		remoteStateLockTableName = remoteStateLockTable
+	}
+
+	if remoteStateRegion == "" {
+		remoteStateRegion = defaultRemoteStateRegion
+	}
+
+	baseCtr, baseCtrErr := m.JobTg(ctx,
+		remoteStateBucketName,
+		remoteStateLockTableName,
+		remoteStateRegion,
+		deploymentRegion,
+		awsAccessKeyID,
+		awsSecretAccessKey,
+		awsSessionToken,
+		tfGitlabToken,
+		GitHubToken,
+		loadDotEnvFile,
+		noCache,
+		envVars,
+		tgBinaryVersionOverride,
+		tfBinaryVersionOverride,
+		tfVersionFile,
+		gitSSH,
+		tgLogLevel,
+		environment,
+		stack,
+	)
+
+	if baseCtrErr != nil {
+		return "", WrapErrorf(baseCtrErr, "failed to create base jobTg container for stack %s", stack)
+	}
+
+	cmdBuilder, err := newTgCmdBuilder(ctx, baseCtr)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to build the Terragrunt commands for stack %s", stack)
+	}
+
+	unitsList, exists := unitsPerStack[stack]
+	if !exists {
+		return "", Errorf("stack %s not found in unitsPerStack", stack)
+	}
+
+	totalUnits := getTotalUnitsPerStack(stack)
+	if totalUnits == 0 {
+		return "", Errorf("no units found for stack %s", stack)
+	}
+
+	var wg sync.WaitGroup
+
+	resultChan := make(chan unitOutputsResult, totalUnits)
+
+	for _, units := range unitsList {
+		for _, unit := range units {
+			wg.Add(1)
+
+			go func(unitName string) {
+				defer wg.Done()
+
+				tgWorkDir := getTerragruntExecutionPath(environment, stack, unitName)
+				readUnitOutputsAsync(ctx, resultChan, baseCtr, cmdBuilder, unitName, tgWorkDir)
+			}(unit)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	outputs := stackOutputs{
+		Environment: environment,
+		Stack:       stack,
+		Units:       make(map[string]map[string]tfOutput, totalUnits),
+	}
+
+	var errs []error
+
+	for result := range resultChan {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+
+			continue
+		}
+
+		if !showSensitive {
+			maskSensitiveOutputs(result.Outputs)
+		}
+
+		outputs.Units[result.Unit] = result.Outputs
+	}
+
+	if len(errs) > 0 {
+		return "", JoinErrors(errs...)
+	}
+
+	// Maps are marshalled with sorted keys, so the document is stable across runs.
+	outputsJSON, err := json.MarshalIndent(outputs, "", "  ")
+	if err != nil {
+		return "", WrapErrorf(err, "failed to marshal the outputs of stack %s", stack)
+	}
+
+	return string(outputsJSON), nil
+}
+
+// readUnitOutputsAsync reads the outputs of a unit, and sends them to the result channel. Stdout is
+// redirected to a file, so the values (sensitive ones included) aren't printed in the logs.
+func readUnitOutputsAsync(
+	ctx context.Context,
+	resultChan chan<- unitOutputsResult,
+	baseCtr *dagger.Container,
+	cmdBuilder *tgCmdBuilder,
+	unit string,
+	tgWorkDir string,
+) {
+	outputsRes := unitOutputsResult{Unit: unit, WorkDir: tgWorkDir}
+
+	execCtr := baseCtr.
+		WithExec(withWorkingDir(cmdBuilder.run("output", "-json"), tgWorkDir), dagger.ContainerWithExecOpts{
+			Expect:         dagger.ReturnTypeAny,
+			RedirectStdout: tgOutputsRedirectPath,
+		})
+
+	exitCode, err := execCtr.ExitCode(ctx)
+	if err != nil {
+		outputsRes.Err = WrapErrorf(err, "failed to read the outputs of unit %s on working directory: %s", unit, tgWorkDir)
+		resultChan <- outputsRes
+
+		return
+	}
+
+	if exitCode != 0 {
+		stderr, _ := execCtr.Stderr(ctx)
+		outputsRes.Err = Errorf("reading the outputs of unit %s on working directory %s failed (exit code %d): %s", unit, tgWorkDir, exitCode, stderr)
+		resultChan <- outputsRes
+
+		return
+	}
+
+	outputsContent, err := execCtr.File(tgOutputsRedirectPath).Contents(ctx)
+	if err != nil {
+		outputsRes.Err = WrapErrorf(err, "failed to read the outputs file of unit %s", unit)
+		resultChan <- outputsRes
+
+		return
+	}
+
+	outputs, err := parseUnitOutputs(outputsContent)
+	if err != nil {
+		outputsRes.Err = WrapErrorf(err, "failed to parse the outputs of unit %s", unit)
+		resultChan <- outputsRes
+
+		return
+	}
+
+	outputsRes.Outputs = outputs
+	resultChan <- outputsRes
+}
+
+// parseUnitOutputs parses the output of terragrunt output -json. Errors never include the content, since
+// it can have sensitive values.
+func parseUnitOutputs(content string) (map[string]tfOutput, error) {
+	content = strings.TrimSpace(content)
+
+	// A unit without state (e.g., never applied) has no outputs.
+	if content == "" {
+		return map[string]tfOutput{}, nil
+	}
+
+	outputsJSON, err := extractJSONDocument(content)
+	if err != nil {
+		return nil, fmt.Errorf("no JSON document found in the outputs")
+	}
+
+	outputs := map[string]tfOutput{}
+	if err := json.Unmarshal([]byte(outputsJSON), &outputs); err != nil {
+		return nil, fmt.Errorf("the outputs aren't a valid JSON document of outputs")
+	}
+
+	return outputs, nil
+}
+
+// maskSensitiveOutputs replaces the values of the sensitive outputs with a placeholder.
+func maskSensitiveOutputs(outputs map[string]tfOutput) {
+	maskedValue, _ := json.Marshal(maskedSensitiveValue)
+
+	for name, output := range outputs {
+		if output.Sensitive {
+			output.Value = maskedValue
+			outputs[name] = output
+		}
+	}
+}
+
+// extractJSONDocument returns the JSON object printed by a Terragrunt command, skipping the lines printed
+// before it (e.g., by run_cmd in the unit's configuration).
+func extractJSONDocument(content string) (string, error) {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "{") {
+		return content, nil
+	}
+
+	jsonStart := strings.Index(content, "\n{")
+	if jsonStart < 0 {
+		return "", errors.New("no JSON object found")
+	}
+
+	return content[jsonStart+1:], nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSOPSVersion      = "3.10.2"
+	sopsSrcMountPath        = "/tmp/sops-src"
+	sopsDecryptedOutputPath = "/tmp/sops-decrypted"
+	sopsAgeKeyEnvVar        = "SOPS_AGE_KEY"
+	// SOPS file formats, as they're decrypted and turned into secret variables.
+	sopsFormatDotEnv     = "dotenv"
+	sopsFormatTfvars     = "tfvars"
+	sopsFormatTfvarsJSON = "tfvars.json"
+	sopsFormatJSON       = "json"
+	// tfVarEnvVarPrefix is the prefix Terraform reads input variables from the environment with.
+	tfVarEnvVarPrefix = "TF_VAR_"
+	// tfvarsStringEscapes are the characters HCL accepts after a backslash, in a quoted string.
+	tfvarsStringEscapes = `nrt"\uU`
+)
+
+var (
+	// sopsFileGlobFilters are the files, in the root of the source directory, checked for SOPS encryption.
+	// Encrypted .env files are decrypted as part of the dot env layers (see parseDotEnvFiles).
+	sopsFileGlobFilters = []string{"*.tfvars", "*.json"}
+	envVarNameRegex     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	tfvarsAssignRegex   = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_-]*)\s*=\s*(.*)$`)
+)
+
+// sopsEncryptedFile represents a SOPS-encrypted file, found in the source directory.
+type sopsEncryptedFile struct {
+	Path   string // Path is the path of the file, relative to the source directory.
+	Format string // Format is how the file is decrypted, and turned into secret variables.
+}
+
+// getSOPSFileFormat returns the format of a file, based on its extension, and whether SOPS files of that format are supported.
+func getSOPSFileFormat(file string) (string, bool) {
+	switch {
+	case strings.HasSuffix(file, ".env"):
+		return sopsFormatDotEnv, true
+	case strings.HasSuffix(file, ".tfvars.json"):
+		return sopsFormatTfvarsJSON, true
+	case strings.HasSuffix(file, ".tfvars"):
+		return sopsFormatTfvars, true
+	case strings.HasSuffix(file, ".json"):
+		return sopsFormatJSON, true
+	default:
+		return "", false
+	}
+}
+
+// getSOPSInputType returns the SOPS input (and output) type to decrypt a file of the given format with.
+// SOPS has no HCL support, so .tfvars files are encrypted as binary files.
+func getSOPSInputType(format string) string {
+	switch format {
+	case sopsFormatDotEnv:
+		return "dotenv"
+	case sopsFormatTfvars:
+		return "binary"
+	default:
+		return "json"
+	}
+}
+
+// isSOPSEncrypted checks whether the content of a file of the given format was encrypted with SOPS, based on
+// the metadata SOPS adds to it: sops_* keys in dotenv files, and a top-level 'sops' object otherwise.
+func isSOPSEncrypted(content, format string) bool {
+	if format == sopsFormatDotEnv {
+		for _, line := range strings.Split(content, "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "sops_mac=") || strings.HasPrefix(line, "sops_version=") {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &document); err != nil {
+		return false
+	}
+
+	var metadata map[string]json.RawMessage
+	if err := json.Unmarshal(document["sops"], &metadata); err != nil {
+		return false
+	}
+
+	_, hasMAC := metadata["mac"]
+
+	return hasMAC
+}
+
+// findSOPSEncryptedFiles returns the SOPS-encrypted files in the root of the source directory.
+func findSOPSEncryptedFiles(ctx context.Context, src *dagger.Directory) ([]sopsEncryptedFile, error) {
+	var encryptedFiles []sopsEncryptedFile
+
+	for _, globFilter := range sopsFileGlobFilters {
+		files, err := src.Glob(ctx, globFilter)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to glob %s files", globFilter)
+		}
+
+		for _, file := range files {
+			format, supported := getSOPSFileFormat(file)
+			if !supported {
+				continue
+			}
+
+			content, err := src.File(file).Contents(ctx)
+			if err != nil {
+				return nil, WrapErrorf(err, "failed to read file %s", file)
+			}
+
+			if isSOPSEncrypted(content, format) {
+				encryptedFiles = append(encryptedFiles, sopsEncryptedFile{Path: file, Format: format})
+			}
+		}
+	}
+
+	return encryptedFiles, nil
+}
+
+// WithSOPSAgeKey sets the age key the jobs decrypt the SOPS-encrypted .env, .tfvars and .json files with,
+// when they load the .env files (see WithDotEnvFile).
+//
+// Parameters:
+//   - ageKey: The age key (AGE-SECRET-KEY-...).
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the age key set
+func (m *Infra) WithSOPSAgeKey(
+	// ageKey is the age key (AGE-SECRET-KEY-...).
+	ageKey *dagger.Secret,
+) *Infra {
+	m.SOPSAgeKey = ageKey
+
+	return m
+}
+
+// sopsDecrypter decrypts SOPS-encrypted files of a source directory, inside a container.
+//
+// The files are decrypted inside a separate container, with the age key set as SOPS_AGE_KEY, and the
+// decrypted content is written to a file that's read back, so it's never printed, nor kept in the container
+// Terragrunt runs in.
+type sopsDecrypter struct {
+	ctr *dagger.Container
+}
+
+// newSOPSDecrypter returns a decrypter for the files of the source directory. Without an age key, it fails
+// to decrypt any file, with an error that explains it.
+func newSOPSDecrypter(container *dagger.Container, src *dagger.Directory, sopsAgeKey *dagger.Secret) *sopsDecrypter {
+	if sopsAgeKey == nil {
+		return &sopsDecrypter{}
+	}
+
+	return &sopsDecrypter{
+		ctr: container.
+			WithExec([]string{"sh", "-c", getSOPSInstallationCommand(defaultSOPSVersion)}).
+			WithMountedDirectory(sopsSrcMountPath, src).
+			WithSecretVariable(sopsAgeKeyEnvVar, sopsAgeKey),
+	}
+}
+
+// decrypt decrypts a file of the source directory, and returns its decrypted content.
+func (d *sopsDecrypter) decrypt(ctx context.Context, file, format string) (string, error) {
+	if d == nil || d.ctr == nil {
+		return "", Errorf("the file %s is encrypted with SOPS, but no age key was passed to decrypt it", file)
+	}
+
+	inputType := getSOPSInputType(format)
+
+	decryptCtr := d.ctr.
+		WithExec([]string{
+			"sops", "--decrypt",
+			"--input-type", inputType,
+			"--output-type", inputType,
+			filepath.Join(sopsSrcMountPath, file),
+		}, dagger.ContainerWithExecOpts{
+			RedirectStdout: sopsDecryptedOutputPath,
+			Expect:         dagger.ReturnTypeAny,
+		})
+
+	exitCode, err := decryptCtr.ExitCode(ctx)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to decrypt the SOPS file %s", file)
+	}
+
+	if exitCode != 0 {
+		stderr, _ := decryptCtr.Stderr(ctx)
+
+		return "", Errorf("failed to decrypt the SOPS file %s: %s", file, strings.TrimSpace(stderr))
+	}
+
+	decrypted, err := decryptCtr.File(sopsDecryptedOutputPath).Contents(ctx)
+	if err != nil {
+		return "", WrapErrorf(err, "failed to read the decrypted SOPS file %s", file)
+	}
+
+	return decrypted, nil
+}
+
+// withSOPSDecryptedFiles decrypts SOPS-encrypted files, and sets every decrypted value as a secret variable.
+// Values from .tfvars and .tfvars.json files are set as TF_VAR_<name>.
+func withSOPSDecryptedFiles(
+	ctx context.Context,
+	container *dagger.Container,
+	encryptedFiles []sopsEncryptedFile,
+	decrypter *sopsDecrypter,
+) (*dagger.Container, error) {
+	for _, encryptedFile := range encryptedFiles {
+		decrypted, err := decrypter.decrypt(ctx, encryptedFile.Path, encryptedFile.Format)
+		if err != nil {
+			return nil, err
+		}
+
+		envVars, err := getSOPSDecryptedEnvVars(encryptedFile, decrypted)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, envVar := range envVars {
+			secretName := fmt.Sprintf("%s_sops_%s", envVar.Key, encryptedFile.Path)
+			container = container.WithSecretVariable(envVar.Key, dag.SetSecret(secretName, envVar.Value))
+		}
+	}
+
+	return container, nil
+}
+
+// getSOPSDecryptedEnvVars turns the decrypted content of a SOPS file into the variables to set.
+// The decrypted values are never part of the returned errors.
+func getSOPSDecryptedEnvVars(encryptedFile sopsEncryptedFile, decrypted string) ([]EnvVarDagger, error) {
+	switch encryptedFile.Format {
+	case sopsFormatDotEnv:
+		return parseDotEnvContent(encryptedFile.Path, decrypted, nil)
+	case sopsFormatTfvars:
+		return parseTfvarsContent(encryptedFile.Path, decrypted)
+	default:
+		return parseJSONEnvVars(encryptedFile.Path, decrypted, encryptedFile.Format == sopsFormatTfvarsJSON)
+	}
+}
+
+// parseJSONEnvVars turns the top-level keys of a JSON document into variables; values that aren't strings are
+// kept as JSON (which Terraform reads as HCL for complex types). With asTfVars, variables are set as TF_VAR_<key>.
+func parseJSONEnvVars(file, content string, asTfVars bool) ([]EnvVarDagger, error) {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &document); err != nil {
+		return nil, Errorf("the decrypted SOPS file %s isn't a JSON object", file)
+	}
+
+	// Keys are sorted, so the variables are always set in the same order, and the container stays cacheable.
+	keys := make([]string, 0, len(document))
+	for key := range document {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	envVars := make([]EnvVarDagger, 0, len(document))
+	for _, key := range keys {
+		raw := document[key]
+		if asTfVars {
+			key = tfVarEnvVarPrefix + key
+		}
+
+		if !envVarNameRegex.MatchString(key) {
+			return nil, Errorf("the key %q in the decrypted SOPS file %s isn't a valid environment variable name", key, file)
+		}
+
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			value = string(raw)
+		}
+
+		envVars = append(envVars, EnvVarDagger{Key: key, Value: value})
+	}
+
+	return envVars, nil
+}
+
+// parseTfvarsContent turns the assignments of a .tfvars file into TF_VAR_<name> variables.
+//
+// Strings are unquoted, while lists, maps and other expressions are kept as they are (including when they span
+// several lines), since Terraform parses TF_VAR_ values of complex types as HCL. Heredocs are supported too.
+func parseTfvarsContent(file, content string) ([]EnvVarDagger, error) {
+	var envVars []EnvVarDagger
+
+	lines := strings.Split(content, "\n")
+	for idx := 0; idx < len(lines); idx++ {
+		line := strings.TrimSpace(lines[idx])
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		matches := tfvarsAssignRegex.FindStringSubmatch(line)
+		if matches == nil {
+			// The line itself isn't part of the error, since it's decrypted content.
+			return nil, Errorf("invalid assignment in the decrypted SOPS file %s on line %d", file, idx+1)
+		}
+
+		name, value := matches[1], strings.TrimSpace(matches[2])
+		startLine := idx + 1
+
+		switch {
+		case strings.HasPrefix(value, "<<"):
+			delimiter := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(value, "<<"), "-"))
+			var heredoc []string
+
+			for idx++; idx < len(lines) && strings.TrimSpace(lines[idx]) != delimiter; idx++ {
+				heredoc = append(heredoc, lines[idx])
+			}
+
+			if idx >= len(lines) {
+				return nil, Errorf("unterminated heredoc in the decrypted SOPS file %s, starting on line %d", file, startLine)
+			}
+
+			value = strings.Join(heredoc, "\n")
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := unquoteTfvarsString(stripTfvarsComment(value))
+			if err != nil {
+				return nil, Errorf("invalid string in the decrypted SOPS file %s on line %d: %s", file, startLine, err)
+			}
+
+			value = unquoted
+		default:
+			// Lists, maps, and other expressions, can span several lines until their brackets are balanced.
+			value = stripTfvarsComment(value)
+			depth := getBracketsDepth(value)
+			for depth > 0 && idx+1 < len(lines) {
+				idx++
+				nextLine := stripTfvarsComment(lines[idx])
+				value += "\n" + nextLine
+				depth += getBracketsDepth(nextLine)
+			}
+
+			if depth != 0 {
+				return nil, Errorf("unbalanced brackets in the decrypted SOPS file %s, starting on line %d", file, startLine)
+			}
+		}
+
+		envVars = append(envVars, EnvVarDagger{Key: tfVarEnvVarPrefix + name, Value: value})
+	}
+
+	return envVars, nil
+}
+
+// getBracketsDepth returns how many brackets ([ and {) a line opens, minus the ones it closes, ignoring strings.
+func getBracketsDepth(line string) int {
+	depth := 0
+	inString := false
+
+	for idx := 0; idx < len(line); idx++ {
+		switch char := line[idx]; {
+		case inString && char == '\\':
+			idx++
+		case char == '"':
+			inString = !inString
+		case inString:
+			continue
+		case char == '[' || char == '{':
+			depth++
+		case char == ']' || char == '}':
+			depth--
+		}
+	}
+
+	return depth
+}
+
+// stripTfvarsComment removes the trailing comment (# or //) of a line, ignoring the ones inside strings.
+func stripTfvarsComment(line string) string {
+	inString := false
+
+	for idx := 0; idx < len(line); idx++ {
+		switch char := line[idx]; {
+		case inString && char == '\\':
+			idx++
+		case char == '"':
+			inString = !inString
+		case inString:
+			continue
+		case char == '#' || (char == '/' && strings.HasPrefix(line[idx:], "//")):
+			return strings.TrimSpace(line[:idx])
+		}
+	}
+
+	return strings.TrimSpace(line)
+}
+
+// unquoteTfvarsString unquotes a .tfvars string. Interpolations and template directives can't be
+// evaluated outside Terraform, so they're rejected, while their escaped forms ($${ and %%{) are kept
+// as literals. Only the escapes HCL supports (\n, \r, \t, \", \\, \uNNNN and \UNNNNNNNN) are accepted,
+// since Terraform rejects the others (e.g., \x or \a). The returned errors never include the value, since
+// it's decrypted content.
+func unquoteTfvarsString(value string) (string, error) {
+	for idx := 0; idx+1 < len(value); idx++ {
+		if value[idx] == '\\' {
+			if !strings.ContainsRune(tfvarsStringEscapes, rune(value[idx+1])) {
+				return "", fmt.Errorf("only the \\n, \\r, \\t, \\\", \\\\, \\uNNNN and \\UNNNNNNNN escapes are supported")
+			}
+
+			idx++
+
+			continue
+		}
+
+		if (value[idx] != '$' && value[idx] != '%') || value[idx+1] != '{' {
+			continue
+		}
+
+		if idx > 0 && value[idx-1] == value[idx] {
+			continue
+		}
+
+		return "", fmt.Errorf("interpolations (${...}) and template directives (%%{...}) aren't supported")
+	}
+
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("the string isn't a single double-quoted value")
+	}
+
+	return strings.NewReplacer("$${", "${", "%%{", "%{").Replace(unquoted), nil
+}
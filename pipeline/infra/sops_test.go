@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTfvarsContent(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "strings and numbers",
+			content: "# comment\n// comment\nregion = \"eu-west-1\"\ncount = 3 # trailing\n\nenabled=true",
+			want:    map[string]string{"TF_VAR_region": "eu-west-1", "TF_VAR_count": "3", "TF_VAR_enabled": "true"},
+		},
+		{
+			name:    "string with comment markers",
+			content: `url = "https://example.com/#anchor" // comment`,
+			want:    map[string]string{"TF_VAR_url": "https://example.com/#anchor"},
+		},
+		{
+			name:    "multi-line list and map",
+			content: "subnets = [\n  \"a\", # first\n  \"b]\",\n]\ntags = {\n  team = \"infra\"\n}",
+			want:    map[string]string{"TF_VAR_subnets": "[\n\"a\",\n\"b]\",\n]", "TF_VAR_tags": "{\nteam = \"infra\"\n}"},
+		},
+		{
+			name:    "heredoc",
+			content: "policy = <<-EOT\n  line one\n  line two\n  EOT\nname = \"x\"",
+			want:    map[string]string{"TF_VAR_policy": "  line one\n  line two", "TF_VAR_name": "x"},
+		},
+		{
+			name:    "invalid assignment",
+			content: "not an assignment",
+			wantErr: "invalid assignment",
+		},
+		{
+			name:    "unterminated heredoc",
+			content: "policy = <<EOT\nline",
+			wantErr: "unterminated heredoc",
+		},
+		{
+			name:    "unbalanced brackets",
+			content: "subnets = [\n\"a\"",
+			wantErr: "unbalanced brackets",
+		},
+		{
+			name:    "invalid string",
+			content: `token = "s3cr3t\x41"`,
+			wantErr: "invalid string",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			envVars, err := parseTfvarsContent("secrets.tfvars", tc.content)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+				}
+
+				if strings.Contains(err.Error(), "s3cr3t") {
+					t.Fatalf("the error has the decrypted content: %q", err.Error())
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := map[string]string{}
+			for _, envVar := range envVars {
+				got[envVar.Key] = envVar.Value
+			}
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %d variables, got %d: %v", len(tc.want), len(got), got)
+			}
+
+			for key, value := range tc.want {
+				if got[key] != value {
+					t.Errorf("expected %s=%q, got %q", key, value, got[key])
+				}
+			}
+		})
+	}
+}
+
+func TestUnquoteTfvarsString(t *testing.T) {
+	testCases := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", value: `"value"`, want: "value"},
+		{name: "HCL escapes", value: `"a\"b\\c\nd\re\tf"`, want: "a\"b\\c\nd\re\tf"},
+		{name: "unicode escapes", value: `"é\U0001F600"`, want: "é😀"},
+		{name: "escaped interpolation", value: `"$${var.x} %%{if}"`, want: "${var.x} %{if}"},
+		{name: "escaped backslash before a dollar", value: `"\\$$"`, want: `\$$`},
+		{name: "interpolation", value: `"${var.x}"`, wantErr: true},
+		{name: "template directive", value: `"%{if true}x%{endif}"`, wantErr: true},
+		{name: "hex escape", value: `"\x41"`, wantErr: true},
+		{name: "bell escape", value: `"\a"`, wantErr: true},
+		{name: "single quote escape", value: `"\'"`, wantErr: true},
+		{name: "octal escape", value: `"\101"`, wantErr: true},
+		{name: "unterminated", value: `"value`, wantErr: true},
+		{name: "several strings", value: `"a" "b"`, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := unquoteTfvarsString(tc.value)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestStripTfvarsComment(t *testing.T) {
+	testCases := []struct {
+		line string
+		want string
+	}{
+		{line: `"value" # comment`, want: `"value"`},
+		{line: `"value" // comment`, want: `"value"`},
+		{line: `"a # b" # comment`, want: `"a # b"`},
+		{line: `"a \" // b"`, want: `"a \" // b"`},
+		{line: `3 / 4`, want: `3 / 4`},
+		{line: `  [1, 2]  `, want: `[1, 2]`},
+	}
+
+	for _, tc := range testCases {
+		if got := stripTfvarsComment(tc.line); got != tc.want {
+			t.Errorf("stripTfvarsComment(%q): expected %q, got %q", tc.line, tc.want, got)
+		}
+	}
+}
+
+func TestGetBracketsDepth(t *testing.T) {
+	testCases := []struct {
+		line string
+		want int
+	}{
+		{line: `[`, want: 1},
+		{line: `{ a = [1, 2`, want: 2},
+		{line: `]}`, want: -2},
+		{line: `["]", "{"`, want: 1},
+		{line: `["a\"]"]`, want: 0},
+		{line: `plain`, want: 0},
+	}
+
+	for _, tc := range testCases {
+		if got := getBracketsDepth(tc.line); got != tc.want {
+			t.Errorf("getBracketsDepth(%q): expected %d, got %d", tc.line, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"dagger/infra/internal/dagger"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	configSSHRootPath        = "/root/.ssh"
+	configSSHKnownHostsPath  = "/root/.ssh/known_hosts"
+	configSSHDeployKeyPath   = "/root/.ssh/id_deploy"
+	defaultSSHPort           = 22
+	sshPrivateKeyBeginMarker = "-----BEGIN "
+	sshPrivateKeyEndMarker   = "PRIVATE KEY-----"
+)
+
+// sshHostRegex matches a hostname, or an IPv4 address, of a Git host reachable through SSH.
+var sshHostRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+// sshHost is a Git host reachable through SSH, on a given port.
+type sshHost struct {
+	Host string
+	Port int
+}
+
+// knownHostsPattern returns the pattern the host is written as, in the known_hosts file.
+func (h sshHost) knownHostsPattern() string {
+	if h.Port == defaultSSHPort {
+		return h.Host
+	}
+
+	return fmt.Sprintf("[%s]:%d", h.Host, h.Port)
+}
+
+// WithSSHKnownHosts adds the host keys of Git hosts reachable through SSH to the known_hosts file.
+//
+// When knownHosts is passed (the content of a known_hosts file, e.g., from ssh-keyscan run once on a
+// trusted machine), the host keys are pinned: they're written as they are, and each host must have
+// an entry in them, so no host key is trusted on first use. Otherwise, the host keys are fetched
+// with ssh-keyscan.
+//
+// Parameters:
+//   - hosts: The Git hosts, as HOST or HOST:PORT (e.g., gitlab.mycorp.internal:2222).
+//   - knownHosts: Optional. The pinned known_hosts content of the hosts.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the known hosts added
+//   - error: An error if a host is malformed, or has no entry in the pinned known_hosts content
+func (m *Infra) WithSSHKnownHosts(
+	// hosts are the Git hosts, as HOST or HOST:PORT (e.g., gitlab.mycorp.internal:2222).
+	// +optional
+	hosts []string,
+	// knownHosts is the pinned known_hosts content of the hosts. Without it, host keys are fetched with ssh-keyscan.
+	// +optional
+	knownHosts string,
+) (*Infra, error) {
+	sshHosts, err := getSSHHosts(hosts)
+	if err != nil {
+		return nil, WrapError(err, "failed to parse the SSH hosts")
+	}
+
+	m.Ctr = m.Ctr.WithExec([]string{"mkdir", "-p", configSSHRootPath})
+
+	if strings.TrimSpace(knownHosts) != "" {
+		for _, host := range sshHosts {
+			if !knownHostsHasEntry(knownHosts, host) {
+				return nil, Errorf("SSH host %s has no entry in the pinned known_hosts", host.knownHostsPattern())
+			}
+		}
+
+		if !strings.HasSuffix(knownHosts, "\n") {
+			knownHosts += "\n"
+		}
+
+		// Pinned host keys are appended, so they're kept along with the ones added before.
+		m.Ctr = m.Ctr.
+			WithNewFile("/tmp/known_hosts.pinned", knownHosts).
+			WithExec([]string{"sh", "-c", fmt.Sprintf("cat /tmp/known_hosts.pinned >> %s && rm /tmp/known_hosts.pinned", configSSHKnownHostsPath)})
+	} else {
+		for _, host := range sshHosts {
+			m.Ctr = m.Ctr.
+				WithExec([]string{"sh", "-c", fmt.Sprintf("ssh-keyscan -p %d %s >> %s", host.Port, host.Host, configSSHKnownHostsPath)})
+		}
+	}
+
+	m.Ctr = m.Ctr.
+		WithExec([]string{"touch", configSSHKnownHostsPath}).
+		WithExec([]string{"chmod", "600", configSSHKnownHostsPath})
+
+	return m, nil
+}
+
+// WithSSHDeployKey configures SSH authentication with a private deploy key, for runners without an SSH agent.
+//
+// The key is mounted as a secret file only readable by its owner, and Git uses it through GIT_SSH_COMMAND,
+// only with the host keys of the known_hosts file (see WithSSHKnownHosts), so unknown hosts are rejected.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - deployKey: The private deploy key (e.g., an OpenSSH ed25519 key).
+//
+// Returns:
+//   - *Infra: The updated Infra instance with SSH authentication configured with the deploy key
+//   - error: An error if the deploy key isn't a private key
+func (m *Infra) WithSSHDeployKey(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// deployKey is the private deploy key (e.g., an OpenSSH ed25519 key).
+	deployKey *dagger.Secret,
+) (*Infra, error) {
+	if deployKey == nil {
+		return nil, NewError("the SSH deploy key is required")
+	}
+
+	deployKeyValue, err := deployKey.Plaintext(ctx)
+	if err != nil {
+		return nil, WrapError(err, "failed to read the SSH deploy key")
+	}
+
+	// The value itself isn't part of the error, since it's a secret.
+	if !strings.Contains(deployKeyValue, sshPrivateKeyBeginMarker) || !strings.Contains(deployKeyValue, sshPrivateKeyEndMarker) {
+		return nil, NewError("the SSH deploy key must be a private key, in the PEM, or OpenSSH, format")
+	}
+
+	// ssh refuses keys without a trailing newline, which is easily lost when the key is passed through a variable.
+	// The new secret is named after the one passed, so its name, and the cache, are stable across runs.
+	if !strings.HasSuffix(deployKeyValue, "\n") {
+		deployKeyName, err := deployKey.Name(ctx)
+		if err != nil {
+			return nil, WrapError(err, "failed to read the name of the SSH deploy key")
+		}
+
+		deployKey = dag.SetSecret(fmt.Sprintf("ssh_deploy_key_%s", getSHA256Hex(deployKeyName)[:secretNameHashLength]), deployKeyValue+"\n")
+	}
+
+	gitSSHCommand := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s",
+		configSSHDeployKeyPath, configSSHKnownHostsPath)
+
+	//nolint:exhaustruct // Only the mode is relevant for the deploy key.
+	m.Ctr = m.Ctr.
+		WithExec([]string{"mkdir", "-p", configSSHRootPath}).
+		WithMountedSecret(configSSHDeployKeyPath, deployKey, dagger.ContainerWithMountedSecretOpts{Mode: 0o400}).
+		WithEnvVariable("GIT_SSH_COMMAND", gitSSHCommand)
+
+	return m, nil
+}
+
+// getSSHHosts parses the SSH hosts passed as HOST or HOST:PORT. The port defaults to 22.
+func getSSHHosts(hosts []string) ([]sshHost, error) {
+	sshHosts := make([]sshHost, 0, len(hosts))
+
+	for idx, entry := range hosts {
+		entry = strings.TrimSpace(entry)
+		host, portValue, hasPort := strings.Cut(entry, ":")
+
+		if !sshHostRegex.MatchString(host) {
+			return nil, fmt.Errorf("SSH host at position %d, %q, must be a hostname, as HOST or HOST:PORT", idx, entry)
+		}
+
+		port := defaultSSHPort
+
+		if hasPort {
+			parsedPort, err := strconv.Atoi(portValue)
+			if err != nil || parsedPort < 1 || parsedPort > 65535 {
+				return nil, fmt.Errorf("SSH host at position %d, %q, has an invalid port, it must be between 1 and 65535", idx, entry)
+			}
+
+			port = parsedPort
+		}
+
+		sshHosts = append(sshHosts, sshHost{Host: host, Port: port})
+	}
+
+	return sshHosts, nil
+}
+
+// knownHostsHasEntry checks whether the known_hosts content has an entry for the host. Hashed entries
+// (|1|salt|hash) are matched with the HMAC-SHA1 of the host name (host, or [host]:port), keyed with their salt.
+func knownHostsHasEntry(knownHosts string, host sshHost) bool {
+	pattern := host.knownHostsPattern()
+
+	for _, line := range strings.Split(knownHosts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// Markers (@cert-authority, @revoked) come before the host patterns; revoked keys don't pin the host.
+		hostPatterns := fields[0]
+		if strings.HasPrefix(hostPatterns, "@") {
+			if hostPatterns == "@revoked" {
+				continue
+			}
+
+			hostPatterns = fields[1]
+		}
+
+		if strings.HasPrefix(hostPatterns, "|1|") {
+			if hashedKnownHostMatches(hostPatterns, pattern) {
+				return true
+			}
+
+			continue
+		}
+
+		for _, hostPattern := range strings.Split(hostPatterns, ",") {
+			if strings.EqualFold(hostPattern, pattern) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hashedKnownHostMatches checks whether a hashed known_hosts entry (|1|base64(salt)|base64(hash)) is the
+// one of the host name, as ssh-keygen -H hashes it: HMAC-SHA1 of the lowercase host name, keyed with the salt.
+func hashedKnownHostMatches(hashedHost, hostName string) bool {
+	parts := strings.Split(strings.TrimPrefix(hashedHost, "|1|"), "|")
+	if len(parts) != 2 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(strings.ToLower(hostName)))
+
+	return hmac.Equal(mac.Sum(nil), hash)
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestKnownHostsHasEntry(t *testing.T) {
+	// The hashed entries are the ones of github.com and [git.example.com]:2222, hashed with ssh-keygen -H.
+	const hostKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHotMs7id21Hd3cpMeA/noo1gFr94Z4zoWGnFScAu2zR"
+
+	hashedKnownHosts := "|1|YTzse8mJCxeh+AtObcTnJjE98Gg=|JfN7AfvwqYVwNWddyoo+psMKpY4= " + hostKey + "\n" +
+		"|1|AvKAYmgC79RYItj3XjPcnm9mypk=|rlM1CMAxjq0kW5ckK9ajPBAH0Jk= " + hostKey + "\n"
+
+	testCases := []struct {
+		name       string
+		knownHosts string
+		host       sshHost
+		want       bool
+	}{
+		{name: "plain entry", knownHosts: "gitlab.com,1.2.3.4 " + hostKey, host: sshHost{Host: "gitlab.com", Port: 22}, want: true},
+		{name: "plain entry with port", knownHosts: "[git.example.com]:2222 " + hostKey, host: sshHost{Host: "git.example.com", Port: 2222}, want: true},
+		{name: "plain entry on another port", knownHosts: "git.example.com " + hostKey, host: sshHost{Host: "git.example.com", Port: 2222}, want: false},
+		{name: "cert authority", knownHosts: "@cert-authority gitlab.com " + hostKey, host: sshHost{Host: "gitlab.com", Port: 22}, want: true},
+		{name: "revoked key", knownHosts: "@revoked gitlab.com " + hostKey, host: sshHost{Host: "gitlab.com", Port: 22}, want: false},
+		{name: "hashed entry", knownHosts: hashedKnownHosts, host: sshHost{Host: "github.com", Port: 22}, want: true},
+		{name: "hashed entry with port", knownHosts: hashedKnownHosts, host: sshHost{Host: "git.example.com", Port: 2222}, want: true},
+		{name: "hashed entry of another host", knownHosts: hashedKnownHosts, host: sshHost{Host: "gitlab.com", Port: 22}, want: false},
+		{name: "malformed hashed entry", knownHosts: "|1|not-base64|x " + hostKey, host: sshHost{Host: "github.com", Port: 22}, want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := knownHostsHasEntry(tc.knownHosts, tc.host); got != tc.want {
+				t.Fatalf("expected %t, got %t", tc.want, got)
+			}
+		})
+	}
+}
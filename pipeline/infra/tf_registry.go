@@ -0,0 +1,72 @@
+package main
+
+import (
+	"dagger/infra/internal/dagger"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultTerraformRegistryHost = "app.terraform.io"
+	terraformTokenEnvVarPrefix   = "TF_TOKEN_"
+)
+
+// terraformRegistryHostRegex matches a hostname Terraform can read a token for, from its environment:
+// dot-separated labels of letters, digits and hyphens, with no port, nor path.
+var terraformRegistryHostRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// WithTerraformRegistryToken sets the token of a Terraform registry (or Terraform Cloud) host in the container.
+//
+// Terraform reads the token of a host from the TF_TOKEN_<host> environment variable, where dots of the
+// hostname are encoded as underscores, and hyphens as double underscores (e.g., gitlab.my-corp.internal
+// is read from TF_TOKEN_gitlab_my__corp_internal). It can be called once per host, to set several of them.
+//
+// Parameters:
+//   - host: The hostname of the registry (e.g., gitlab.mycorp.internal, app.terraform.io).
+//   - token: The token to authenticate on the registry with.
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the registry token set
+//   - error: An error if the hostname can't be encoded as an environment variable name
+func (m *Infra) WithTerraformRegistryToken(
+	// host is the hostname of the registry (e.g., gitlab.mycorp.internal, app.terraform.io).
+	host string,
+	// token is the token to authenticate on the registry with.
+	token *dagger.Secret,
+) (*Infra, error) {
+	if token == nil {
+		return nil, Errorf("the token of the Terraform registry %s is required", host)
+	}
+
+	tokenEnvVar, err := getTerraformRegistryTokenEnvVar(host)
+	if err != nil {
+		return nil, WrapError(err, "invalid Terraform registry host")
+	}
+
+	m.Ctr = m.Ctr.
+		WithSecretVariable(tokenEnvVar, token)
+
+	return m, nil
+}
+
+// getTerraformRegistryTokenEnvVar returns the environment variable Terraform reads the token of a host
+// from: TF_TOKEN_ followed by the hostname, with dots encoded as underscores, and hyphens as double
+// underscores. Internationalized hostnames must be passed in their punycode (xn--) form.
+func getTerraformRegistryTokenEnvVar(host string) (string, error) {
+	normalizedHost := strings.ToLower(strings.TrimSpace(host))
+
+	if normalizedHost == "" {
+		return "", fmt.Errorf("the Terraform registry host is required")
+	}
+
+	if !terraformRegistryHostRegex.MatchString(normalizedHost) {
+		return "", fmt.Errorf("Terraform registry host %q must be a hostname (e.g., app.terraform.io), with no scheme, port, nor path; "+
+			"internationalized hostnames must be in their punycode (xn--) form", host)
+	}
+
+	encodedHost := strings.ReplaceAll(normalizedHost, "-", "__")
+	encodedHost = strings.ReplaceAll(encodedHost, ".", "_")
+
+	return terraformTokenEnvVarPrefix + encodedHost, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// tgCLIRedesignVersion is the first Terragrunt version with the redesigned CLI (run --all, hcl fmt,
+// hcl validate, info print, render, etc.) out of the experiment, where the legacy commands are deprecated.
+var tgCLIRedesignVersion = tgVersion{Major: 0, Minor: 78, Patch: 0}
+
+var tgVersionRegex = regexp.MustCompile(`v?(\d+)\.(\d+)\.(\d+)`)
+
+// tgLegacyCommands maps the legacy Terragrunt commands to their redesigned CLI form.
+var tgLegacyCommands = map[string][]string{
+	"run-all":            {"run", "--all"},
+	"hclfmt":             {"hcl", "fmt"},
+	"hclvalidate":        {"hcl", "validate"},
+	"validate-inputs":    {"hcl", "validate", "--inputs"},
+	"terragrunt-info":    {"info", "print"},
+	"render-json":        {"render", "--json", "--write"},
+	"graph-dependencies": {"dag", "graph"},
+}
+
+// tgVersion is a Terragrunt version (e.g., 0.80.2).
+type tgVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// String returns the version as vMAJOR.MINOR.PATCH.
+func (v tgVersion) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// atLeast checks whether the version is the same as, or newer than, the other one.
+func (v tgVersion) atLeast(other tgVersion) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+
+	if v.Minor != other.Minor {
+		return v.Minor > other.Minor
+	}
+
+	return v.Patch >= other.Patch
+}
+
+// tgCmdBuilder builds Terragrunt commands with the syntax of the installed Terragrunt version, so
+// upgrading it (e.g., with tgBinaryVersionOverride) doesn't break the jobs on removed commands.
+type tgCmdBuilder struct {
+	version tgVersion
+}
+
+// newTgCmdBuilder returns a command builder for the Terragrunt version installed in the container.
+func newTgCmdBuilder(ctx context.Context, ctr *dagger.Container) (*tgCmdBuilder, error) {
+	versionOut, err := ctr.
+		WithExec([]string{"terragrunt", "--version"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, WrapError(err, "failed to get the installed Terragrunt version")
+	}
+
+	version, err := parseTerragruntVersion(versionOut)
+	if err != nil {
+		// Builds without a release version (e.g., dev builds) are recent ones, hence the redesigned CLI.
+		version = tgCLIRedesignVersion
+	}
+
+	return newTgCmdBuilderForVersion(version), nil
+}
+
+// newTgCmdBuilderForVersion returns a command builder for the given Terragrunt version.
+func newTgCmdBuilderForVersion(version tgVersion) *tgCmdBuilder {
+	return &tgCmdBuilder{version: version}
+}
+
+// usesRedesignedCLI checks whether the Terragrunt version has the redesigned CLI.
+func (b *tgCmdBuilder) usesRedesignedCLI() bool {
+	return b.version.atLeast(tgCLIRedesignVersion)
+}
+
+// run returns the command that runs a Terragrunt (or OpenTofu/Terraform) command on a single unit,
+// e.g., run("plan", "-detailed-exitcode"). Legacy commands (see tgLegacyCommands) are translated to
+// the redesigned CLI, when the version has it.
+func (b *tgCmdBuilder) run(args ...string) []string {
+	if len(args) > 0 && b.usesRedesignedCLI() {
+		if redesigned, isLegacy := tgLegacyCommands[args[0]]; isLegacy {
+			return append(append([]string{"terragrunt"}, redesigned...), args[1:]...)
+		}
+	}
+
+	return append([]string{"terragrunt"}, args...)
+}
+
+// runAll returns the command that runs a command on every unit of the working directory, in the
+// order of their dependencies, e.g., runAll("apply", "-auto-approve").
+func (b *tgCmdBuilder) runAll(args ...string) []string {
+	return b.run(append([]string{"run-all"}, args...)...)
+}
+
+// info returns the command that prints the Terragrunt information of a unit (e.g., its download dir).
+func (b *tgCmdBuilder) info() []string {
+	return b.run("terragrunt-info")
+}
+
+// hclFmtCheck returns the command that checks the HCL files are formatted, showing the diff if not.
+func (b *tgCmdBuilder) hclFmtCheck() []string {
+	return b.run("hclfmt", "--check", "--diff")
+}
+
+// hclValidate returns the command that validates the HCL configuration, showing the paths of invalid files.
+func (b *tgCmdBuilder) hclValidate() []string {
+	return b.run("hclvalidate", "--show-config-path")
+}
+
+// validateInputs returns the command that checks the inputs of a unit match the variables of its module.
+func (b *tgCmdBuilder) validateInputs() []string {
+	return b.run("validate-inputs")
+}
+
+// dependencyGraph returns the command that prints the dependency graph of the units of the working
+// directory, in the DOT format.
+func (b *tgCmdBuilder) dependencyGraph() []string {
+	return b.run("graph-dependencies")
+}
+
+// renderJSON returns the command that writes the resolved configuration of a unit, as JSON, to the
+// given file. The flag of the output file was renamed with the redesigned CLI.
+func (b *tgCmdBuilder) renderJSON(outPath string) []string {
+	if b.usesRedesignedCLI() {
+		return b.run("render-json", "--out", outPath)
+	}
+
+	return b.run("render-json", "--terragrunt-json-out", outPath)
+}
+
+// withWorkingDir appends the working directory to a command.
+func withWorkingDir(tgCmd []string, tgWorkDir string) []string {
+	return append(tgCmd, "--working-dir", tgWorkDir)
+}
+
+// parseTerragruntVersion parses the version from the output of terragrunt --version
+// (e.g., "terragrunt version v0.80.2").
+func parseTerragruntVersion(versionOut string) (tgVersion, error) {
+	matches := tgVersionRegex.FindStringSubmatch(strings.TrimSpace(versionOut))
+	if matches == nil {
+		return tgVersion{}, fmt.Errorf("no Terragrunt version found in %q", strings.TrimSpace(versionOut))
+	}
+
+	// The regex only matches digits, so the conversions can't fail.
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	patch, _ := strconv.Atoi(matches[3])
+
+	return tgVersion{Major: major, Minor: minor, Patch: patch}, nil
+}
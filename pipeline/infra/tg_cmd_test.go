@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTerragruntVersion(t *testing.T) {
+	testCases := []struct {
+		name       string
+		versionOut string
+		want       tgVersion
+		wantErr    bool
+	}{
+		{name: "release", versionOut: "terragrunt version v0.80.2\n", want: tgVersion{Major: 0, Minor: 80, Patch: 2}},
+		{name: "without v prefix", versionOut: "terragrunt version 0.77.22", want: tgVersion{Major: 0, Minor: 77, Patch: 22}},
+		{name: "pre-release", versionOut: "terragrunt version v1.0.0-rc1", want: tgVersion{Major: 1, Minor: 0, Patch: 0}},
+		{name: "dev build", versionOut: "terragrunt version latest", wantErr: true},
+		{name: "empty output", versionOut: "", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTerragruntVersion(tc.versionOut)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got version %s", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestTgCmdBuilderRun(t *testing.T) {
+	legacy := newTgCmdBuilderForVersion(tgVersion{Major: 0, Minor: 77, Patch: 22})
+	redesigned := newTgCmdBuilderForVersion(tgCLIRedesignVersion)
+
+	testCases := []struct {
+		name    string
+		builder *tgCmdBuilder
+		args    []string
+		want    string
+	}{
+		{name: "legacy plan", builder: legacy, args: []string{"plan", "-detailed-exitcode"}, want: "terragrunt plan -detailed-exitcode"},
+		{name: "legacy run-all", builder: legacy, args: []string{"run-all", "apply"}, want: "terragrunt run-all apply"},
+		{name: "redesigned plan", builder: redesigned, args: []string{"plan", "-detailed-exitcode"}, want: "terragrunt plan -detailed-exitcode"},
+		{name: "redesigned run-all", builder: redesigned, args: []string{"run-all", "apply"}, want: "terragrunt run --all apply"},
+		{name: "redesigned hclfmt", builder: redesigned, args: []string{"hclfmt", "--check"}, want: "terragrunt hcl fmt --check"},
+		{name: "redesigned validate-inputs", builder: redesigned, args: []string{"validate-inputs"}, want: "terragrunt hcl validate --inputs"},
+		{name: "redesigned terragrunt-info", builder: redesigned, args: []string{"terragrunt-info"}, want: "terragrunt info print"},
+		{name: "redesigned graph-dependencies", builder: redesigned, args: []string{"graph-dependencies"}, want: "terragrunt dag graph"},
+		{name: "redesigned legacy name as argument", builder: redesigned, args: []string{"output", "hclfmt"}, want: "terragrunt output hclfmt"},
+		{name: "no arguments", builder: redesigned, want: "terragrunt"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := strings.Join(tc.builder.run(tc.args...), " "); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestTgCmdBuilderRenderJSON(t *testing.T) {
+	legacy := newTgCmdBuilderForVersion(tgVersion{Major: 0, Minor: 77, Patch: 0})
+	if got := strings.Join(legacy.renderJSON("/tmp/out.json"), " "); got != "terragrunt render-json --terragrunt-json-out /tmp/out.json" {
+		t.Fatalf("unexpected legacy command %q", got)
+	}
+
+	redesigned := newTgCmdBuilderForVersion(tgVersion{Major: 0, Minor: 80, Patch: 2})
+	if got := strings.Join(redesigned.renderJSON("/tmp/out.json"), " "); got != "terragrunt render --json --write --out /tmp/out.json" {
+		t.Fatalf("unexpected redesigned command %q", got)
+	}
+}
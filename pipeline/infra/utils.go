@@ -2,8 +2,12 @@
 
 import (
 	"context"
+	"crypto/sha256"
 	"dagger/infra/internal/dagger"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"path"
 	"path/filepath"
 	"strings"
 )
@@ -20,6 +24,21 @@ func getTFInstallCmd(tfVersion string) string {
 	return strings.TrimSpace(command)
 }
 
+func getSOPSInstallationCommand(version string) string {
+	installPath := "/usr/local/bin/sops"
+	// The binary is verified against the checksums published with the release, before it's installed.
+	command := fmt.Sprintf(`set -e
+apk add --no-cache curl
+cd "$(mktemp -d)"
+curl -sSLf https://github.com/getsops/sops/releases/download/v%[1]s/sops-v%[1]s.linux.amd64 -o sops-v%[1]s.linux.amd64
+curl -sSLf https://github.com/getsops/sops/releases/download/v%[1]s/sops-v%[1]s.checksums.txt -o checksums.txt
+grep " sops-v%[1]s.linux.amd64$" checksums.txt > sops.sha256
+sha256sum -c sops.sha256
+install -m 0755 sops-v%[1]s.linux.amd64 %[2]s`, version, installPath)
+
+	return strings.TrimSpace(command)
+}
+
 func getTerragruntInstallationCommand(version string) string {
 	installDir := "/usr/local/bin"
 	installPath := filepath.Join(installDir, "terragrunt")
@@ -87,41 +106,240 @@ func getTerraformModulesExecutionPath(moduleName string) string {
 	return filepath.Join(configRefArchATerraformModulesRootPath, moduleName)
 }
 
+// getNormalisedPreviewID turns a branch name or a merge request ID into a valid preview ID.
+// It lowercases the value, and replaces anything that isn't a letter or a digit with '-', so it can be
+// used both in the remote state key and in resource names. IDs longer than previewIDMaxLength are
+// truncated, and end with a short hash of the whole ID, so branches sharing a long prefix don't share a
+// preview. The Terragrunt configuration (preview_id in infra/terragrunt/config.hcl) normalises
+// TG_STACK_PREVIEW_ID the same way, so the apply, and the teardown, of a preview always resolve to the
+// same state key and resource names.
+func getNormalisedPreviewID(previewID string) (string, error) {
+	var normalised strings.Builder
+
+	lastWasDash := false
+	for _, char := range strings.ToLower(strings.TrimSpace(previewID)) {
+		if (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') {
+			normalised.WriteRune(char)
+			lastWasDash = false
+
+			continue
+		}
+
+		if !lastWasDash && normalised.Len() > 0 {
+			normalised.WriteRune('-')
+			lastWasDash = true
+		}
+	}
+
+	result := strings.Trim(normalised.String(), "-")
+	if result == "" {
+		return "", Errorf("invalid preview ID %q: it must contain at least one letter or digit", previewID)
+	}
+
+	if len(result) > previewIDMaxLength {
+		hash := sha256.Sum256([]byte(result))
+		prefix := strings.Trim(result[:previewIDMaxLength-previewIDHashLength-1], "-")
+		result = prefix + "-" + hex.EncodeToString(hash[:])[:previewIDHashLength]
+	}
+
+	return result, nil
+}
+
+// isSecretKey checks whether a key matches any of the secret key patterns. Matching is case-insensitive.
+func isSecretKey(key string, patterns []string) bool {
+	upperKey := strings.ToUpper(key)
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToUpper(pattern), upperKey); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateSecretKeyPatterns checks every secret key pattern is a valid path.Match pattern.
+func validateSecretKeyPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			return NewError("secret key pattern cannot be empty")
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return WrapErrorf(err, "invalid secret key pattern %q", pattern)
+		}
+	}
+
+	return nil
+}
+
+// Sources of the values of the envVars entries (KEY=VALUE, KEY=env:HOST_VAR, KEY=file:path or KEY=secret:URI).
+const (
+	envVarSourceLiteral = ""
+	envVarSourceEnv     = "env:"
+	envVarSourceFile    = "file:"
+	envVarSourceSecret  = "secret:"
+	// envVarLiteralPrefix escapes a literal value that starts with one of the sources (e.g., KEY=literal:env:x).
+	envVarLiteralPrefix = "literal:"
+)
+
 type EnvVarDagger struct {
 	Key   string
 	Value string
+	// Source is where the value comes from: the literal value (empty), or env:, file: or secret:.
+	Source string
+	// Ref is what the value references, for the env: (host variable), file: (path) and secret: (URI) sources.
+	Ref string
 }
 
+// getEnvVarsDaggerFromSlice parses the envVars entries. The value is everything after the first '=',
+// so it can contain '=' itself (e.g., base64 values, or JDBC URLs). A value can also reference:
+//
+//   - env:HOST_VAR, a variable of the host (the caller of the module), read as a secret.
+//   - file:path/in/src, a file of the source directory, read as the value.
+//   - secret:URI, a Dagger secret URI (e.g., env://VAR, file:///path, op://vault/item/field, vault://path.field).
+//
+// A literal value that starts with one of these prefixes is escaped with literal: (e.g., KEY=literal:env:x sets
+// KEY to env:x); only the first literal: is removed.
+//
+// Errors refer to entries by position and key, since values can be secrets.
 func getEnvVarsDaggerFromSlice(envVars []string) ([]EnvVarDagger, error) {
 	envVarsDagger := []EnvVarDagger{}
-	for _, envVar := range envVars {
+	for idx, envVar := range envVars {
 		trimmedEnvVar := strings.TrimSpace(envVar)
 		if trimmedEnvVar == "" {
-			return nil, NewError("environment variable cannot be empty")
+			return nil, Errorf("environment variable at position %d cannot be empty", idx)
 		}
 
-		if !strings.Contains(trimmedEnvVar, "=") {
-			return nil, NewError(fmt.Sprintf("environment variable must be in the format ENVARKEY=VALUE: %s", trimmedEnvVar))
+		key, value, found := strings.Cut(trimmedEnvVar, "=")
+		key = strings.TrimSpace(key)
+
+		if !found {
+			return nil, Errorf("environment variable at position %d must be in the format ENVARKEY=VALUE", idx)
 		}
 
-		parts := strings.Split(trimmedEnvVar, "=")
-		if len(parts) != 2 {
-			return nil, NewError(fmt.Sprintf("environment variable must be in the format ENVARKEY=VALUE: %s", trimmedEnvVar))
+		if !envVarNameRegex.MatchString(key) {
+			return nil, Errorf("environment variable at position %d has an invalid key %q, it must start with a letter or '_', followed by letters, digits or '_'", idx, key)
 		}
 
-		envVarsDagger = append(envVarsDagger, EnvVarDagger{
-			Key:   parts[0],
-			Value: parts[1],
-		})
+		if literal, isLiteral := strings.CutPrefix(value, envVarLiteralPrefix); isLiteral {
+			envVarsDagger = append(envVarsDagger, EnvVarDagger{Key: key, Value: literal})
+
+			continue
+		}
+
+		envVarDagger := EnvVarDagger{Key: key, Value: value}
+
+		for _, source := range []string{envVarSourceEnv, envVarSourceFile, envVarSourceSecret} {
+			if ref, isRef := strings.CutPrefix(value, source); isRef {
+				envVarDagger = EnvVarDagger{Key: key, Source: source, Ref: strings.TrimSpace(ref)}
+
+				break
+			}
+		}
+
+		if err := validateEnvVarRef(envVarDagger); err != nil {
+			return nil, WrapErrorf(err, "environment variable %s at position %d has an invalid reference", key, idx)
+		}
+
+		envVarsDagger = append(envVarsDagger, envVarDagger)
 	}
 
 	return envVarsDagger, nil
 }
 
+// validateEnvVarRef checks the reference of an envVars entry is well-formed, for its source.
+func validateEnvVarRef(envVar EnvVarDagger) error {
+	switch envVar.Source {
+	case envVarSourceEnv:
+		if !envVarNameRegex.MatchString(envVar.Ref) {
+			return fmt.Errorf("env: must be followed by the name of a host environment variable, got %q", envVar.Ref)
+		}
+	case envVarSourceFile:
+		cleanPath := filepath.Clean(envVar.Ref)
+		if envVar.Ref == "" || filepath.IsAbs(cleanPath) || cleanPath == ".." || strings.HasPrefix(cleanPath, "../") {
+			return fmt.Errorf("file: must be followed by a path relative to the source directory, got %q", envVar.Ref)
+		}
+	case envVarSourceSecret:
+		if scheme, rest, found := strings.Cut(envVar.Ref, "://"); !found || scheme == "" || rest == "" {
+			// The reference itself isn't part of the error, since a malformed URI could be a secret value.
+			return errors.New("secret: must be followed by a Dagger secret URI (e.g., env://VAR, op://vault/item/field)")
+		}
+	}
+
+	return nil
+}
+
+// namedSecretTarget is where a named secret is set: an environment variable, or a file path.
+type namedSecretTarget struct {
+	EnvVar   string
+	FilePath string
+}
+
+// getNamedSecretTargets parses the keys of WithNamedSecrets: an environment variable name, or
+// file: followed by an absolute path. Keys are never secret, so they're part of the errors.
+func getNamedSecretTargets(keys []string) ([]namedSecretTarget, error) {
+	targets := make([]namedSecretTarget, 0, len(keys))
+	seen := make(map[string]int, len(keys))
+
+	for idx, key := range keys {
+		key = strings.TrimSpace(key)
+
+		var target namedSecretTarget
+
+		if filePath, isFile := strings.CutPrefix(key, envVarSourceFile); isFile {
+			filePath = strings.TrimSpace(filePath)
+			if !filepath.IsAbs(filePath) {
+				return nil, fmt.Errorf("secret key at position %d, %q, must be followed by an absolute path after file:", idx, key)
+			}
+
+			target.FilePath = filepath.Clean(filePath)
+		} else {
+			if !envVarNameRegex.MatchString(key) {
+				return nil, fmt.Errorf("secret key at position %d, %q, must be an environment variable name, or file:/absolute/path", idx, key)
+			}
+
+			target.EnvVar = key
+		}
+
+		name := target.EnvVar + target.FilePath
+		if firstIdx, duplicated := seen[name]; duplicated {
+			return nil, fmt.Errorf("secret key at position %d, %q, duplicates the one at position %d", idx, key, firstIdx)
+		}
+
+		seen[name] = idx
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
 // parseDotEnvFiles processes .env files found by WithDotEnvFile.
-// It handles basic .env syntax including comments (#), empty lines,
-// KEY=VALUE pairs, whitespace trimming, and basic quote removal (' or ").
-func parseDotEnvFiles(ctx context.Context, container *dagger.Container, src *dagger.Directory, envFiles []string) (*dagger.Container, error) {
+// Each file is parsed with parseDotEnvContent, which follows the common dotenv semantics
+// (export prefix, comments, quotes, escapes, multi-line values and variable expansion).
+// Files are layered in the order they're passed: a key defined in a later file overrides
+// the earlier one, and can reference the keys of the files loaded before it.
+// SOPS-encrypted files are decrypted first, and their values are always secret; otherwise,
+// values are secret when the file name contains "secret", the key matches a secret key pattern,
+// or the value expands a secret key.
+func parseDotEnvFiles(
+	ctx context.Context,
+	src *dagger.Directory,
+	envFiles []string,
+	decrypter *sopsDecrypter,
+	secretKeyPatterns []string,
+) ([]dotEnvVar, error) {
+	dotEnvVars := []dotEnvVar{}
+	keyIndex := map[string]int{}
+
+	lookup := func(key string) (string, bool) {
+		if idx, ok := keyIndex[key]; ok {
+			return dotEnvVars[idx].Value, true
+		}
+
+		return "", false
+	}
+
 	for _, file := range envFiles {
 		fileContent, err := src.File(file).Contents(ctx)
 		if err != nil {
@@ -129,50 +347,58 @@ func parseDotEnvFiles(ctx context.Context, container *dagger.Container, src *dag
 			return nil, fmt.Errorf("failed to read dot env file '%s': %w", file, err)
 		}
 
-		lines := strings.Split(fileContent, "\n")
+		isEncrypted := isSOPSEncrypted(fileContent, sopsFormatDotEnv)
+		if isEncrypted {
+			decrypted, err := decrypter.decrypt(ctx, file, sopsFormatDotEnv)
+			if err != nil {
+				return nil, err
+			}
 
-		for lineNum, line := range lines {
-			trimmedLine := strings.TrimSpace(line)
+			fileContent = decrypted
+		}
 
-			// Skip empty lines and comments
-			if trimmedLine == "" || strings.HasPrefix(trimmedLine, "#") {
-				continue
-			}
+		envVars, references, err := parseDotEnvContentWithReferences(file, fileContent, lookup)
+		if err != nil {
+			return nil, err
+		}
 
-			// Split line into key/value pair by the first '='
-			parts := strings.SplitN(trimmedLine, "=", 2)
-			if len(parts) != 2 {
-				// Return error for lines without '='
-				return nil, fmt.Errorf("invalid format in file '%s' on line %d: '%s'", file, lineNum+1, trimmedLine)
-			}
+		// Determine if it's a secret based on filename
+		isSecret := isEncrypted || strings.Contains(file, "secret")
 
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
+		// A value that expands a secret (e.g., DB_URL=postgres://u:${DB_PASSWORD}@h) is a secret too. The
+		// keys are processed in the order they're defined, so the keys they reference are classified first.
+		isTainted := func(key string) bool {
+			for _, reference := range references[key] {
+				if isSecretKey(reference, secretKeyPatterns) {
+					return true
+				}
 
-			// Check for empty key
-			if key == "" {
-				return nil, fmt.Errorf("empty key found in file '%s' on line %d: '%s'", file, lineNum+1, trimmedLine)
+				if idx, defined := keyIndex[reference]; defined && dotEnvVars[idx].Secret {
+					return true
+				}
 			}
 
-			// Trim surrounding quotes (basic handling)
-			if len(value) >= 2 {
-				if (value[0] == '"' && value[len(value)-1] == '"') || (value[0] == '\'' && value[len(value)-1] == '\'') {
-					value = value[1 : len(value)-1]
-				}
+			return false
+		}
+
+		for _, envVar := range envVars {
+			layeredVar := dotEnvVar{
+				Key:    envVar.Key,
+				Value:  envVar.Value,
+				Source: file,
+				Secret: isSecret || isSecretKey(envVar.Key, secretKeyPatterns) || isTainted(envVar.Key),
 			}
 
-			// Determine if it's a secret based on filename
-			isSecret := strings.Contains(file, "secret")
+			if idx, defined := keyIndex[envVar.Key]; defined {
+				dotEnvVars[idx] = layeredVar
 
-			if isSecret {
-				// Use a distinct name for the Dagger secret object itself
-				secretName := fmt.Sprintf("%s_secret_%s", key, file)
-				container = container.WithSecretVariable(key, dag.SetSecret(secretName, value))
-			} else {
-				container = container.WithEnvVariable(key, value)
+				continue
 			}
+
+			keyIndex[envVar.Key] = len(dotEnvVars)
+			dotEnvVars = append(dotEnvVars, layeredVar)
 		}
 	}
 
-	return container, nil
+	return dotEnvVars, nil
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetNormalisedPreviewID(t *testing.T) {
+	testCases := []struct {
+		name      string
+		previewID string
+		want      string
+		wantErr   bool
+	}{
+		{name: "merge request ID", previewID: "1234", want: "1234"},
+		{name: "branch name", previewID: " Feature/JIRA-1234_Add ", want: "feature-jira-1234-add"},
+		{name: "exactly the maximum length", previewID: strings.Repeat("a", 32), want: strings.Repeat("a", 32)},
+		{name: "truncated with a hash", previewID: "feature/jira-1234-add-something-a", want: "feature-jira-1234-add-s-693441bc"},
+		{name: "truncated on a dash", previewID: "feature/jira-1234-abcd/more-words-here", want: "feature-jira-1234-abcd-8ce9241d"},
+		{name: "no letters or digits", previewID: "--/--", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getNormalisedPreviewID(tc.previewID)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+
+			if len(got) > previewIDMaxLength {
+				t.Fatalf("expected at most %d characters, got %d", previewIDMaxLength, len(got))
+			}
+		})
+	}
+}
+
+func TestGetNormalisedPreviewIDSharedPrefix(t *testing.T) {
+	first, err := getNormalisedPreviewID("feature/jira-1234-add-something-a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	second, err := getNormalisedPreviewID("feature/jira-1234-add-something-b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if first == second {
+		t.Fatalf("expected branches sharing their first 32 characters to get different preview IDs, both got %q", first)
+	}
+}
+
+func TestGetEnvVarsDaggerFromSlice(t *testing.T) {
+	testCases := []struct {
+		name    string
+		envVar  string
+		want    EnvVarDagger
+		wantErr bool
+	}{
+		{name: "literal value", envVar: "A=b=c", want: EnvVarDagger{Key: "A", Value: "b=c"}},
+		{name: "host variable", envVar: "A=env:HOST_VAR", want: EnvVarDagger{Key: "A", Source: envVarSourceEnv, Ref: "HOST_VAR"}},
+		{name: "file", envVar: "A=file:config/value.txt", want: EnvVarDagger{Key: "A", Source: envVarSourceFile, Ref: "config/value.txt"}},
+		{name: "secret URI", envVar: "A=secret:op://vault/item/field", want: EnvVarDagger{Key: "A", Source: envVarSourceSecret, Ref: "op://vault/item/field"}},
+		{name: "escaped env prefix", envVar: "A=literal:env:not a variable", want: EnvVarDagger{Key: "A", Value: "env:not a variable"}},
+		{name: "escaped secret prefix", envVar: "A=literal:secret:", want: EnvVarDagger{Key: "A", Value: "secret:"}},
+		{name: "escaped literal prefix", envVar: "A=literal:literal:x", want: EnvVarDagger{Key: "A", Value: "literal:x"}},
+		{name: "empty literal", envVar: "A=literal:", want: EnvVarDagger{Key: "A", Value: ""}},
+		{name: "invalid host variable", envVar: "A=env:not a variable", wantErr: true},
+		{name: "file outside the source directory", envVar: "A=file:../secret", wantErr: true},
+		{name: "invalid key", envVar: "1A=b", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getEnvVarsDaggerFromSlice([]string{tc.envVar})
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(got) != 1 || got[0] != tc.want {
+				t.Fatalf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
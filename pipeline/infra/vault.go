@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"dagger/infra/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	vaultAuthMethodToken   = "token"
+	vaultAuthMethodAppRole = "approle"
+	vaultAuthMethodJWT     = "jwt"
+	vaultDefaultKVVersion  = 2
+	vaultServicePort       = 8200
+	// vaultRequestTimeout is the timeout of every request to the Vault API.
+	vaultRequestTimeout = 30 * time.Second
+)
+
+// vaultSecretRef represents a reference to a field of a Vault KV secret, in the ENV_VAR=MOUNT/PATH[#FIELD] format.
+type vaultSecretRef struct {
+	EnvVar string // EnvVar is the name of the secret variable the value is exposed as.
+	Mount  string // Mount is the KV secrets engine mount (the first segment of the path).
+	Path   string // Path is the path of the secret, within the mount.
+	Field  string // Field is the field of the secret to read. Optional, when the secret has a single field.
+}
+
+// vaultResponse represents the parts of a Vault API response that are used.
+type vaultResponse struct {
+	Errors []string        `json:"errors"`
+	Data   json.RawMessage `json:"data"`
+	Auth   *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+// vaultAWSCredentials represents the data of the dynamic credentials of the AWS secrets engine.
+type vaultAWSCredentials struct {
+	AccessKey     string `json:"access_key"`
+	SecretKey     string `json:"secret_key"`
+	SecurityToken string `json:"security_token"`
+}
+
+// WithVaultSecrets reads secrets from HashiCorp Vault, and sets them as secret variables in the container.
+//
+// It authenticates with a token, AppRole or JWT (e.g., a CI OIDC token), then reads every KV secret listed in
+// kvSecrets (ENV_VAR=MOUNT/PATH[#FIELD], e.g., DB_PASSWORD=secret/app/db#password), and optionally requests
+// dynamic AWS credentials (e.g., aws/creds/deployer), set as AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN. The requests are sent from the module itself, so neither the token, the login payloads,
+// nor the responses, are ever part of a command, or written to the container; every value is exposed only as
+// a secret variable.
+//
+// Parameters:
+//   - ctx: The context for the Dagger container.
+//   - vaultAddr: Optional. The address of Vault. Defaults to VAULT_ADDR, or the bound Vault service.
+//   - vaultNamespace: Optional. The Vault (Enterprise) namespace.
+//   - vaultService: Optional. A Vault service (e.g., a dev server) to read the secrets from.
+//   - authMethod: Optional. The auth method: token, approle or jwt. Defaults to token.
+//   - authMount: Optional. The mount of the auth method. Defaults to the auth method name.
+//   - vaultToken: Optional. The Vault token, for the token auth method.
+//   - appRoleID: Optional. The AppRole role ID, for the approle auth method.
+//   - appRoleSecretID: Optional. The AppRole secret ID, for the approle auth method.
+//   - jwtRole: Optional. The role to log in with, for the jwt auth method.
+//   - jwt: Optional. The JWT, for the jwt auth method.
+//   - kvSecrets: Optional. The KV secrets to read, in the ENV_VAR=MOUNT/PATH[#FIELD] format.
+//   - kvVersion: Optional. The version of the KV secrets engine (1 or 2). Defaults to 2.
+//   - awsCredsPath: Optional. The path of the dynamic AWS credentials (e.g., aws/creds/deployer).
+//
+// Returns:
+//   - *Infra: The updated Infra instance with the Vault secrets set as secret variables
+//   - error: An error if the authentication fails, or any of the secrets can't be read
+func (m *Infra) WithVaultSecrets(
+	// ctx is the context for the Dagger container.
+	// +optional
+	ctx context.Context,
+	// vaultAddr is the address of Vault. Defaults to VAULT_ADDR, or the bound Vault service.
+	// +optional
+	vaultAddr string,
+	// vaultNamespace is the Vault (Enterprise) namespace.
+	// +optional
+	vaultNamespace string,
+	// vaultService is a Vault service (e.g., a dev server) to read the secrets from.
+	// +optional
+	vaultService *dagger.Service,
+	// authMethod is the auth method: token, approle or jwt. Defaults to token.
+	// +optional
+	authMethod string,
+	// authMount is the mount of the auth method. Defaults to the auth method name.
+	// +optional
+	authMount string,
+	// vaultToken is the Vault token, for the token auth method.
+	// +optional
+	vaultToken *dagger.Secret,
+	// appRoleID is the AppRole role ID, for the approle auth method.
+	// +optional
+	appRoleID string,
+	// appRoleSecretID is the AppRole secret ID, for the approle auth method.
+	// +optional
+	appRoleSecretID *dagger.Secret,
+	// jwtRole is the role to log in with, for the jwt auth method.
+	// +optional
+	jwtRole string,
+	// jwt is the JWT, for the jwt auth method.
+	// +optional
+	jwt *dagger.Secret,
+	// kvSecrets are the KV secrets to read, in the ENV_VAR=MOUNT/PATH[#FIELD] format.
+	// +optional
+	kvSecrets []string,
+	// kvVersion is the version of the KV secrets engine (1 or 2). Defaults to 2.
+	// +optional
+	kvVersion int,
+	// awsCredsPath is the path of the dynamic AWS credentials (e.g., aws/creds/deployer).
+	// +optional
+	awsCredsPath string,
+) (*Infra, error) {
+	if kvVersion == 0 {
+		kvVersion = vaultDefaultKVVersion
+	}
+
+	if kvVersion != 1 && kvVersion != 2 {
+		return nil, Errorf("invalid Vault KV version %d, it must be 1 or 2", kvVersion)
+	}
+
+	secretRefs, err := getVaultSecretRefs(kvSecrets)
+	if err != nil {
+		return nil, WrapErrorf(err, "invalid Vault KV secrets")
+	}
+
+	if vaultService != nil && vaultAddr == "" {
+		serviceAddr, err := vaultService.Endpoint(ctx, dagger.ServiceEndpointOpts{Port: vaultServicePort, Scheme: "http"})
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to get the address of the Vault service")
+		}
+
+		vaultAddr = serviceAddr
+	}
+
+	if vaultAddr == "" {
+		envAddr, err := m.Ctr.EnvVariable(ctx, "VAULT_ADDR")
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to get VAULT_ADDR from the container")
+		}
+
+		vaultAddr = envAddr
+	}
+
+	vaultAddr = strings.TrimRight(strings.TrimSpace(vaultAddr), "/")
+	if vaultAddr == "" {
+		return nil, NewError("the Vault address is required: pass vaultAddr, set VAULT_ADDR, or pass a Vault service")
+	}
+
+	client := &vaultClient{
+		httpClient: &http.Client{Timeout: vaultRequestTimeout},
+		addr:       vaultAddr,
+		namespace:  vaultNamespace,
+	}
+
+	token, err := client.login(ctx, authMethod, authMount, vaultToken, appRoleID, appRoleSecretID, jwtRole, jwt)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to authenticate against Vault at %s", vaultAddr)
+	}
+
+	for _, ref := range secretRefs {
+		data, err := client.read(ctx, getVaultKVReadPath(ref, kvVersion), token)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to read the Vault secret %s/%s", ref.Mount, ref.Path)
+		}
+
+		value, err := getVaultSecretField(data, ref, kvVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Ctr = m.Ctr.
+			WithSecretVariable(ref.EnvVar, dag.SetSecret(fmt.Sprintf("VAULT_%s_%s", ref.EnvVar, uuid.New().String()), value))
+	}
+
+	if awsCredsPath != "" {
+		data, err := client.read(ctx, strings.Trim(awsCredsPath, "/"), token)
+		if err != nil {
+			return nil, WrapErrorf(err, "failed to get dynamic AWS credentials from Vault at %s", awsCredsPath)
+		}
+
+		var awsCreds vaultAWSCredentials
+		if err := json.Unmarshal(data, &awsCreds); err != nil || awsCreds.AccessKey == "" || awsCreds.SecretKey == "" {
+			return nil, Errorf("the Vault path %s returned no AWS credentials", awsCredsPath)
+		}
+
+		credsID := uuid.New().String()
+
+		m.Ctr = m.Ctr.
+			WithoutEnvVariable("AWS_PROFILE").
+			WithSecretVariable("AWS_ACCESS_KEY_ID", dag.SetSecret("VAULT_AWS_ACCESS_KEY_ID_"+credsID, awsCreds.AccessKey)).
+			WithSecretVariable("AWS_SECRET_ACCESS_KEY", dag.SetSecret("VAULT_AWS_SECRET_ACCESS_KEY_"+credsID, awsCreds.SecretKey))
+
+		if awsCreds.SecurityToken != "" {
+			m.Ctr = m.Ctr.
+				WithSecretVariable("AWS_SESSION_TOKEN", dag.SetSecret("VAULT_AWS_SESSION_TOKEN_"+credsID, awsCreds.SecurityToken))
+		} else {
+			m.Ctr = m.Ctr.
+				WithoutEnvVariable("AWS_SESSION_TOKEN")
+		}
+	}
+
+	return m, nil
+}
+
+// vaultClient runs requests against the Vault HTTP API.
+type vaultClient struct {
+	httpClient *http.Client
+	addr       string
+	namespace  string
+}
+
+// login authenticates against Vault with the given auth method, and returns the client token.
+func (c *vaultClient) login(
+	ctx context.Context,
+	authMethod, authMount string,
+	vaultToken *dagger.Secret,
+	appRoleID string,
+	appRoleSecretID *dagger.Secret,
+	jwtRole string,
+	jwt *dagger.Secret,
+) (string, error) {
+	if authMethod == "" {
+		authMethod = vaultAuthMethodToken
+	}
+
+	if authMount == "" {
+		authMount = authMethod
+	}
+
+	var payload map[string]string
+
+	switch authMethod {
+	case vaultAuthMethodToken:
+		if vaultToken == nil {
+			return "", NewError("the Vault token is required for the token auth method")
+		}
+
+		token, err := vaultToken.Plaintext(ctx)
+		if err != nil {
+			return "", WrapError(err, "failed to read the Vault token")
+		}
+
+		if strings.TrimSpace(token) == "" {
+			return "", NewError("the Vault token is empty")
+		}
+
+		return strings.TrimSpace(token), nil
+	case vaultAuthMethodAppRole:
+		if appRoleID == "" || appRoleSecretID == nil {
+			return "", NewError("both the role ID, and the secret ID, are required for the approle auth method")
+		}
+
+		secretID, err := appRoleSecretID.Plaintext(ctx)
+		if err != nil {
+			return "", WrapError(err, "failed to read the AppRole secret ID")
+		}
+
+		payload = map[string]string{"role_id": appRoleID, "secret_id": strings.TrimSpace(secretID)}
+	case vaultAuthMethodJWT:
+		if jwtRole == "" || jwt == nil {
+			return "", NewError("both the role, and the JWT, are required for the jwt auth method")
+		}
+
+		jwtValue, err := jwt.Plaintext(ctx)
+		if err != nil {
+			return "", WrapError(err, "failed to read the JWT")
+		}
+
+		payload = map[string]string{"role": jwtRole, "jwt": strings.TrimSpace(jwtValue)}
+	default:
+		return "", Errorf("unsupported Vault auth method %q, it must be one of: %s, %s, %s",
+			authMethod, vaultAuthMethodToken, vaultAuthMethodAppRole, vaultAuthMethodJWT)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", WrapError(err, "failed to build the Vault login request")
+	}
+
+	resp, err := c.request(ctx, fmt.Sprintf("auth/%s/login", strings.Trim(authMount, "/")), "", string(body))
+	if err != nil {
+		return "", WrapErrorf(err, "failed to log in with the %s auth method", authMethod)
+	}
+
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", Errorf("logging in with the %s auth method returned no token", authMethod)
+	}
+
+	return resp.Auth.ClientToken, nil
+}
+
+// read reads a path of the Vault API with the given token, and returns its data.
+func (c *vaultClient) read(ctx context.Context, path, token string) (json.RawMessage, error) {
+	resp, err := c.request(ctx, path, token, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Data) == 0 || string(resp.Data) == "null" {
+		return nil, Errorf("the Vault path %s has no data", path)
+	}
+
+	return resp.Data, nil
+}
+
+// request runs a request against the Vault API. With a body, it's a POST request; otherwise, it's a GET request.
+// Neither the token, the body, nor the response, are ever part of the returned errors.
+func (c *vaultClient) request(ctx context.Context, path, token, body string) (*vaultResponse, error) {
+	method := http.MethodGet
+	var reqBody io.Reader
+
+	if body != "" {
+		method = http.MethodPost
+		reqBody = bytes.NewBufferString(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/v1/%s", c.addr, strings.TrimLeft(path, "/")), reqBody)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to create the Vault request to %s", path)
+	}
+
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to run the Vault request to %s", path)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, WrapErrorf(err, "failed to read the response of the Vault request to %s", path)
+	}
+
+	return parseVaultResponse(resp.StatusCode, string(respBody))
+}
+
+// parseVaultResponse parses a response of the Vault API, turning the error statuses into errors.
+// Vault error messages don't contain secrets, so they're part of the returned errors.
+func parseVaultResponse(statusCode int, body string) (*vaultResponse, error) {
+	var resp vaultResponse
+
+	if strings.TrimSpace(body) != "" {
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			return nil, Errorf("the Vault response (status %d) isn't valid JSON", statusCode)
+		}
+	}
+
+	if statusCode < 200 || statusCode > 299 {
+		if len(resp.Errors) > 0 {
+			return nil, Errorf("Vault returned status %d: %s", statusCode, strings.Join(resp.Errors, "; "))
+		}
+
+		return nil, Errorf("Vault returned status %d", statusCode)
+	}
+
+	return &resp, nil
+}
+
+// getVaultSecretRefs parses the Vault KV secrets passed in the ENV_VAR=MOUNT/PATH[#FIELD] format.
+func getVaultSecretRefs(kvSecrets []string) ([]vaultSecretRef, error) {
+	refs := make([]vaultSecretRef, 0, len(kvSecrets))
+	seen := make(map[string]bool, len(kvSecrets))
+
+	for _, kvSecret := range kvSecrets {
+		envVar, location, found := strings.Cut(strings.TrimSpace(kvSecret), "=")
+		envVar = strings.TrimSpace(envVar)
+
+		if !found || !envVarNameRegex.MatchString(envVar) {
+			return nil, Errorf("Vault KV secret must be in the format ENV_VAR=MOUNT/PATH[#FIELD]: %s", kvSecret)
+		}
+
+		if seen[envVar] {
+			return nil, Errorf("Vault KV secret for %s is set more than once", envVar)
+		}
+
+		location, field, _ := strings.Cut(strings.TrimSpace(location), "#")
+		mount, path, found := strings.Cut(strings.Trim(location, "/"), "/")
+
+		if !found || mount == "" || strings.Trim(path, "/") == "" {
+			return nil, Errorf("Vault KV secret for %s must have both a mount and a path (MOUNT/PATH): %s", envVar, location)
+		}
+
+		seen[envVar] = true
+		refs = append(refs, vaultSecretRef{
+			EnvVar: envVar,
+			Mount:  mount,
+			Path:   strings.Trim(path, "/"),
+			Field:  strings.TrimSpace(field),
+		})
+	}
+
+	return refs, nil
+}
+
+// getVaultKVReadPath returns the API path to read a KV secret; the KV v2 engine reads it under MOUNT/data/PATH.
+func getVaultKVReadPath(ref vaultSecretRef, kvVersion int) string {
+	if kvVersion == 2 {
+		return fmt.Sprintf("%s/data/%s", ref.Mount, ref.Path)
+	}
+
+	return fmt.Sprintf("%s/%s", ref.Mount, ref.Path)
+}
+
+// getVaultSecretField returns a field of the data of a KV secret. When no field is referenced, the secret
+// must have a single field. Values that aren't strings are returned as JSON.
+func getVaultSecretField(data json.RawMessage, ref vaultSecretRef, kvVersion int) (string, error) {
+	var fields map[string]json.RawMessage
+
+	if kvVersion == 2 {
+		var kvV2 struct {
+			Data map[string]json.RawMessage `json:"data"`
+		}
+
+		if err := json.Unmarshal(data, &kvV2); err != nil {
+			return "", Errorf("the Vault secret %s/%s isn't a KV v2 secret", ref.Mount, ref.Path)
+		}
+
+		fields = kvV2.Data
+	} else if err := json.Unmarshal(data, &fields); err != nil {
+		return "", Errorf("the Vault secret %s/%s isn't a KV v1 secret", ref.Mount, ref.Path)
+	}
+
+	field := ref.Field
+	if field == "" {
+		if len(fields) != 1 {
+			return "", Errorf("the Vault secret %s/%s has %d fields, reference one of them with #FIELD", ref.Mount, ref.Path, len(fields))
+		}
+
+		for name := range fields {
+			field = name
+		}
+	}
+
+	raw, ok := fields[field]
+	if !ok {
+		return "", Errorf("the Vault secret %s/%s has no field %s", ref.Mount, ref.Path, field)
+	}
+
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value, nil
+	}
+
+	return string(raw), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"dagger/infra/internal/dagger"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testVaultRootToken = "root-token"
+	testVaultDevImage  = "hashicorp/vault:1.17"
+)
+
+// newTestVaultServer returns a fake Vault, with an AppRole login and a KV v2 secret (secret/app/db).
+func newTestVaultServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/auth/approle/login":
+			body, _ := io.ReadAll(r.Body)
+
+			var payload map[string]string
+			if err := json.Unmarshal(body, &payload); err != nil || payload["role_id"] != "role" || payload["secret_id"] != "secret-id" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors": ["invalid role or secret ID"]}`))
+
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"auth": {"client_token": "` + testVaultRootToken + `"}}`))
+		case r.Header.Get("X-Vault-Token") != testVaultRootToken:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors": ["permission denied"]}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/secret/data/app/db":
+			_, _ = w.Write([]byte(`{"data": {"data": {"password": "s3cr3t", "port": 5432}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors": []}`))
+		}
+	}))
+}
+
+func TestVaultClient(t *testing.T) {
+	server := newTestVaultServer(t)
+	defer server.Close()
+
+	client := &vaultClient{httpClient: server.Client(), addr: server.URL}
+	ctx := context.Background()
+
+	token, err := client.login(ctx, vaultAuthMethodAppRole, "", nil, "role", nil, "", nil)
+	if err == nil || token != "" {
+		t.Fatalf("expected an error without the AppRole secret ID, got token %q", token)
+	}
+
+	resp, err := client.request(ctx, "auth/approle/login", "", `{"role_id": "role", "secret_id": "secret-id"}`)
+	if err != nil {
+		t.Fatalf("unexpected login error: %v", err)
+	}
+
+	if resp.Auth == nil || resp.Auth.ClientToken != testVaultRootToken {
+		t.Fatalf("expected the client token from the login response, got %+v", resp.Auth)
+	}
+
+	ref := vaultSecretRef{EnvVar: "DB_PASSWORD", Mount: "secret", Path: "app/db", Field: "password"}
+
+	data, err := client.read(ctx, getVaultKVReadPath(ref, 2), testVaultRootToken)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+
+	value, err := getVaultSecretField(data, ref, 2)
+	if err != nil || value != "s3cr3t" {
+		t.Fatalf("expected the password field, got %q (error: %v)", value, err)
+	}
+
+	ref.Field = "port"
+	if value, err := getVaultSecretField(data, ref, 2); err != nil || value != "5432" {
+		t.Fatalf("expected the port field as JSON, got %q (error: %v)", value, err)
+	}
+
+	ref.Field = ""
+	if _, err := getVaultSecretField(data, ref, 2); err == nil || !strings.Contains(err.Error(), "has 2 fields") {
+		t.Fatalf("expected an error about the missing field, got %v", err)
+	}
+
+	_, err = client.read(ctx, getVaultKVReadPath(ref, 2), "wrong-token")
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected a permission denied error, got %v", err)
+	}
+
+	if strings.Contains(err.Error(), "wrong-token") {
+		t.Fatalf("the error has the token: %q", err.Error())
+	}
+
+	if _, err := client.read(ctx, "secret/data/missing", testVaultRootToken); err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestGetVaultSecretRefs(t *testing.T) {
+	refs, err := getVaultSecretRefs([]string{"DB_PASSWORD=secret/app/db#password", " API_KEY = /kv/api/ "})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []vaultSecretRef{
+		{EnvVar: "DB_PASSWORD", Mount: "secret", Path: "app/db", Field: "password"},
+		{EnvVar: "API_KEY", Mount: "kv", Path: "api"},
+	}
+
+	for idx, ref := range want {
+		if refs[idx] != ref {
+			t.Errorf("expected %+v, got %+v", ref, refs[idx])
+		}
+	}
+
+	for _, invalid := range [][]string{{"1A=secret/app"}, {"A=secret"}, {"A=secret/app", "A=secret/other"}, {"secret/app"}} {
+		if _, err := getVaultSecretRefs(invalid); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
+
+// TestWithVaultSecretsDevServer reads a secret from a Vault dev server, run as a service container.
+// It needs a Dagger session (e.g., dagger run go test ./...), and it's skipped otherwise.
+func TestWithVaultSecretsDevServer(t *testing.T) {
+	if os.Getenv("DAGGER_SESSION_PORT") == "" {
+		t.Skip("no Dagger session, run the tests with dagger run")
+	}
+
+	ctx := context.Background()
+	rootToken := dag.SetSecret("VAULT_TEST_ROOT_TOKEN", testVaultRootToken)
+
+	vaultService := dag.Container().
+		From(testVaultDevImage).
+		WithEnvVariable("VAULT_DEV_ROOT_TOKEN_ID", testVaultRootToken).
+		WithEnvVariable("VAULT_DEV_LISTEN_ADDRESS", "0.0.0.0:8200").
+		WithExposedPort(vaultServicePort).
+		AsService(dagger.ContainerAsServiceOpts{UseEntrypoint: true, Args: []string{"server", "-dev"}})
+
+	// The dev server mounts a KV v2 engine at secret/, so the secret is written with the vault CLI.
+	_, err := dag.Container().
+		From(testVaultDevImage).
+		WithServiceBinding("vault", vaultService).
+		WithEnvVariable("VAULT_ADDR", "http://vault:8200").
+		WithSecretVariable("VAULT_TOKEN", rootToken).
+		WithExec([]string{"vault", "kv", "put", "secret/app/db", "password=s3cr3t"}).
+		Sync(ctx)
+	if err != nil {
+		t.Fatalf("failed to write the test secret: %v", err)
+	}
+
+	m := &Infra{Ctr: dag.Container().From("alpine:3.21")}
+
+	m, err = m.WithVaultSecrets(ctx, "", "", vaultService, "", "", rootToken, "", nil, "", nil,
+		[]string{"DB_PASSWORD=secret/app/db#password"}, 0, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out, err := m.Ctr.
+		WithExec([]string{"sh", "-c", `test "$DB_PASSWORD" = s3cr3t && echo ok`}).
+		Stdout(ctx)
+	if err != nil || strings.TrimSpace(out) != "ok" {
+		t.Fatalf("expected DB_PASSWORD to be set from Vault, got %q (error: %v)", out, err)
+	}
+}